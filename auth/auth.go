@@ -0,0 +1,324 @@
+// Package auth signs agent requests with pre-shared secrets and verifies them on the server.
+//
+// The server holds the SHA-256 hash of each agent's secret rather than the secret, so its configuration doesn't give
+// away secrets which may have been used elsewhere too.  That hash is the HMAC key, though, so it is all anyone needs
+// to sign requests as the agent, and the server's configuration must be protected as carefully as the secrets.
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Headers carrying the signature of a request
+const (
+	AgentHeader     = "X-Olympus-Agent"
+	TimestampHeader = "X-Olympus-Timestamp"
+	NonceHeader     = "X-Olympus-Nonce"
+	SignatureHeader = "X-Olympus-Signature"
+)
+
+// DefaultMaxSkew is how far a request's timestamp may be from the server's clock
+const DefaultMaxSkew = 5 * time.Minute
+
+var (
+	ErrUnsigned     = errors.New("request is not signed")
+	ErrUnknownAgent = errors.New("unknown agent")
+	ErrExpired      = errors.New("request timestamp is too old or too new")
+	ErrBadSignature = errors.New("signature does not match")
+	ErrReplayed     = errors.New("request has already been received")
+	ErrForbidden    = errors.New("agent is not allowed to write there")
+)
+
+// Agent is an agent allowed to send data to the server, and what it may write.  Leaving a list empty allows anything.
+type Agent struct {
+	Name string `yaml:"name"`
+	// SecretSHA256 is the hex encoded SHA-256 hash of the agent's secret, which is the key its requests are signed with
+	SecretSHA256 string `yaml:"secret-sha256"`
+	// Keys are the parts of the key tree the agent may write.  Each pattern allows the keys whose leading parts match
+	// it part by part, so "production" and "production/*" both allow "production/network".
+	Keys []string `yaml:"keys,omitempty"`
+	// Branches are patterns of the branches the agent may write
+	Branches []string `yaml:"branches,omitempty"`
+	// Workspaces are patterns of the workspaces the agent may write
+	Workspaces []string `yaml:"workspaces,omitempty"`
+}
+
+// Config lists the agents known to the server
+type Config struct {
+	Agents []Agent `yaml:"agents"`
+}
+
+// LoadConfig reads the server's agent file
+func LoadConfig(file string) (*Config, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &Config{}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(b))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(config); err != nil {
+		return nil, errors.Wrap(err, "while reading agents from "+file)
+	}
+
+	return config, nil
+}
+
+// Load creates a verifier for the agents listed in file
+func Load(file string) (*Verifier, error) {
+	config, err := LoadConfig(file)
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := NewVerifier(config.Agents)
+	if err != nil {
+		return nil, errors.Wrap(err, file)
+	}
+
+	return v, nil
+}
+
+// HashSecret returns the form in which the server keeps a secret, which is also the key requests are signed with
+func HashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// Sign adds the headers which identify the agent and prove it knows its secret.  Body must be the request body.
+func Sign(r *http.Request, agent, secret string, body []byte) {
+	// Reading from memory can't fail
+	sign(r, agent, secret, bytes.NewReader(body), time.Now())
+}
+
+// SignReader signs a request like Sign, reading the body to its end so that it needn't be held in memory
+func SignReader(r *http.Request, agent, secret string, body io.Reader) error {
+	return sign(r, agent, secret, body, time.Now())
+}
+
+func sign(r *http.Request, agent, secret string, body io.Reader, at time.Time) error {
+	sum := sha256.Sum256([]byte(secret))
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+
+	// Makes identical requests sent within the same second distinguishable from replays
+	b := make([]byte, 16)
+	rand.Read(b)
+	nonce := hex.EncodeToString(b)
+
+	mac := newMAC(sum[:], timestamp, nonce, r.Method, r.URL.RequestURI())
+	if _, err := io.Copy(mac, body); err != nil {
+		return errors.Wrap(err, "failed to read body to sign")
+	}
+
+	r.Header.Set(AgentHeader, agent)
+	r.Header.Set(TimestampHeader, timestamp)
+	r.Header.Set(NonceHeader, nonce)
+	r.Header.Set(SignatureHeader, hex.EncodeToString(mac.Sum(nil)))
+	return nil
+}
+
+// signature is the HMAC of everything which must not be changed or reused
+func signature(key []byte, timestamp, nonce, method, uri string, body []byte) []byte {
+	mac := newMAC(key, timestamp, nonce, method, uri)
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// newMAC starts the HMAC of a request, to which the body is still to be written
+func newMAC(key []byte, timestamp, nonce, method, uri string) hash.Hash {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(timestamp + "\n" + nonce + "\n" + method + "\n" + uri + "\n"))
+	return mac
+}
+
+// Verifier checks the signatures of requests from known agents
+type Verifier struct {
+	// MaxSkew is how far a request's timestamp may be from now
+	MaxSkew time.Duration
+
+	keys   map[string][]byte
+	agents map[string]Agent
+	now    func() time.Time
+
+	lock sync.Mutex
+	// seen holds the signatures already accepted, until they would be too old to accept anyway
+	seen map[string]time.Time
+}
+
+// NewVerifier creates a verifier for the agents
+func NewVerifier(agents []Agent) (*Verifier, error) {
+	keys := make(map[string][]byte)
+	byName := make(map[string]Agent)
+	for _, a := range agents {
+		if a.Name == "" {
+			return nil, errors.New("agent has no name")
+		}
+		if _, ok := keys[a.Name]; ok {
+			return nil, errors.Errorf("agent %s is listed twice", a.Name)
+		}
+
+		key, err := hex.DecodeString(a.SecretSHA256)
+		if err != nil || len(key) != sha256.Size {
+			return nil, errors.Errorf("agent %s: secret-sha256 must be a hex encoded SHA-256 hash", a.Name)
+		}
+		keys[a.Name] = key
+
+		for _, p := range append(append(append([]string{}, a.Keys...), a.Branches...), a.Workspaces...) {
+			if _, err := path.Match(p, ""); err != nil {
+				return nil, errors.Errorf("agent %s: bad pattern %s", a.Name, p)
+			}
+		}
+		byName[a.Name] = a
+	}
+
+	return &Verifier{
+		MaxSkew: DefaultMaxSkew,
+		keys:    keys,
+		agents:  byName,
+		now:     time.Now,
+		seen:    make(map[string]time.Time),
+	}, nil
+}
+
+// Verify checks the signature of a request whose body has already been read, returning the name of the agent which
+// sent it
+func (v *Verifier) Verify(r *http.Request, body []byte) (string, error) {
+	agent := r.Header.Get(AgentHeader)
+	timestamp := r.Header.Get(TimestampHeader)
+	nonce := r.Header.Get(NonceHeader)
+	given := r.Header.Get(SignatureHeader)
+
+	if agent == "" || timestamp == "" || nonce == "" || given == "" {
+		return "", ErrUnsigned
+	}
+
+	key, ok := v.keys[agent]
+	if !ok {
+		return agent, ErrUnknownAgent
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return agent, ErrExpired
+	}
+	signed := time.Unix(seconds, 0)
+	now := v.now()
+	if signed.Before(now.Add(-v.MaxSkew)) || signed.After(now.Add(v.MaxSkew)) {
+		return agent, ErrExpired
+	}
+
+	// Behind a prefix stripping handler the URL has been changed, but RequestURI is what the agent sent
+	uri := r.RequestURI
+	if uri == "" {
+		uri = r.URL.RequestURI()
+	}
+
+	sig, err := hex.DecodeString(given)
+	if err != nil || !hmac.Equal(sig, signature(key, timestamp, nonce, r.Method, uri, body)) {
+		return agent, ErrBadSignature
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	for s, expires := range v.seen {
+		if now.After(expires) {
+			delete(v.seen, s)
+		}
+	}
+
+	// Hex decoding ignores case, so only the decoded form identifies a signature
+	canonical := hex.EncodeToString(sig)
+	if _, ok := v.seen[canonical]; ok {
+		return agent, ErrReplayed
+	}
+	v.seen[canonical] = signed.Add(v.MaxSkew)
+
+	return agent, nil
+}
+
+// Authorize returns ErrForbidden if the agent may not write a record for the key, branch and workspace.  Denials are
+// written to the audit log.
+func (v *Verifier) Authorize(agent, key, branch, workspace string) error {
+	reason := v.denied(agent, key, branch, workspace)
+	if reason == "" {
+		return nil
+	}
+
+	log.Warn().
+		Bool("audit", true).
+		Str("agent", agent).
+		Str("key", key).
+		Str("branch", branch).
+		Str("workspace", workspace).
+		Str("reason", reason).
+		Msg("Denied write")
+
+	return ErrForbidden
+}
+
+// Allowed is Authorize for when nothing is being written yet, so there is nothing to audit
+func (v *Verifier) Allowed(agent, key, branch, workspace string) bool {
+	return v.denied(agent, key, branch, workspace) == ""
+}
+
+// denied returns why the agent may not write, or nothing if it may
+func (v *Verifier) denied(agent, key, branch, workspace string) string {
+	a, ok := v.agents[agent]
+
+	switch {
+	case !ok:
+		return "unknown agent"
+	case len(a.Keys) > 0 && !anyMatch(a.Keys, key, matchKey):
+		return "key not allowed"
+	case len(a.Branches) > 0 && !anyMatch(a.Branches, branch, path.Match):
+		return "branch not allowed"
+	case len(a.Workspaces) > 0 && !anyMatch(a.Workspaces, workspace, path.Match):
+		return "workspace not allowed"
+	}
+	return ""
+}
+
+func anyMatch(patterns []string, s string, match func(pattern, s string) (bool, error)) bool {
+	for _, p := range patterns {
+		if ok, _ := match(p, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// matchKey reports whether the leading parts of key match the pattern part by part
+func matchKey(pattern, key string) (bool, error) {
+	patterns := strings.Split(strings.TrimSuffix(strings.Trim(pattern, "/"), "/*"), "/")
+	parts := strings.Split(strings.Trim(key, "/"), "/")
+
+	if len(parts) < len(patterns) {
+		return false, nil
+	}
+
+	for i, p := range patterns {
+		if ok, err := path.Match(p, parts[i]); !ok || err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,159 @@
+package auth
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func signed(t *testing.T, agent, secret, path string, body []byte) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, path, nil)
+	Sign(r, agent, secret, body)
+	return r
+}
+
+func TestVerifier(t *testing.T) {
+	v, err := NewVerifier([]Agent{{Name: "prod", SecretSHA256: HashSecret("s3cret")}})
+	require.NoError(t, err)
+
+	body := []byte(`{"branch":"main"}`)
+
+	agent, err := v.Verify(signed(t, "prod", "s3cret", "/plan/production/network", body), body)
+	require.NoError(t, err)
+	assert.Equal(t, "prod", agent)
+
+	streamed := httptest.NewRequest(http.MethodPost, "/plan/production/network", nil)
+	require.NoError(t, SignReader(streamed, "prod", "s3cret", bytes.NewReader(body)))
+	_, err = v.Verify(streamed, body)
+	assert.NoError(t, err, "streamed bodies are signed the same")
+
+	t.Run("rejects", func(t *testing.T) {
+		replayed := signed(t, "prod", "s3cret", "/plan/production/app", body)
+		_, err := v.Verify(replayed, body)
+		require.NoError(t, err)
+
+		shouted := replayed.Clone(replayed.Context())
+		shouted.Header.Set(SignatureHeader, strings.ToUpper(replayed.Header.Get(SignatureHeader)))
+
+		moved := signed(t, "prod", "s3cret", "/plan/production/app", body)
+		moved.RequestURI = "/plan/staging/app"
+
+		old := signed(t, "prod", "s3cret", "/plan/production/app", body)
+		old.Header.Set(TimestampHeader, strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10))
+
+		noNonce := signed(t, "prod", "s3cret", "/plan/production/app", body)
+		noNonce.Header.Del(NonceHeader)
+
+		for name, tt := range map[string]struct {
+			request *http.Request
+			body    []byte
+			err     error
+		}{
+			"unsigned":      {request: httptest.NewRequest(http.MethodPost, "/plan/a", nil), body: body, err: ErrUnsigned},
+			"unknown agent": {request: signed(t, "dev", "s3cret", "/plan/a", body), body: body, err: ErrUnknownAgent},
+			"wrong secret":  {request: signed(t, "prod", "guess", "/plan/a", body), body: body, err: ErrBadSignature},
+			"changed body":  {request: signed(t, "prod", "s3cret", "/plan/a", body), body: []byte(`{"branch":"evil"}`), err: ErrBadSignature},
+			"changed path":  {request: moved, body: body, err: ErrBadSignature},
+			"old timestamp": {request: old, body: body, err: ErrExpired},
+			"no nonce":      {request: noNonce, body: body, err: ErrUnsigned},
+			"replayed":      {request: replayed, body: body, err: ErrReplayed},
+		} {
+			_, err := v.Verify(tt.request, tt.body)
+			assert.ErrorIs(t, err, tt.err, name)
+		}
+	})
+
+	t.Run("accepts identical requests sent in the same second", func(t *testing.T) {
+		now := time.Now()
+		for i := 0; i < 2; i++ {
+			r := httptest.NewRequest(http.MethodPost, "/plan/production/app", nil)
+			require.NoError(t, sign(r, "prod", "s3cret", bytes.NewReader(body), now))
+			_, err := v.Verify(r, body)
+			assert.NoError(t, err)
+		}
+	})
+
+	t.Run("forgets signatures once they expire", func(t *testing.T) {
+		later := time.Now().Add(time.Hour)
+		v.now = func() time.Time { return later }
+
+		r := httptest.NewRequest(http.MethodPost, "/plan/a", nil)
+		require.NoError(t, sign(r, "prod", "s3cret", bytes.NewReader(body), later))
+		_, err := v.Verify(r, body)
+		require.NoError(t, err)
+		assert.Len(t, v.seen, 1)
+	})
+}
+
+func TestNewVerifier(t *testing.T) {
+	_, err := NewVerifier([]Agent{{Name: "prod", SecretSHA256: "s3cret"}})
+	assert.Error(t, err, "secrets must be hashed")
+
+	_, err = NewVerifier([]Agent{{SecretSHA256: HashSecret("a")}})
+	assert.Error(t, err)
+
+	_, err = NewVerifier([]Agent{{Name: "a", SecretSHA256: HashSecret("a")}, {Name: "a", SecretSHA256: HashSecret("b")}})
+	assert.Error(t, err)
+}
+
+func TestLoadConfig(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "agents.yaml")
+	require.NoError(t, os.WriteFile(file, []byte(`
+agents:
+  - name: prod
+    secret-sha256: `+HashSecret("s3cret")+`
+`), 0644))
+
+	config, err := LoadConfig(file)
+	require.NoError(t, err)
+	assert.Equal(t, []Agent{{Name: "prod", SecretSHA256: HashSecret("s3cret")}}, config.Agents)
+
+	require.NoError(t, os.WriteFile(file, []byte("agents:\n  - name: prod\n    secret: s3cret\n"), 0644))
+	_, err = LoadConfig(file)
+	assert.Error(t, err)
+}
+
+func TestVerifier_Authorize(t *testing.T) {
+	v, err := NewVerifier([]Agent{
+		{Name: "prod", SecretSHA256: HashSecret("a"), Keys: []string{"production/*", "*/shared"}, Branches: []string{"main", "release/*"}, Workspaces: []string{"default"}},
+		{Name: "any", SecretSHA256: HashSecret("b")},
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		agent, key, branch, workspace string
+		allowed                       bool
+	}{
+		{"prod", "production/network", "main", "default", true},
+		{"prod", "production/network/vpc", "release/1.2", "default", true},
+		{"prod", "staging/shared", "main", "default", true},
+		{"prod", "production", "main", "default", true},
+		{"prod", "staging/network", "main", "default", false},
+		{"prod", "productionx/network", "main", "default", false},
+		{"prod", "shared", "main", "default", false},
+		{"prod", "production/network", "feature", "default", false},
+		{"prod", "production/network", "main", "blue", false},
+		{"any", "staging/network", "feature", "blue", true},
+		{"unknown", "staging/network", "main", "default", false},
+	}
+	for _, tt := range tests {
+		err := v.Authorize(tt.agent, tt.key, tt.branch, tt.workspace)
+		if tt.allowed {
+			assert.NoError(t, err, "%+v", tt)
+		} else {
+			assert.ErrorIs(t, err, ErrForbidden, "%+v", tt)
+		}
+		assert.Equal(t, tt.allowed, v.Allowed(tt.agent, tt.key, tt.branch, tt.workspace), "%+v", tt)
+	}
+
+	_, err = NewVerifier([]Agent{{Name: "bad", SecretSHA256: HashSecret("a"), Keys: []string{"production/[x"}}})
+	assert.Error(t, err)
+}
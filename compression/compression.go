@@ -0,0 +1,149 @@
+// Package compression encodes and decodes the compressed plan records sent by agents and kept by the server.
+//
+// Readers never need to be told how something was compressed: compressed data is recognized by its magic number, and
+// anything else is taken to be uncompressed.
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"io"
+	"strings"
+)
+
+// Encoding is a compression scheme, named as in the HTTP Content-Encoding header
+type Encoding string
+
+const (
+	None Encoding = ""
+	Gzip Encoding = "gzip"
+	Zstd Encoding = "zstd"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// Parse returns the encoding named by s, which may be a Content-Encoding header value or "none"
+func Parse(s string) (Encoding, error) {
+	switch e := Encoding(strings.ToLower(strings.TrimSpace(s))); e {
+	case None, Gzip, Zstd:
+		return e, nil
+	case "none", "identity":
+		return None, nil
+	default:
+		return None, errors.Errorf("unsupported encoding %s", s)
+	}
+}
+
+// Extension is added to the names of files compressed with the encoding
+func (e Encoding) Extension() string {
+	switch e {
+	case Gzip:
+		return ".gz"
+	case Zstd:
+		return ".zst"
+	default:
+		return ""
+	}
+}
+
+// Extensions are those of every encoding which compresses
+var Extensions = []string{Gzip.Extension(), Zstd.Extension()}
+
+// TrimExtension removes any compression extension from a file name
+func TrimExtension(name string) string {
+	for _, ext := range Extensions {
+		if strings.HasSuffix(name, ext) {
+			return strings.TrimSuffix(name, ext)
+		}
+	}
+	return name
+}
+
+// NewWriter returns a writer which compresses what is written to it into w.  It must be closed to finish.
+func (e Encoding) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	switch e {
+	case None:
+		return nopCloser{w}, nil
+	case Gzip:
+		return gzip.NewWriter(w), nil
+	case Zstd:
+		return zstd.NewWriter(w)
+	default:
+		return nil, errors.Errorf("unsupported encoding %s", e)
+	}
+}
+
+// NewReader returns a reader of the decompressed content of r
+func (e Encoding) NewReader(r io.Reader) (io.ReadCloser, error) {
+	switch e {
+	case None:
+		return io.NopCloser(r), nil
+	case Gzip:
+		return gzip.NewReader(r)
+	case Zstd:
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	default:
+		return nil, errors.Errorf("unsupported encoding %s", e)
+	}
+}
+
+// Compress returns b compressed
+func (e Encoding) Compress(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := e.NewWriter(&buf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Detect returns how the data starting with b is compressed
+func Detect(b []byte) Encoding {
+	switch {
+	case bytes.HasPrefix(b, gzipMagic):
+		return Gzip
+	case bytes.HasPrefix(b, zstdMagic):
+		return Zstd
+	default:
+		return None
+	}
+}
+
+// Decompress returns b decompressed, whether or not it was compressed
+func Decompress(b []byte) ([]byte, error) {
+	e := Detect(b)
+	if e == None {
+		return b, nil
+	}
+
+	r, err := e.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
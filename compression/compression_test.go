@@ -0,0 +1,50 @@
+package compression
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+func TestEncoding_Compress(t *testing.T) {
+	content := []byte(strings.Repeat(`{"resource": "aws_instance.web"}`, 1000))
+
+	for _, e := range []Encoding{None, Gzip, Zstd} {
+		b, err := e.Compress(content)
+		require.NoError(t, err, e)
+		assert.Equal(t, e, Detect(b), e)
+
+		if e != None {
+			assert.Less(t, len(b), len(content)/10, e)
+		}
+
+		decompressed, err := Decompress(b)
+		require.NoError(t, err, e)
+		assert.Equal(t, content, decompressed, e)
+	}
+}
+
+func TestParse(t *testing.T) {
+	for s, expected := range map[string]Encoding{
+		"":         None,
+		"none":     None,
+		"identity": None,
+		"gzip":     Gzip,
+		" GZIP ":   Gzip,
+		"zstd":     Zstd,
+	} {
+		e, err := Parse(s)
+		require.NoError(t, err, s)
+		assert.Equal(t, expected, e, s)
+	}
+
+	_, err := Parse("br")
+	assert.Error(t, err)
+}
+
+func TestTrimExtension(t *testing.T) {
+	assert.Equal(t, "a.json", TrimExtension("a.json"))
+	assert.Equal(t, "a.json", TrimExtension("a.json"+Gzip.Extension()))
+	assert.Equal(t, "a.json", TrimExtension("a.json"+Zstd.Extension()))
+}
@@ -4,6 +4,7 @@ import (
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
 	"os/exec"
+	"strings"
 )
 
 type SHA256 string
@@ -23,5 +24,74 @@ func CurrentSHA(dir string) (SHA256, error) {
 		return "", errors.Wrap(err, "Error getting HEAD commit SHA")
 	}
 
-	return SHA256(bytes), nil
+	return SHA256(strings.TrimSpace(string(bytes))), nil
+}
+
+func CurrentBranch(dir string) (Branch, error) {
+	cmd := exec.Command("git", "rev-parse", "--abbrev-ref", "HEAD")
+	cmd.Dir = dir
+
+	log.Debug().Strs("cmd", cmd.Args).Msg("running")
+
+	bytes, err := cmd.Output()
+
+	if err != nil {
+		return "", errors.Wrap(err, "Error getting current branch")
+	}
+
+	return Branch(strings.TrimSpace(string(bytes))), nil
+}
+
+// Pull fetches branch from origin and fast-forwards the working directory to it, checking the branch out if needed
+func Pull(dir string, branch Branch) error {
+	for _, args := range [][]string{
+		{"fetch", "--quiet", "origin", string(branch)},
+		{"checkout", "--quiet", string(branch)},
+		{"merge", "--quiet", "--ff-only", "FETCH_HEAD"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+
+		log.Debug().Strs("cmd", cmd.Args).Msg("running")
+
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return errors.Wrapf(err, "Error running git %s: %s", args[0], strings.TrimSpace(string(output)))
+		}
+	}
+
+	return nil
+}
+
+// RemotePath returns the path of the repository at the origin remote, e.g. "org/infra" for
+// git@github.com:org/infra.git
+func RemotePath(dir string) (string, error) {
+	cmd := exec.Command("git", "remote", "get-url", "origin")
+	cmd.Dir = dir
+
+	log.Debug().Strs("cmd", cmd.Args).Msg("running")
+
+	bytes, err := cmd.Output()
+
+	if err != nil {
+		return "", errors.Wrap(err, "Error getting origin remote")
+	}
+
+	return remotePath(strings.TrimSpace(string(bytes))), nil
+}
+
+// remotePath extracts the repository path from a remote URL, in either URL or scp-like syntax
+func remotePath(remote string) string {
+	path := remote
+	if i := strings.Index(remote, "://"); i >= 0 {
+		path = remote[i+3:]
+		if j := strings.Index(path, "/"); j >= 0 {
+			path = path[j+1:]
+		} else {
+			path = ""
+		}
+	} else if i := strings.Index(remote, ":"); i >= 0 {
+		path = remote[i+1:]
+	}
+
+	return strings.TrimSuffix(strings.Trim(path, "/"), ".git")
 }
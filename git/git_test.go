@@ -0,0 +1,19 @@
+package git
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func Test_remotePath(t *testing.T) {
+	for remote, expected := range map[string]string{
+		"git@github.com:acme/infra.git":             "acme/infra",
+		"https://github.com/acme/infra.git":         "acme/infra",
+		"https://github.com/acme/infra":             "acme/infra",
+		"ssh://git@gitlab.example.com:22/ops/infra": "ops/infra",
+		"https://dev.azure.com/acme/ops/_git/infra": "acme/ops/_git/infra",
+		"/srv/git/infra.git":                        "srv/git/infra",
+	} {
+		assert.Equal(t, expected, remotePath(remote), remote)
+	}
+}
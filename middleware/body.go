@@ -0,0 +1,24 @@
+package middleware
+
+import (
+	"errors"
+	"io"
+	"net/http"
+)
+
+// LimitBody stops more than the given number of megabytes being read from body.  With 0, there is no limit.
+func LimitBody(w http.ResponseWriter, body io.ReadCloser, megabytes int) io.ReadCloser {
+	if megabytes <= 0 {
+		return body
+	}
+	return http.MaxBytesReader(w, body, int64(megabytes)*1024*1024)
+}
+
+// ReadStatus is the status with which to reject a request whose body could not be read
+func ReadStatus(err error) int {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
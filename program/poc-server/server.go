@@ -1,21 +1,34 @@
 package poc_server
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"github.com/deweysasser/olympus/auth"
+	"github.com/deweysasser/olympus/compression"
 	"github.com/deweysasser/olympus/middleware"
+	"github.com/deweysasser/olympus/program/store"
 	"github.com/deweysasser/olympus/program/ui"
 	"github.com/deweysasser/olympus/run"
+	"github.com/deweysasser/olympus/storage"
+	"github.com/deweysasser/olympus/terraform"
 	"github.com/gorilla/mux"
 	"github.com/rs/zerolog/log"
 	"io"
 	"net/http"
-	"os"
-	"path/filepath"
+	"time"
 )
 
 type Options struct {
 	ui.Options
+	PruneEvery time.Duration   `help:"How often to prune stored history by the retention policy (0 to never prune)" default:"0"`
+	Retention  store.Retention `embed:"" prefix:"retention."`
+	Agents     string          `help:"File listing the agents allowed to upload, with their hashed secrets.  Without it, uploads are not authenticated." type:"path"`
+	MaxBody    int             `help:"Largest plan record to accept, in megabytes after decompression (0 for no limit)" default:"256"`
+	Compress   string          `help:"How to compress stored records (none|gzip|zstd)" enum:"none,gzip,zstd" default:"none"`
+
+	storage  *storage.Storage
+	verifier *auth.Verifier
 }
 
 func (o *Options) Run() error {
@@ -23,6 +36,13 @@ func (o *Options) Run() error {
 	if err != nil {
 		return err
 	}
+	defer o.storage.Close()
+
+	o.Retention.Schedule(o.storage, o.PruneEvery)
+
+	if o.verifier == nil {
+		log.Warn().Msg("No agents file given.  Anyone who can reach the server can upload plans.")
+	}
 
 	log.Debug().Int("port", o.Port).Msg("Listening")
 	return http.ListenAndServe(fmt.Sprintf(":%d", o.Port), server)
@@ -34,6 +54,21 @@ func (o *Options) createServer() (*mux.Router, error) {
 		return nil, err
 	}
 
+	// Plans are received into the same storage the UI shows
+	o.storage = o.Storage()
+
+	encoding, err := compression.Parse(o.Compress)
+	if err != nil {
+		return nil, err
+	}
+	o.storage.Compress(encoding)
+
+	if o.Agents != "" {
+		if o.verifier, err = auth.Load(o.Agents); err != nil {
+			return nil, err
+		}
+	}
+
 	server.Use(middleware.RequestLogger)
 
 	server.Path("/status").HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
@@ -57,60 +92,99 @@ func (o *Options) createServer() (*mux.Router, error) {
 }
 
 func (o *Options) receive(writer http.ResponseWriter, request *http.Request) {
-	path := filepath.Join(o.DataPath, request.URL.Path[1:])
-	log := log.With().Str("path", path).Logger()
-
-	info, err := os.Stat(path)
-	switch {
-	case err != nil:
-		err = os.MkdirAll(path, os.ModePerm)
-		if err != nil {
-			log.Error().Err(err).Msg("Failed to make directories")
-		}
-	case !info.IsDir():
-		log.Error().Err(err).Msg("output directory isn't")
-		writer.WriteHeader(http.StatusInternalServerError)
+	key, err := storage.ValidKey(request.URL.Path)
+	if err != nil {
+		log.Debug().Err(err).Str("path", request.URL.Path).Msg("Bad key")
+		writer.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	log := log.With().Str("key", key.String()).Logger()
 
-	// TODO:  save the whole thing, not just the plan
+	request.Body = middleware.LimitBody(writer, request.Body, o.MaxBody)
 
-	outputPath := filepath.Join(path, "plan.json")
-
-	log = log.With().Str("output_file", outputPath).Logger()
-
-	f, err := os.Create(outputPath)
+	run := &run.PlanRecord{}
+	bytes, err := io.ReadAll(request.Body)
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to create output file")
-		writer.WriteHeader(http.StatusInternalServerError)
+		log.Error().Err(err).Msg("Failed to read request")
+		writer.WriteHeader(middleware.ReadStatus(err))
 		return
 	}
 
-	defer f.Close()
+	var agent string
+	if o.verifier != nil {
+		agent, err = o.verifier.Verify(request, bytes)
+		if err != nil {
+			log.Warn().Err(err).Str("agent", agent).Msg("Rejected upload")
+			writer.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		log = log.With().Str("agent", agent).Logger()
+	}
 
-	run := &run.PlanRecord{}
-	bytes, err := io.ReadAll(request.Body)
+	// Signatures cover the body as sent, so it can only be decompressed once verified
+	encoding, err := compression.Parse(request.Header.Get("Content-Encoding"))
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to read request")
-		writer.WriteHeader(http.StatusInternalServerError)
+		log.Debug().Err(err).Msg("Unsupported request encoding")
+		writer.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+	if bytes, err = o.decompress(writer, encoding, bytes); err != nil {
+		log.Debug().Err(err).Msg("Failed to decompress request")
+		writer.WriteHeader(middleware.ReadStatus(err))
 		return
 	}
 
 	err = json.Unmarshal(bytes, run)
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to unmarshal request")
-		writer.WriteHeader(http.StatusInternalServerError)
+		writer.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	bytes, err = json.Marshal(run.Plan)
-	if err != nil {
-		log.Error().Err(err).Msg("Failed to marshal output")
+	// Older agents don't say when they finished or which workspace they planned
+	if run.End.IsZero() {
+		run.End = time.Now()
+	}
+	if run.Workspace == "" {
+		run.Workspace = "default"
+	}
+
+	if err := storage.ValidateRecord(key, run); err != nil {
+		log.Debug().Err(err).Msg("Rejected plan record")
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if o.verifier != nil {
+		if err := o.verifier.Authorize(agent, key.String(), string(run.Branch), string(run.Workspace)); err != nil {
+			writer.WriteHeader(http.StatusForbidden)
+			return
+		}
+	}
+
+	// Agents should never send sensitive values, but the server must not keep them if one does
+	terraform.Redact(run.Plan)
+
+	if err := o.storage.Store(key, run); err != nil {
+		log.Error().Err(err).Msg("Failed to store plan record")
 		writer.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	log.Debug().Msg("Wrote output file")
+	log.Debug().Str("branch", string(run.Branch)).Str("workspace", string(run.Workspace)).Msg("Stored plan record")
+}
+
+// decompress returns the content of a compressed request body, at most the maximum body size of it
+func (o *Options) decompress(writer http.ResponseWriter, encoding compression.Encoding, body []byte) ([]byte, error) {
+	if encoding == compression.None {
+		return body, nil
+	}
+
+	r, err := encoding.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
 
-	f.Write(bytes)
+	return io.ReadAll(middleware.LimitBody(writer, r, o.MaxBody))
 }
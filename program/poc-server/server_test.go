@@ -1,11 +1,24 @@
 package poc_server
 
 import (
+	"bytes"
+	"encoding/json"
+	"github.com/deweysasser/olympus/auth"
+	"github.com/deweysasser/olympus/compression"
+	"github.com/deweysasser/olympus/git"
+	"github.com/deweysasser/olympus/run"
+	"github.com/deweysasser/olympus/storage"
+	tfjson "github.com/hashicorp/terraform-json"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestOptions_createServer(t *testing.T) {
@@ -46,3 +59,191 @@ func Benchmark_Status(b *testing.B) {
 		assert.Equal(b, 200, r.StatusCode)
 	}
 }
+
+func TestOptions_receive(t *testing.T) {
+	o := &Options{}
+	o.DataPath = t.TempDir()
+	o.Backend = "file"
+
+	router, err := o.createServer()
+	require.NoError(t, err)
+
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	end := time.Date(2000, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, sha := range []git.SHA256{"first", "second"} {
+		b, err := json.Marshal(&run.PlanRecord{
+			Plan:      &tfjson.Plan{FormatVersion: "1.1"},
+			End:       end,
+			CommitSHA: sha,
+			Branch:    "main",
+			Succeeded: true,
+		})
+		require.NoError(t, err)
+
+		r, err := http.Post(server.URL+"/plan/staging/network", "text/json", bytes.NewReader(b))
+		require.NoError(t, err)
+		assert.Equal(t, 200, r.StatusCode)
+
+		end = end.Add(time.Hour)
+	}
+
+	history, err := o.storage.History(storage.ParseKey("staging/network"), "main", "default")
+	require.NoError(t, err)
+	require.Equal(t, 2, len(history))
+
+	record, err := o.storage.Get(history[0])
+	require.NoError(t, err)
+	assert.Equal(t, git.SHA256("first"), record.CommitSHA)
+	assert.True(t, record.Succeeded)
+	assert.NotNil(t, record.Plan)
+
+	r, err := http.Post(server.URL+"/plan/staging/network", "text/json", bytes.NewReader([]byte("not json")))
+	require.NoError(t, err)
+	assert.Equal(t, 400, r.StatusCode)
+}
+
+func TestOptions_receive_badKeys(t *testing.T) {
+	dir := t.TempDir()
+	o := &Options{}
+	o.DataPath = filepath.Join(dir, "data")
+	o.Backend = "file"
+
+	router, err := o.createServer()
+	require.NoError(t, err)
+
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	// Redirects to a cleaned up path would lose the body anyway
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+
+	b, err := json.Marshal(&run.PlanRecord{End: time.Now(), Branch: "main", Output: "failed"})
+	require.NoError(t, err)
+
+	for path, status := range map[string]int{
+		"/plan/":                            http.StatusBadRequest,
+		"/plan/%2e%2e/escaped":              http.StatusMovedPermanently,
+		"/plan/prod/..%2f..%2fescaped":      http.StatusMovedPermanently,
+		"/plan/prod%5c..%5c..%5cescaped":    http.StatusBadRequest,
+		"/plan/prod/net%00work":             http.StatusBadRequest,
+		"/plan/prod/.ssh":                   http.StatusBadRequest,
+		"/plan/prod/aux.json":               http.StatusBadRequest,
+		"/plan/" + strings.Repeat("a/", 20): http.StatusBadRequest,
+	} {
+		r, err := client.Post(server.URL+path, "text/json", bytes.NewReader(b))
+		require.NoError(t, err)
+		r.Body.Close()
+		assert.Equal(t, status, r.StatusCode, path)
+	}
+
+	for name, record := range map[string]*run.PlanRecord{
+		"branch":              {Branch: "x/../../../escaped"},
+		"relative branch":     {Branch: ".."},
+		"branch separator":    {Branch: `feature\x`},
+		"workspace":           {Branch: "main", Workspace: "../../escaped"},
+		"workspace separator": {Branch: "main", Workspace: "a/b"},
+	} {
+		b, err := json.Marshal(record)
+		require.NoError(t, err)
+		r, err := client.Post(server.URL+"/plan/prod/app", "text/json", bytes.NewReader(b))
+		require.NoError(t, err)
+		r.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, r.StatusCode, name)
+	}
+
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	for _, f := range files {
+		assert.Equal(t, "data", f.Name())
+	}
+	_, err = os.Stat(filepath.Join(dir, "data", "prod"))
+	assert.True(t, os.IsNotExist(err), "nothing was stored")
+}
+
+func TestOptions_receive_authenticated(t *testing.T) {
+	agents := filepath.Join(t.TempDir(), "agents.yaml")
+	require.NoError(t, os.WriteFile(agents, []byte("agents:\n  - name: prod\n    secret-sha256: "+auth.HashSecret("s3cret")+"\n    keys: [production]\n"), 0644))
+
+	o := &Options{Agents: agents}
+	o.DataPath = t.TempDir()
+	o.Backend = "file"
+
+	router, err := o.createServer()
+	require.NoError(t, err)
+
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	b, err := json.Marshal(&run.PlanRecord{End: time.Now(), Branch: "main", Output: "failed"})
+	require.NoError(t, err)
+
+	send := func(secret string, path ...string) int {
+		url := server.URL + "/plan/production/network"
+		if len(path) > 0 {
+			url = server.URL + path[0]
+		}
+		request, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(b))
+		require.NoError(t, err)
+		if secret != "" {
+			auth.Sign(request, "prod", secret, b)
+		}
+		r, err := http.DefaultClient.Do(request)
+		require.NoError(t, err)
+		return r.StatusCode
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, send(""))
+	assert.Equal(t, http.StatusUnauthorized, send("guess"))
+	assert.Equal(t, http.StatusOK, send("s3cret"))
+	assert.Equal(t, http.StatusForbidden, send("s3cret", "/plan/staging/network"))
+
+	history, err := o.storage.History(storage.ParseKey("production/network"), "main", "default")
+	require.NoError(t, err)
+	assert.Len(t, history, 1)
+}
+
+func TestOptions_receive_compressed(t *testing.T) {
+	o := &Options{MaxBody: 1, Compress: "zstd"}
+	o.DataPath = t.TempDir()
+	o.Backend = "file"
+
+	router, err := o.createServer()
+	require.NoError(t, err)
+
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	send := func(encoding compression.Encoding, header string, r *run.PlanRecord) int {
+		b, err := json.Marshal(r)
+		require.NoError(t, err)
+		b, err = encoding.Compress(b)
+		require.NoError(t, err)
+
+		request, err := http.NewRequest(http.MethodPost, server.URL+"/plan/production/network", bytes.NewReader(b))
+		require.NoError(t, err)
+		request.Header.Set("Content-Encoding", header)
+		response, err := http.DefaultClient.Do(request)
+		require.NoError(t, err)
+		response.Body.Close()
+		return response.StatusCode
+	}
+
+	end := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	assert.Equal(t, http.StatusOK, send(compression.Gzip, "gzip", &run.PlanRecord{End: end, Branch: "main", Command: "terraform plan"}))
+	assert.Equal(t, http.StatusUnsupportedMediaType, send(compression.None, "br", &run.PlanRecord{End: end, Branch: "main"}))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, send(compression.Zstd, "zstd", &run.PlanRecord{End: end.Add(time.Hour), Branch: "main", Output: strings.Repeat("x", 2*1024*1024)}))
+
+	_, err = os.Stat(filepath.Join(o.DataPath, "production", "network", "2000-01-01-00-00-00__main__default.json.zst"))
+	assert.NoError(t, err, "stored compressed")
+
+	history, err := o.storage.History(storage.ParseKey("production/network"), "main", "default")
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	r, err := o.storage.Get(history[0])
+	require.NoError(t, err)
+	assert.Equal(t, "terraform plan", r.Command)
+}
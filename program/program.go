@@ -6,6 +6,7 @@ import (
 	poc_server "github.com/deweysasser/olympus/program/poc-server"
 	"github.com/deweysasser/olympus/program/run"
 	"github.com/deweysasser/olympus/program/server"
+	"github.com/deweysasser/olympus/program/store"
 	"github.com/deweysasser/olympus/program/ui"
 	"github.com/mattn/go-colorable"
 	"github.com/rs/zerolog"
@@ -24,6 +25,9 @@ type Options struct {
 	Server2 server.Options     `cmd:"" help:"Run the (under development) data server" hidden:"1"`
 	UI      ui.Options         `cmd:"" help:"run the web UI poc-server"`
 	RunCmd  run.Options        `cmd:"" name:"run"  help:"Run the run local process to make plans and upload them to the poc-server"`
+	Agent   run.AgentOptions   `cmd:"" help:"Run the agent continuously, planning components on a schedule or as the server requests"`
+	Redact  run.RedactOptions  `cmd:"" help:"Show what the agent would send for a terraform JSON plan"`
+	Storage store.Options      `cmd:"" help:"Manage stored plan data"`
 
 	Debug        bool   `group:"Info" help:"Show debugging information"`
 	OutputFormat string `group:"Info" enum:"auto,jsonl,terminal" default:"auto" help:"How to show program output (auto|terminal|jsonl)"`
@@ -0,0 +1,201 @@
+package run
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// limiter bounds the number of plans running at once
+type limiter interface {
+	AddWithContext(ctx context.Context) error
+	Done()
+	Wait()
+}
+
+// procStat is where linux reports the CPU time counters
+const procStat = "/proc/stat"
+
+// deadband keeps the limit from growing as soon as utilization drops the slightest bit below the target
+const deadband = 0.05
+
+// cpuSample holds the cumulative CPU time counters of the whole system
+type cpuSample struct {
+	idle  uint64
+	total uint64
+}
+
+// readCPU reads the aggregate CPU counters from a file in /proc/stat format
+func readCPU(file string) (cpuSample, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return cpuSample{}, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 || fields[0] != "cpu" {
+			continue
+		}
+
+		// user nice system idle iowait irq softirq steal.  Guest time is already counted in user.
+		var sample cpuSample
+		for i, field := range fields[1:] {
+			if i >= 8 {
+				break
+			}
+			v, err := strconv.ParseUint(field, 10, 64)
+			if err != nil {
+				return cpuSample{}, fmt.Errorf("bad cpu counter %s in %s: %w", field, file, err)
+			}
+			sample.total += v
+			if i == 3 || i == 4 {
+				sample.idle += v
+			}
+		}
+		return sample, nil
+	}
+
+	if err := scanner.Err(); err != nil {
+		return cpuSample{}, err
+	}
+	return cpuSample{}, fmt.Errorf("no cpu line in %s", file)
+}
+
+// utilization returns the fraction of CPU time spent busy between an earlier sample and this one
+func (s cpuSample) utilization(since cpuSample) float64 {
+	total := s.total - since.total
+	if total == 0 || s.total < since.total {
+		return 0
+	}
+	return 1 - float64(s.idle-since.idle)/float64(total)
+}
+
+// adaptiveLimit is a limiter whose limit moves between min and max to keep CPU utilization near a target
+type adaptiveLimit struct {
+	min, max int
+	target   float64
+
+	lock    sync.Mutex
+	limit   int
+	running int
+	// changed is closed (and replaced) whenever a waiting Add might now succeed
+	changed chan struct{}
+	wg      sync.WaitGroup
+}
+
+func newAdaptiveLimit(min, max int, target float64) *adaptiveLimit {
+	if min < 1 {
+		min = 1
+	}
+	if max < min {
+		max = min
+	}
+
+	return &adaptiveLimit{min: min, max: max, target: target, limit: min, changed: make(chan struct{})}
+}
+
+// AddWithContext blocks until there is room for another plan, or the context is cancelled
+func (a *adaptiveLimit) AddWithContext(ctx context.Context) error {
+	for {
+		a.lock.Lock()
+		if a.running < a.limit {
+			a.running++
+			a.wg.Add(1)
+			a.lock.Unlock()
+			return nil
+		}
+		changed := a.changed
+		a.lock.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+func (a *adaptiveLimit) Done() {
+	a.lock.Lock()
+	a.running--
+	a.notify()
+	a.lock.Unlock()
+
+	a.wg.Done()
+}
+
+func (a *adaptiveLimit) Wait() {
+	a.wg.Wait()
+}
+
+// Limit returns the number of plans currently allowed to run at once
+func (a *adaptiveLimit) Limit() int {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	return a.limit
+}
+
+// adjust moves the limit one step towards the target utilization.  It only grows when every slot is in use, since
+// otherwise more slots would not change anything.
+func (a *adaptiveLimit) adjust(utilization float64) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	old := a.limit
+	switch {
+	case utilization > a.target && a.limit > a.min:
+		a.limit--
+	case utilization < a.target-deadband && a.running >= a.limit && a.limit < a.max:
+		a.limit++
+		a.notify()
+	}
+
+	if a.limit != old {
+		log.Debug().Float64("utilization", utilization).Int("parallel", a.limit).Msg("Adjusted parallel plans")
+	}
+}
+
+// notify wakes everyone waiting for room.  The caller must hold the lock.
+func (a *adaptiveLimit) notify() {
+	close(a.changed)
+	a.changed = make(chan struct{})
+}
+
+// monitor samples CPU utilization from file and adjusts the limit until the context is cancelled
+func (a *adaptiveLimit) monitor(ctx context.Context, file string, every time.Duration) {
+	last, err := readCPU(file)
+	if err != nil {
+		log.Error().Err(err).Int("parallel", a.min).Msg("Cannot measure CPU use, running a fixed number of plans")
+		return
+	}
+
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		sample, err := readCPU(file)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to measure CPU use")
+			continue
+		}
+
+		a.adjust(sample.utilization(last))
+		last = sample
+	}
+}
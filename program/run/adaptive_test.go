@@ -0,0 +1,96 @@
+package run
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReadCPU(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "stat")
+	require.NoError(t, os.WriteFile(file, []byte(`cpu  100 0 50 800 50 0 0 0 20 0
+cpu0 100 0 50 800 50 0 0 0 20 0
+intr 591899 0 0
+`), 0644))
+
+	before, err := readCPU(file)
+	require.NoError(t, err)
+	assert.Equal(t, cpuSample{idle: 850, total: 1000}, before)
+
+	require.NoError(t, os.WriteFile(file, []byte("cpu  250 0 100 1000 50 0 0 0 20 0\n"), 0644))
+	after, err := readCPU(file)
+	require.NoError(t, err)
+	assert.InDelta(t, 0.5, after.utilization(before), 0.001)
+	assert.Equal(t, 0.0, before.utilization(after), "counters going backwards are ignored")
+
+	require.NoError(t, os.WriteFile(file, []byte("intr 591899 0 0\n"), 0644))
+	_, err = readCPU(file)
+	assert.Error(t, err)
+
+	_, err = readCPU(filepath.Join(t.TempDir(), "missing"))
+	assert.Error(t, err)
+}
+
+func TestAdaptiveLimit_adjust(t *testing.T) {
+	a := newAdaptiveLimit(1, 3, 0.8)
+	ctx := context.Background()
+
+	a.adjust(0.1)
+	assert.Equal(t, 1, a.Limit(), "does not grow while slots are unused")
+
+	require.NoError(t, a.AddWithContext(ctx))
+	a.adjust(0.1)
+	assert.Equal(t, 2, a.Limit())
+
+	require.NoError(t, a.AddWithContext(ctx))
+	a.adjust(0.78)
+	assert.Equal(t, 2, a.Limit(), "close enough to the target")
+
+	a.adjust(0.5)
+	assert.Equal(t, 3, a.Limit())
+
+	require.NoError(t, a.AddWithContext(ctx))
+	a.adjust(0.1)
+	assert.Equal(t, 3, a.Limit(), "never grows past max")
+
+	for i := 0; i < 5; i++ {
+		a.adjust(0.95)
+	}
+	assert.Equal(t, 1, a.Limit(), "never shrinks past min")
+
+	a.Done()
+	a.Done()
+	a.Done()
+	a.Wait()
+}
+
+func TestAdaptiveLimit_AddWithContext(t *testing.T) {
+	a := newAdaptiveLimit(1, 2, 0.8)
+	require.NoError(t, a.AddWithContext(context.Background()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.Error(t, a.AddWithContext(ctx), "blocks while the limit is reached")
+
+	added := make(chan error)
+	go func() {
+		added <- a.AddWithContext(context.Background())
+	}()
+
+	// Growing the limit lets the waiting plan start
+	a.adjust(0.1)
+	select {
+	case err := <-added:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiting plan did not start when the limit grew")
+	}
+
+	a.Done()
+	a.Done()
+	a.Wait()
+}
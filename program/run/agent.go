@@ -0,0 +1,322 @@
+package run
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/deweysasser/olympus/git"
+	"github.com/deweysasser/olympus/middleware"
+	"github.com/gin-gonic/gin"
+	"github.com/robfig/cron/v3"
+	"github.com/rs/zerolog/log"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// AgentOptions runs the agent as a daemon, planning each component on its own schedule or whenever the server asks
+type AgentOptions struct {
+	Options
+	Every      time.Duration `help:"Time between plans of components without a configured schedule" default:"1h"`
+	Jitter     time.Duration `help:"Maximum random delay added to each interval, to spread out the load" default:"5m"`
+	HealthPort int           `help:"Port on which to serve the local health endpoint (0 to disable)" default:"8082"`
+
+	Pull      bool          `help:"Plan requests leased from the server's queue instead of planning on a schedule"`
+	Server    string        `help:"Server from which to lease plan requests in pull mode.  Their plans are sent to its API rather than the collector." default:"http://localhost:8081"`
+	PollEvery time.Duration `help:"How long to wait before asking again when the server has nothing to plan" default:"30s"`
+
+	// checkouts stops pulls from changing a checkout while its components are being planned
+	checkouts map[string]*checkout
+
+	lock   sync.Mutex
+	status map[string]*componentStatus
+}
+
+// componentStatus is what the health endpoint reports about each component
+type componentStatus struct {
+	Key       string    `json:"key"`
+	Dir       string    `json:"dir"`
+	Running   bool      `json:"running"`
+	Runs      int       `json:"runs"`
+	Failures  int       `json:"failures"`
+	Succeeded bool      `json:"succeeded"`
+	LastStart time.Time `json:"last-start"`
+	LastEnd   time.Time `json:"last-end"`
+	Next      time.Time `json:"next"`
+}
+
+// checkout is a repository working directory shared by the components in it
+type checkout struct {
+	sync.RWMutex
+	// branch is what was last pulled
+	branch git.Branch
+}
+
+// schedule decides when a component is planned next
+type schedule interface {
+	Next(time.Time) time.Time
+}
+
+// interval plans every so often, delayed by a random amount up to jitter
+type interval struct {
+	every  time.Duration
+	jitter time.Duration
+	random *rand.Rand
+}
+
+func (i *interval) Next(t time.Time) time.Time {
+	return t.Add(i.every + i.delay())
+}
+
+func (i *interval) delay() time.Duration {
+	if i.jitter <= 0 {
+		return 0
+	}
+	return time.Duration(i.random.Int63n(int64(i.jitter)))
+}
+
+func (o *AgentOptions) Run() error {
+	components, err := o.components()
+	if err != nil {
+		return err
+	}
+
+	if len(components) == 0 {
+		return errors.New("nothing to plan: give directories or a config file with components")
+	}
+
+	o.prepare(components)
+
+	if err := o.openSpool(); err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if o.spool != nil {
+		go o.spool.watch(ctx, drainEvery)
+	}
+
+	if o.HealthPort > 0 {
+		server := &http.Server{Addr: fmt.Sprintf(":%d", o.HealthPort), Handler: o.createHealthServer()}
+		go func() {
+			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Error().Err(err).Msg("Health endpoint failed")
+			}
+		}()
+		defer server.Close()
+	}
+
+	log.Info().Int("components", len(components)).Int("parallel", o.Parallel).Bool("pull", o.Pull).Msg("Agent started")
+
+	limit := o.limiter(ctx)
+
+	if o.Pull {
+		err = o.leased(ctx, components, limit)
+	} else {
+		err = o.scheduled(ctx, components, limit)
+	}
+
+	limit.Wait()
+	log.Info().Msg("Agent stopped")
+
+	return err
+}
+
+// prepare sets up the shared state of the components
+func (o *AgentOptions) prepare(components []Component) {
+	o.checkouts = make(map[string]*checkout)
+	o.status = make(map[string]*componentStatus)
+	for _, c := range components {
+		if _, ok := o.checkouts[c.Checkout]; !ok {
+			o.checkouts[c.Checkout] = &checkout{}
+		}
+		o.status[c.Key] = &componentStatus{Key: c.Key, Dir: c.Dir}
+	}
+}
+
+// scheduled plans each component on its own schedule until the context is cancelled
+func (o *AgentOptions) scheduled(ctx context.Context, components []Component, limit limiter) error {
+	schedules := make([]schedule, len(components))
+	for i, c := range components {
+		var err error
+		if schedules[i], err = o.schedule(c); err != nil {
+			return err
+		}
+	}
+
+	var loops sync.WaitGroup
+
+	for i, c := range components {
+		loops.Add(1)
+		go func(c Component, s schedule) {
+			defer loops.Done()
+			o.loop(ctx, c, s, limit)
+		}(c, schedules[i])
+	}
+
+	loops.Wait()
+	return nil
+}
+
+// schedule builds the schedule for a component, falling back to the command line for anything not configured
+func (o *AgentOptions) schedule(c Component) (schedule, error) {
+	if c.Schedule.Cron != "" {
+		s, err := cron.ParseStandard(c.Schedule.Cron)
+		if err != nil {
+			return nil, fmt.Errorf("component %s: bad cron expression %s: %w", c.Key, c.Schedule.Cron, err)
+		}
+		return s, nil
+	}
+
+	i := &interval{
+		every:  c.Schedule.Every,
+		jitter: c.Schedule.Jitter,
+		random: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+
+	if i.every == 0 {
+		i.every = o.Every
+	}
+	if i.jitter == 0 {
+		i.jitter = o.Jitter
+	}
+
+	if i.every <= 0 {
+		return nil, fmt.Errorf("component %s: schedule interval must be positive", c.Key)
+	}
+
+	return i, nil
+}
+
+// first returns when a component is first planned.  Intervals start right away (give or take the jitter) rather than
+// waiting out a whole interval after every restart.
+func first(s schedule, now time.Time) time.Time {
+	if i, ok := s.(*interval); ok {
+		return now.Add(i.delay())
+	}
+	return s.Next(now)
+}
+
+// loop plans a component on its schedule until the context is cancelled
+func (o *AgentOptions) loop(ctx context.Context, c Component, s schedule, limit limiter) {
+	next := first(s, time.Now())
+
+	for {
+		o.update(c.Key, func(status *componentStatus) {
+			status.Next = next
+		})
+		log.Debug().Str("key", c.Key).Time("next", next).Msg("Scheduled plan")
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		if err := limit.AddWithContext(ctx); err != nil {
+			return
+		}
+		o.plan(c)
+		limit.Done()
+
+		next = s.Next(time.Now())
+	}
+}
+
+// plan brings the component's checkout up to date and plans it once
+func (o *AgentOptions) plan(c Component) {
+	co := o.checkout(c)
+
+	o.update(c.Key, func(status *componentStatus) {
+		status.Running = true
+		status.LastStart = time.Now()
+	})
+
+	succeeded := o.process(c)
+	co.RUnlock()
+
+	o.update(c.Key, func(status *componentStatus) {
+		status.Running = false
+		status.LastEnd = time.Now()
+		status.Runs++
+		status.Succeeded = succeeded
+		if !succeeded {
+			status.Failures++
+		}
+	})
+}
+
+// checkout pulls the component's branch and returns its checkout locked so that it cannot change until the plan is
+// done.  Other components wanting a different branch wait their turn.
+func (o *AgentOptions) checkout(c Component) *checkout {
+	co := o.checkouts[c.Checkout]
+
+	if c.Checkout == "" || c.Branch == "" {
+		co.RLock()
+		return co
+	}
+
+	for {
+		co.Lock()
+		err := git.Pull(c.Checkout, c.Branch)
+		if err != nil {
+			co.branch = ""
+			// Planning what's already checked out is still better than nothing
+			log.Error().Err(err).Str("repo", c.Repo).Str("branch", string(c.Branch)).Msg("Failed to pull")
+		} else {
+			co.branch = c.Branch
+		}
+		co.Unlock()
+
+		co.RLock()
+		if err != nil || co.branch == c.Branch {
+			return co
+		}
+		// Another component switched branches in between
+		co.RUnlock()
+	}
+}
+
+// update changes the status of a component
+func (o *AgentOptions) update(key string, f func(status *componentStatus)) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	f(o.status[key])
+}
+
+// snapshot returns a copy of the status of every component, sorted by key
+func (o *AgentOptions) snapshot() []componentStatus {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	result := make([]componentStatus, 0, len(o.status))
+	for _, s := range o.status {
+		result = append(result, *s)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Key < result[j].Key
+	})
+
+	return result
+}
+
+func (o *AgentOptions) createHealthServer() *gin.Engine {
+	r := gin.New()
+	r.Use(middleware.GinRequestLogger())
+	r.GET("/status", func(context *gin.Context) {
+		context.JSON(200, gin.H{"status": "alive", "components": o.snapshot()})
+	})
+
+	return r
+}
@@ -0,0 +1,73 @@
+package run
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAgentOptions_schedule(t *testing.T) {
+	o := &AgentOptions{Every: time.Hour, Jitter: 10 * time.Minute}
+	now := time.Date(2022, 10, 10, 12, 0, 0, 0, time.UTC)
+
+	s, err := o.schedule(Component{Key: "defaults"})
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		next := s.Next(now)
+		assert.False(t, next.Before(now.Add(time.Hour)), "next %s is too early", next)
+		assert.True(t, next.Before(now.Add(70*time.Minute)), "next %s is too late", next)
+
+		start := first(s, now)
+		assert.False(t, start.Before(now))
+		assert.True(t, start.Before(now.Add(10*time.Minute)))
+	}
+
+	s, err = o.schedule(Component{Key: "configured", Schedule: ScheduleConfig{Every: 5 * time.Minute, Jitter: time.Nanosecond}})
+	require.NoError(t, err)
+	assert.Equal(t, now.Add(5*time.Minute), s.Next(now))
+
+	s, err = o.schedule(Component{Key: "cron", Schedule: ScheduleConfig{Cron: "30 6 * * 1-5"}})
+	require.NoError(t, err)
+	// 2022-10-14 is a Friday
+	assert.Equal(t, time.Date(2022, 10, 17, 6, 30, 0, 0, time.UTC), s.Next(time.Date(2022, 10, 14, 7, 0, 0, 0, time.UTC)))
+	assert.Equal(t, time.Date(2022, 10, 11, 6, 30, 0, 0, time.UTC), first(s, now))
+
+	_, err = o.schedule(Component{Key: "bad", Schedule: ScheduleConfig{Cron: "whenever"}})
+	assert.Error(t, err)
+
+	_, err = (&AgentOptions{}).schedule(Component{Key: "never"})
+	assert.Error(t, err)
+}
+
+func TestAgentOptions_status(t *testing.T) {
+	o := &AgentOptions{status: map[string]*componentStatus{
+		"b": {Key: "b", Dir: "/repo/b"},
+		"a": {Key: "a", Dir: "/repo/a"},
+	}}
+
+	o.update("b", func(status *componentStatus) {
+		status.Runs++
+		status.Succeeded = true
+	})
+
+	w := httptest.NewRecorder()
+	o.createHealthServer().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/status", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var body struct {
+		Status     string
+		Components []componentStatus
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, "alive", body.Status)
+	require.Len(t, body.Components, 2)
+	assert.Equal(t, "a", body.Components[0].Key)
+	assert.Equal(t, 0, body.Components[0].Runs)
+	assert.Equal(t, "b", body.Components[1].Key)
+	assert.Equal(t, 1, body.Components[1].Runs)
+	assert.True(t, body.Components[1].Succeeded)
+}
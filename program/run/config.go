@@ -0,0 +1,413 @@
+package run
+
+import (
+	"bytes"
+	"github.com/deweysasser/olympus/git"
+	"github.com/deweysasser/olympus/terraform"
+	"github.com/pkg/errors"
+	"github.com/robfig/cron/v3"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Config describes everything the agent plans and how.  It only ever comes from local files, never from the server.
+type Config struct {
+	// Collector is the address to which plans are sent
+	Collector string `yaml:"collector,omitempty"`
+	// Redact are rules removing values from every plan before it is sent
+	Redact []terraform.RedactionRule `yaml:"redact,omitempty"`
+	// Profile decides how much of each plan is sent, unless a repo or component says otherwise
+	Profile terraform.Profile `yaml:"profile,omitempty"`
+	// Vars are values which key templates can use
+	Vars  map[string]string `yaml:"vars,omitempty"`
+	Repos []RepoConfig      `yaml:"repos"`
+}
+
+// RepoConfig describes a checked out repository of terraform components
+type RepoConfig struct {
+	// Name is used to build default server keys
+	Name string `yaml:"name"`
+	// Path is where the repository is checked out.  Relative paths are relative to the config file.
+	Path string `yaml:"path"`
+	// Commands are the default command sequence for the repo's components
+	Commands Steps `yaml:"commands,omitempty"`
+	// Branch is pulled before each scheduled run by the agent daemon.  If empty, the checkout is left alone.
+	Branch git.Branch `yaml:"branch,omitempty"`
+	// Env are environment variables set for every command
+	Env map[string]string `yaml:"env,omitempty"`
+	// Workspaces are the default workspaces of the repo's components which don't give one
+	Workspaces []string `yaml:"workspaces,omitempty"`
+	// Schedule is the default schedule of the repo's components when running as a daemon
+	Schedule ScheduleConfig `yaml:"schedule,omitempty"`
+	// Redact are rules removing values from the repo's plans, in addition to those for every repo
+	Redact []terraform.RedactionRule `yaml:"redact,omitempty"`
+	// Profile decides how much of the repo's plans is sent
+	Profile terraform.Profile `yaml:"profile,omitempty"`
+	// KeyTemplate builds the server keys of components which don't give one
+	KeyTemplate `yaml:",inline"`
+	// Vars add to (or override) the values which key templates can use
+	Vars       map[string]string `yaml:"vars,omitempty"`
+	Components []ComponentConfig `yaml:"components"`
+}
+
+// ScheduleConfig says how often the agent daemon plans a component.  Either Cron or Every may be given.
+type ScheduleConfig struct {
+	// Every is the time between plans
+	Every time.Duration `yaml:"every,omitempty"`
+	// Jitter is the maximum random delay added to each interval, to spread out the load
+	Jitter time.Duration `yaml:"jitter,omitempty"`
+	// Cron is a standard 5 field cron expression
+	Cron string `yaml:"cron,omitempty"`
+}
+
+// ComponentConfig describes one or more terraform component directories in a repo
+type ComponentConfig struct {
+	// Dir is the component directory relative to the repo.  It may be a glob matching several components.
+	Dir string `yaml:"dir"`
+	// Key is the server key for the component.  When Dir is a glob, the parts of each directory matched by wildcards
+	// are appended.  It defaults to the repo name followed by the directory.
+	Key string `yaml:"key,omitempty"`
+	// Commands overrides the command sequence of the repo
+	Commands Steps `yaml:"commands,omitempty"`
+	// Env adds to (or overrides) the environment variables of the repo
+	Env map[string]string `yaml:"env,omitempty"`
+	// Workspace is the terraform workspace to plan
+	Workspace terraform.Workspace `yaml:"workspace,omitempty"`
+	// Workspaces are the terraform workspaces to plan, one after the other.  Each may be a pattern, selecting from the
+	// workspaces terraform lists.  It can't be used with Workspace.
+	Workspaces []string `yaml:"workspaces,omitempty"`
+	// Schedule overrides the schedule of the repo
+	Schedule ScheduleConfig `yaml:"schedule,omitempty"`
+	// Profile overrides how much of the repo's plans is sent
+	Profile terraform.Profile `yaml:"profile,omitempty"`
+	// KeyTemplate overrides the key template of the repo.  It can't be used with Key.
+	KeyTemplate `yaml:",inline"`
+	// Vars add to (or override) the values which key templates can use
+	Vars map[string]string `yaml:"vars,omitempty"`
+}
+
+// Component is a single directory to plan, and everything needed to plan it
+type Component struct {
+	Dir       string
+	Key       string
+	Commands  Steps
+	Env       map[string]string
+	Workspace terraform.Workspace
+	// Workspaces are planned one after the other instead of Workspace, if there are any
+	Workspaces []string
+	// Repo is the name of the repo containing the component, and Checkout where it is, if it came from the config file
+	Repo     string
+	Checkout string
+	Branch   git.Branch
+	Schedule ScheduleConfig
+	// Redact are the rules removing values from the component's plans
+	Redact []terraform.RedactionRule
+	// Profile decides how much of the component's plans is sent.  If empty, the agent's default is used.
+	Profile terraform.Profile
+}
+
+// LoadConfig reads an agent configuration file
+func LoadConfig(file string) (*Config, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &Config{}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(b))
+	// Catch misspellings rather than silently planning the wrong thing
+	decoder.KnownFields(true)
+	if err := decoder.Decode(config); err != nil {
+		return nil, errors.Wrap(err, "while reading config "+file)
+	}
+
+	if err := compile(config.Redact); err != nil {
+		return nil, errors.Wrap(err, file)
+	}
+
+	if err := config.Profile.Validate(); err != nil {
+		return nil, errors.Wrap(err, file)
+	}
+
+	base := filepath.Dir(file)
+	for i := range config.Repos {
+		repo := &config.Repos[i]
+		switch {
+		case repo.Name == "":
+			return nil, errors.Errorf("%s: repo %d has no name", file, i+1)
+		case repo.Path == "":
+			return nil, errors.Errorf("%s: repo %s has no path", file, repo.Name)
+		}
+
+		repo.Path = expandHome(repo.Path)
+		if !filepath.IsAbs(repo.Path) {
+			repo.Path = filepath.Join(base, repo.Path)
+		}
+
+		if err := repo.Schedule.validate(); err != nil {
+			return nil, errors.Wrapf(err, "%s: repo %s", file, repo.Name)
+		}
+
+		if err := compile(repo.Redact); err != nil {
+			return nil, errors.Wrapf(err, "%s: repo %s", file, repo.Name)
+		}
+
+		if err := repo.Profile.Validate(); err != nil {
+			return nil, errors.Wrapf(err, "%s: repo %s", file, repo.Name)
+		}
+
+		if err := repo.KeyTemplate.compile(); err != nil {
+			return nil, errors.Wrapf(err, "%s: repo %s", file, repo.Name)
+		}
+
+		if err := validateWorkspaces(repo.Workspaces); err != nil {
+			return nil, errors.Wrapf(err, "%s: repo %s", file, repo.Name)
+		}
+
+		for j := range repo.Components {
+			c := &repo.Components[j]
+			if c.Dir == "" {
+				return nil, errors.Errorf("%s: component %d of repo %s has no dir", file, j+1, repo.Name)
+			}
+			if err := c.Schedule.validate(); err != nil {
+				return nil, errors.Wrapf(err, "%s: component %s of repo %s", file, c.Dir, repo.Name)
+			}
+			if err := c.Profile.Validate(); err != nil {
+				return nil, errors.Wrapf(err, "%s: component %s of repo %s", file, c.Dir, repo.Name)
+			}
+			if c.Key != "" && c.KeyTemplate.Template != "" {
+				return nil, errors.Errorf("%s: component %s of repo %s has both a key and a key template", file, c.Dir, repo.Name)
+			}
+			if err := c.KeyTemplate.compile(); err != nil {
+				return nil, errors.Wrapf(err, "%s: component %s of repo %s", file, c.Dir, repo.Name)
+			}
+			if c.Workspace != "" && len(c.Workspaces) > 0 {
+				return nil, errors.Errorf("%s: component %s of repo %s has both a workspace and workspaces", file, c.Dir, repo.Name)
+			}
+			if err := validateWorkspaces(c.Workspaces); err != nil {
+				return nil, errors.Wrapf(err, "%s: component %s of repo %s", file, c.Dir, repo.Name)
+			}
+		}
+	}
+
+	return config, nil
+}
+
+// Components expands the configuration into the individual components to plan.  Commands are used for any component
+// whose repo does not say otherwise.
+func (c *Config) Components(commands Steps) ([]Component, error) {
+	var result []Component
+	keys := make(map[string]string)
+
+	for _, repo := range c.Repos {
+		remote := repoRemote(repo)
+
+		for _, cc := range repo.Components {
+			dirs, err := filepath.Glob(filepath.Join(repo.Path, cc.Dir))
+			if err != nil {
+				return nil, errors.Wrap(err, "bad component dir "+cc.Dir)
+			}
+			sort.Strings(dirs)
+
+			for _, dir := range dirs {
+				if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+					continue
+				}
+
+				key, err := c.componentKey(repo, cc, dir, remote)
+				if err != nil {
+					return nil, errors.Wrapf(err, "repo %s", repo.Name)
+				}
+
+				component := Component{
+					Dir:        dir,
+					Key:        key,
+					Commands:   firstNonEmpty(cc.Commands, repo.Commands, commands),
+					Env:        merge(repo.Env, cc.Env),
+					Workspace:  cc.Workspace,
+					Workspaces: cc.workspaces(repo),
+					Repo:       repo.Name,
+					Checkout:   repo.Path,
+					Branch:     repo.Branch,
+					Schedule:   cc.Schedule.or(repo.Schedule),
+					Redact:     c.RedactionRules(repo.Name),
+					Profile:    firstProfile(cc.Profile, repo.Profile, c.Profile),
+				}
+
+				if other, ok := keys[component.Key]; ok {
+					return nil, errors.Errorf("components %s and %s both use key %s", other, dir, component.Key)
+				}
+				keys[component.Key] = dir
+
+				result = append(result, component)
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// RedactionRules returns the rules for plans of the named repo
+func (c *Config) RedactionRules(repo string) []terraform.RedactionRule {
+	rules := append([]terraform.RedactionRule{}, c.Redact...)
+	for _, r := range c.Repos {
+		if r.Name == repo {
+			rules = append(rules, r.Redact...)
+		}
+	}
+	return rules
+}
+
+// UploadProfile returns the profile configured for plans of the named repo, or the empty profile if none is
+func (c *Config) UploadProfile(repo string) terraform.Profile {
+	for _, r := range c.Repos {
+		if r.Name == repo && r.Profile != "" {
+			return r.Profile
+		}
+	}
+	return c.Profile
+}
+
+// compile prepares redaction rules for use
+func compile(rules []terraform.RedactionRule) error {
+	for i := range rules {
+		if err := rules[i].Compile(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// repoRemote returns the path of the repo at its origin, if any of its keys are templates which might use it
+func repoRemote(repo RepoConfig) string {
+	templated := repo.KeyTemplate.Template != ""
+	for _, cc := range repo.Components {
+		templated = templated || cc.KeyTemplate.Template != ""
+	}
+	if !templated {
+		return ""
+	}
+
+	remote, err := git.RemotePath(repo.Path)
+	if err != nil {
+		log.Debug().Err(err).Str("repo", repo.Name).Msg("No git remote for key templates")
+	}
+	return remote
+}
+
+// componentKey decides the server key for a component directory
+func (c *Config) componentKey(repo RepoConfig, cc ComponentConfig, dir, remote string) (string, error) {
+	rel, err := filepath.Rel(repo.Path, dir)
+	if err != nil {
+		rel = filepath.Base(dir)
+	}
+	rel = filepath.ToSlash(rel)
+
+	if keys := cc.KeyTemplate.or(repo.KeyTemplate); cc.Key == "" && keys.Template != "" {
+		data := keyData(repo.Name, rel, string(cc.Workspace), remote)
+		if len(cc.workspaces(repo)) > 0 {
+			// Every workspace planned shares the key, so it can't depend on one
+			delete(data, "workspace")
+		}
+		for name, v := range merge(c.Vars, repo.Vars, cc.Vars) {
+			data[name] = v
+		}
+		return keys.render(rel, data)
+	}
+
+	if cc.Key == "" {
+		return checkKey(repo.Name + "/" + rel)
+	}
+
+	key := []string{strings.Trim(cc.Key, "/")}
+
+	// Globs never match across separators, so the pattern and the directory have the same parts
+	pattern := strings.Split(filepath.ToSlash(filepath.Clean(cc.Dir)), "/")
+	parts := strings.Split(rel, "/")
+	for i, p := range pattern {
+		if i < len(parts) && strings.ContainsAny(p, "*?[") {
+			key = append(key, parts[i])
+		}
+	}
+
+	return checkKey(strings.Join(key, "/"))
+}
+
+// workspaces returns the workspaces to plan one after the other, unless the component plans a single one
+func (cc ComponentConfig) workspaces(repo RepoConfig) []string {
+	if len(cc.Workspaces) > 0 || cc.Workspace != "" {
+		return cc.Workspaces
+	}
+	return repo.Workspaces
+}
+
+// validate makes sure the schedule can be used
+func (s ScheduleConfig) validate() error {
+	switch {
+	case s.Cron != "" && s.Every != 0:
+		return errors.New("schedule cannot have both cron and every")
+	case s.Every < 0 || s.Jitter < 0:
+		return errors.New("schedule durations cannot be negative")
+	case s.Cron != "":
+		if _, err := cron.ParseStandard(s.Cron); err != nil {
+			return errors.Wrap(err, "bad cron expression "+s.Cron)
+		}
+	}
+	return nil
+}
+
+// or returns the schedule if it says when to run, otherwise the fallback
+func (s ScheduleConfig) or(fallback ScheduleConfig) ScheduleConfig {
+	if s.Cron == "" && s.Every == 0 {
+		return fallback
+	}
+	return s
+}
+
+func firstNonEmpty(lists ...Steps) Steps {
+	for _, l := range lists {
+		if len(l) > 0 {
+			return l
+		}
+	}
+	return nil
+}
+
+func firstProfile(profiles ...terraform.Profile) terraform.Profile {
+	for _, p := range profiles {
+		if p != "" {
+			return p
+		}
+	}
+	return ""
+}
+
+func merge(maps ...map[string]string) map[string]string {
+	result := make(map[string]string)
+	for _, m := range maps {
+		for k, v := range m {
+			result[k] = v
+		}
+	}
+	return result
+}
+
+// expandHome replaces a leading ~ with the user's home directory
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+
+	return filepath.Join(home, path[1:])
+}
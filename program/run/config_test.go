@@ -0,0 +1,311 @@
+package run
+
+import (
+	"github.com/deweysasser/olympus/terraform"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, dir, content string) string {
+	file := filepath.Join(dir, "olympus.yaml")
+	require.NoError(t, os.WriteFile(file, []byte(content), 0644))
+	return file
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	for _, d := range []string{"infra/envs/staging/network", "infra/envs/prod/network", "infra/global/dns"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, d), os.ModePerm))
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "infra/envs/README.md"), nil, 0644))
+
+	file := writeConfig(t, dir, `
+collector: http://olympus:8080/plan
+repos:
+  - name: infra
+    path: infra
+    commands:
+      - terraform init
+      - terraform show -json plan
+    branch: main
+    env:
+      AWS_PROFILE: default
+      TF_IN_AUTOMATION: "1"
+    schedule:
+      every: 2h
+      jitter: 10m
+    components:
+      - dir: envs/*/network
+        key: network
+        env:
+          AWS_PROFILE: network
+      - dir: global/dns
+        key: global/dns
+        workspace: shared
+        schedule:
+          cron: "30 6 * * 1-5"
+        commands: [terraform plan, terraform show -json]
+      - dir: envs/*
+`)
+
+	config, err := LoadConfig(file)
+	require.NoError(t, err)
+	assert.Equal(t, "http://olympus:8080/plan", config.Collector)
+	assert.Equal(t, filepath.Join(dir, "infra"), config.Repos[0].Path)
+
+	components, err := config.Components(Steps{{Args: []string{"default"}}})
+	require.NoError(t, err)
+
+	var keys []string
+	for _, c := range components {
+		keys = append(keys, c.Key)
+	}
+	assert.Equal(t, []string{"network/prod", "network/staging", "global/dns", "infra/envs/prod", "infra/envs/staging"}, keys)
+
+	network := components[0]
+	assert.Equal(t, filepath.Join(dir, "infra/envs/prod/network"), network.Dir)
+	assert.Equal(t, "terraform init; terraform show -json plan", network.Commands.String())
+	assert.Equal(t, map[string]string{"AWS_PROFILE": "network", "TF_IN_AUTOMATION": "1"}, network.Env)
+	assert.Equal(t, "", string(network.Workspace))
+	assert.Equal(t, "infra", network.Repo)
+	assert.Equal(t, filepath.Join(dir, "infra"), network.Checkout)
+	assert.Equal(t, "main", string(network.Branch))
+	assert.Equal(t, ScheduleConfig{Every: 2 * time.Hour, Jitter: 10 * time.Minute}, network.Schedule)
+
+	dns := components[2]
+	assert.Equal(t, "terraform plan; terraform show -json", dns.Commands.String())
+	assert.Equal(t, "shared", string(dns.Workspace))
+	assert.Equal(t, ScheduleConfig{Cron: "30 6 * * 1-5"}, dns.Schedule)
+
+	noCommands := &Config{Repos: []RepoConfig{{Name: "x", Path: dir, Components: []ComponentConfig{{Dir: "infra"}}}}}
+	components, err = noCommands.Components(Steps{{Args: []string{"default"}}})
+	require.NoError(t, err)
+	assert.Equal(t, "default", components[0].Commands.String())
+}
+
+func TestLoadConfig_errors(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "a/b"), os.ModePerm))
+
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{name: "unknown field", content: "repos:\n  - name: a\n    path: a\n    componets: []\n"},
+		{name: "no name", content: "repos:\n  - path: a\n"},
+		{name: "no path", content: "repos:\n  - name: a\n"},
+		{name: "no dir", content: "repos:\n  - name: a\n    path: a\n    components:\n      - key: x\n"},
+		{name: "bad cron", content: "repos:\n  - name: a\n    path: a\n    schedule:\n      cron: every tuesday\n"},
+		{name: "cron and every", content: "repos:\n  - name: a\n    path: a\n    components:\n      - dir: b\n        schedule: {cron: '@daily', every: 1h}\n"},
+		{name: "bad duration", content: "repos:\n  - name: a\n    path: a\n    schedule:\n      every: often\n"},
+		{name: "empty redaction", content: "redact:\n  - type: aws_instance\n"},
+		{name: "bad profile", content: "repos:\n  - name: a\n    path: a\n    components:\n      - dir: b\n        profile: everything\n"},
+		{name: "bad redaction", content: "repos:\n  - name: a\n    path: a\n    redact:\n      - value: '(unclosed'\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadConfig(writeConfig(t, dir, tt.content))
+			assert.Error(t, err)
+		})
+	}
+
+	config, err := LoadConfig(writeConfig(t, dir, `
+repos:
+  - name: a
+    path: a
+    components:
+      - dir: b
+        key: same
+  - name: b
+    path: a
+    components:
+      - dir: b
+        key: same
+`))
+	require.NoError(t, err)
+	_, err = config.Components(nil)
+	assert.ErrorContains(t, err, "both use key same")
+}
+
+func TestLoadConfig_redact(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "a/b"), os.ModePerm))
+
+	config, err := LoadConfig(writeConfig(t, dir, `
+redact:
+  - attribute: tags.*
+    value: Password=[^;]*
+repos:
+  - name: a
+    path: a
+    redact:
+      - type: aws_instance
+        attribute: user_data
+    components:
+      - dir: b
+`))
+	require.NoError(t, err)
+
+	components, err := config.Components(nil)
+	require.NoError(t, err)
+	require.Len(t, components, 1)
+
+	rules := components[0].Redact
+	require.Len(t, rules, 2)
+	assert.Equal(t, "rule attribute tags.*, value Password=[^;]*", rules[0].String())
+	assert.Equal(t, "rule type aws_instance, attribute user_data", rules[1].String())
+
+	assert.Len(t, config.RedactionRules("other"), 1)
+}
+
+func TestLoadConfig_profile(t *testing.T) {
+	dir := t.TempDir()
+	for _, d := range []string{"a/b", "a/c", "z/b"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, d), os.ModePerm))
+	}
+
+	config, err := LoadConfig(writeConfig(t, dir, `
+profile: full
+repos:
+  - name: a
+    path: a
+    profile: diff-only
+    components:
+      - dir: b
+        profile: minimal
+      - dir: c
+  - name: z
+    path: z
+    components:
+      - dir: b
+`))
+	require.NoError(t, err)
+
+	components, err := config.Components(nil)
+	require.NoError(t, err)
+	require.Len(t, components, 3)
+
+	assert.Equal(t, terraform.ProfileMinimal, components[0].Profile)
+	assert.Equal(t, terraform.ProfileDiffOnly, components[1].Profile)
+	assert.Equal(t, terraform.ProfileFull, components[2].Profile)
+}
+
+func TestLoadConfig_keyTemplate(t *testing.T) {
+	dir := t.TempDir()
+	for _, d := range []string{"infra/envs/prod/network", "infra/envs/staging/us-east-1/app", "infra/global/dns"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, d), os.ModePerm))
+	}
+
+	config, err := LoadConfig(writeConfig(t, dir, `
+vars:
+  org: acme
+repos:
+  - name: infra
+    path: infra
+    key-template: "{{.org}}/{{.env}}/{{.component}}"
+    match: ^envs/(?P<env>[^/]+)/
+    components:
+      - dir: envs/*/network
+      - dir: envs/*/*/app
+      - dir: global/dns
+        key-template: "{{.org}}/{{.scope}}/{{.component}}-{{.workspace}}"
+        workspace: shared
+        vars:
+          scope: global
+`))
+	require.NoError(t, err)
+
+	components, err := config.Components(nil)
+	require.NoError(t, err)
+
+	var keys []string
+	for _, c := range components {
+		keys = append(keys, c.Key)
+	}
+	assert.Equal(t, []string{"acme/prod/network", "acme/staging/app", "acme/global/dns-shared"}, keys)
+}
+
+func TestLoadConfig_keyErrors(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "a/b"), os.ModePerm))
+
+	for name, content := range map[string]string{
+		"key and template": "repos:\n  - name: a\n    path: a\n    components:\n      - dir: b\n        key: x\n        key-template: y\n",
+		"bad template":     "repos:\n  - name: a\n    path: a\n    key-template: '{{.x'\n    components: []\n",
+		"match only":       "repos:\n  - name: a\n    path: a\n    match: '.*'\n    components: []\n",
+	} {
+		_, err := LoadConfig(writeConfig(t, dir, content))
+		assert.Error(t, err, name)
+	}
+
+	for name, content := range map[string]string{
+		"unknown var": "repos:\n  - name: a\n    path: a\n    key-template: '{{.env}}'\n    components:\n      - dir: b\n",
+		"no match":    "repos:\n  - name: a\n    path: a\n    key-template: '{{.env}}'\n    match: '^envs/(?P<env>.*)'\n    components:\n      - dir: b\n",
+		"unsafe":      "repos:\n  - name: a\n    path: a\n    key-template: '../{{.component}}'\n    components:\n      - dir: b\n",
+		"unsafe key":  "repos:\n  - name: a\n    path: a\n    components:\n      - dir: b\n        key: x/../../y\n",
+	} {
+		config, err := LoadConfig(writeConfig(t, dir, content))
+		require.NoError(t, err, name)
+		_, err = config.Components(nil)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestLoadConfig_workspaces(t *testing.T) {
+	dir := t.TempDir()
+	for _, d := range []string{"infra/app", "infra/dns", "infra/network"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, d), os.ModePerm))
+	}
+
+	config, err := LoadConfig(writeConfig(t, dir, `
+repos:
+  - name: infra
+    path: infra
+    workspaces: [staging, prod]
+    components:
+      - dir: app
+        workspaces: ["*"]
+        key-template: "{{.repo}}/{{.component}}"
+      - dir: dns
+        workspace: shared
+      - dir: network
+`))
+	require.NoError(t, err)
+
+	components, err := config.Components(nil)
+	require.NoError(t, err)
+	require.Len(t, components, 3)
+
+	assert.Equal(t, "infra/app", components[0].Key)
+	assert.Equal(t, []string{"*"}, components[0].Workspaces)
+	assert.Nil(t, components[1].Workspaces, "a single workspace overrides the repo's")
+	assert.Equal(t, "shared", string(components[1].Workspace))
+	assert.Equal(t, []string{"staging", "prod"}, components[2].Workspaces)
+
+	for name, content := range map[string]string{
+		"both":        "repos: [{name: x, path: ., components: [{dir: ., workspace: a, workspaces: [b]}]}]",
+		"bad pattern": "repos: [{name: x, path: ., components: [{dir: ., workspaces: ['[']}]}]",
+		"empty":       "repos: [{name: x, path: ., workspaces: ['']}]",
+	} {
+		_, err := LoadConfig(writeConfig(t, dir, content))
+		assert.Error(t, err, name)
+	}
+
+	// The key is shared by every workspace, so it can't depend on one
+	config, err = LoadConfig(writeConfig(t, dir, `
+repos:
+  - name: infra
+    path: infra
+    components:
+      - dir: app
+        workspaces: [staging, prod]
+        key-template: "{{.workspace}}/{{.component}}"
+`))
+	require.NoError(t, err)
+	_, err = config.Components(nil)
+	assert.Error(t, err)
+}
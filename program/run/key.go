@@ -0,0 +1,137 @@
+package run
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/deweysasser/olympus/storage"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// keyFuncs are the functions key templates may use, besides the standard ones
+var keyFuncs = template.FuncMap{
+	"base":    path.Base,
+	"lower":   strings.ToLower,
+	"replace": strings.ReplaceAll,
+}
+
+// KeyTemplate builds server keys from what is known about a component directory
+type KeyTemplate struct {
+	// Template is a text/template producing the key, e.g. "{{.env}}/{{.component}}"
+	Template string `yaml:"key-template,omitempty"`
+	// Match is a regular expression matched against the directory relative to the repo.  Its named groups can be
+	// used in the template.
+	Match string `yaml:"match,omitempty"`
+
+	template *template.Template
+	match    *regexp.Regexp
+}
+
+// compile checks the template and prepares it for use
+func (k *KeyTemplate) compile() error {
+	if k.Template == "" {
+		if k.Match != "" {
+			return fmt.Errorf("match %s is only used by a key template, and there is none", k.Match)
+		}
+		return nil
+	}
+
+	t, err := template.New("key").Funcs(keyFuncs).Option("missingkey=error").Parse(k.Template)
+	if err != nil {
+		return fmt.Errorf("bad key template %s: %w", k.Template, err)
+	}
+	k.template = t
+
+	if k.Match != "" {
+		if k.match, err = regexp.Compile(k.Match); err != nil {
+			return fmt.Errorf("bad match expression %s: %w", k.Match, err)
+		}
+	}
+
+	return nil
+}
+
+// or returns the template if there is one, or else the fallback
+func (k KeyTemplate) or(fallback KeyTemplate) KeyTemplate {
+	if k.Template == "" {
+		return fallback
+	}
+	return k
+}
+
+// render builds the key of the directory, given relative to the repo.  Data holds everything else the template may
+// use, which named groups of the match expression override.
+func (k KeyTemplate) render(rel string, data map[string]string) (string, error) {
+	values := make(map[string]string)
+	for name, v := range data {
+		values[name] = v
+	}
+
+	if k.match != nil {
+		m := k.match.FindStringSubmatch(rel)
+		if m == nil {
+			return "", fmt.Errorf("%s does not match %s", rel, k.Match)
+		}
+		for i, name := range k.match.SubexpNames() {
+			if name != "" {
+				values[name] = m[i]
+			}
+		}
+	}
+
+	var b bytes.Buffer
+	if err := k.template.Execute(&b, values); err != nil {
+		return "", fmt.Errorf("cannot build key for %s: %w", rel, err)
+	}
+
+	return checkKey(b.String())
+}
+
+// keyData is what a key template knows about a directory without any configuration
+func keyData(repo, rel, workspace, remote string) map[string]string {
+	data := map[string]string{
+		"dir":       rel,
+		"component": path.Base(rel),
+		"workspace": workspace,
+	}
+
+	if workspace == "" {
+		data["workspace"] = "default"
+	}
+
+	// Templates using anything unknown fail rather than building a key without it
+	if repo != "" {
+		data["repo"] = repo
+	}
+	if remote != "" {
+		data["remote"] = remote
+	}
+
+	return data
+}
+
+// checkKey cleans up a key and makes sure it is safe to send to the server
+func checkKey(key string) (string, error) {
+	key = strings.Trim(key, "/")
+	if err := storage.ParseKey(key).Validate(); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// clip derives a server key from the last parts of a directory path
+func clip(dir string, last int) string {
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+
+	parts := strings.Split(strings.Trim(filepath.ToSlash(filepath.Clean(dir)), "/"), "/")
+	if last > 0 && len(parts) > last {
+		parts = parts[len(parts)-last:]
+	}
+
+	return strings.Join(parts, "/")
+}
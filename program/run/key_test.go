@@ -0,0 +1,79 @@
+package run
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKeyTemplate_render(t *testing.T) {
+	keys := KeyTemplate{Template: "{{.env}}/{{.component}}", Match: `^envs/(?P<env>[^/]+)/`}
+	require.NoError(t, keys.compile())
+
+	key, err := keys.render("envs/prod/network", keyData("infra", "envs/prod/network", "", ""))
+	require.NoError(t, err)
+	assert.Equal(t, "prod/network", key)
+
+	key, err = keys.render("envs/prod/us-east-1/app", keyData("infra", "envs/prod/us-east-1/app", "", ""))
+	require.NoError(t, err)
+	assert.Equal(t, "prod/app", key, "any depth")
+
+	_, err = keys.render("global/dns", keyData("infra", "global/dns", "", ""))
+	assert.ErrorContains(t, err, "does not match")
+
+	keys = KeyTemplate{Template: "{{.remote}}/{{.dir}}"}
+	require.NoError(t, keys.compile())
+	_, err = keys.render("a", keyData("infra", "a", "", ""))
+	assert.Error(t, err, "no remote")
+
+	key, err = keys.render("a", keyData("infra", "a", "", "org/infra"))
+	require.NoError(t, err)
+	assert.Equal(t, "org/infra/a", key)
+
+	keys = KeyTemplate{Template: `{{.repo | lower}}/{{replace .dir "/" "-"}}/{{.workspace}}`}
+	require.NoError(t, keys.compile())
+	key, err = keys.render("a/b", keyData("Infra", "a/b", "blue", ""))
+	require.NoError(t, err)
+	assert.Equal(t, "infra/a-b/blue", key)
+
+	for name, template := range map[string]string{
+		"escapes":    "../{{.component}}",
+		"empty part": "{{.repo}}//{{.component}}",
+		"empty":      "{{if false}}x{{end}}",
+	} {
+		keys := KeyTemplate{Template: template}
+		require.NoError(t, keys.compile(), name)
+		_, err := keys.render("a/b", keyData("infra", "a/b", "", ""))
+		assert.Error(t, err, name)
+	}
+}
+
+func TestKeyTemplate_compile(t *testing.T) {
+	for name, keys := range map[string]KeyTemplate{
+		"bad template":       {Template: "{{.env"},
+		"bad match":          {Template: "{{.env}}", Match: "(?P<env"},
+		"match, no template": {Match: "(?P<env>.*)"},
+		"unknown function":   {Template: "{{upper .env}}"},
+	} {
+		assert.Error(t, keys.compile(), name)
+	}
+}
+
+func TestClip(t *testing.T) {
+	dir := t.TempDir()
+	component := filepath.Join(dir, "envs", "prod", "network")
+	require.NoError(t, os.MkdirAll(component, os.ModePerm))
+
+	assert.Equal(t, "prod/network", clip(component, 2))
+	assert.Equal(t, "network", clip(component+string(filepath.Separator), 1))
+
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(component))
+	defer os.Chdir(wd)
+
+	assert.Equal(t, "prod/network", clip(".", 2), "relative directories are clipped from where they really are")
+	assert.Equal(t, "envs/prod", clip("..", 2))
+}
@@ -4,13 +4,18 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/acarl005/stripansi"
+	"github.com/deweysasser/olympus/auth"
+	"github.com/deweysasser/olympus/compression"
 	"github.com/deweysasser/olympus/git"
 	"github.com/deweysasser/olympus/run"
+	"github.com/deweysasser/olympus/terraform"
 	tfjson "github.com/hashicorp/terraform-json"
 	"github.com/remeh/sizedwaitgroup"
 	"github.com/rs/zerolog/log"
+	"io"
 	"net/http"
 	"os"
 	"os/exec"
@@ -21,40 +26,80 @@ import (
 )
 
 type Options struct {
-	Collector  string        `help:"collector address" default:"http://localhost:8080/plan"`
-	Command    []string      `sep:";" help:"sequences of commands to generate a plan JSON.  The final command should generate a terraform JSON format plan output" default:"terraform plan; terraform show -json plan"`
-	RunTimeout time.Duration `help:"Maximum time to allow a command to run" default:"5m"`
-	Parallel   int           `help:"Number of processes to run in parallel" default:"1"`
-	ClipLast   int           `help:"Number of directories from the end path to use sending to poc-server" default:"2"`
-
-	Directories []string `arg:"" help:"Directories in which to run terraform"`
+	Collector        string        `help:"collector address" default:"http://localhost:8080/plan"`
+	Command          []string      `sep:"none" help:"Commands to generate a plan JSON, separated by ';' or given several times.  They are split into words like a shell would, but not run by one.  The final command should generate a terraform JSON format plan output" default:"terraform plan; terraform show -json plan"`
+	RunTimeout       time.Duration `help:"Maximum time to allow a command to run" default:"5m"`
+	Parallel         int           `help:"Number of processes to run in parallel" default:"1"`
+	TargetCPU        int           `help:"CPU use (percent) to aim for by running between --parallel and --max-parallel processes (0 to always run --parallel)" default:"0"`
+	MaxParallel      int           `help:"Most processes to run in parallel when targeting CPU use" default:"8"`
+	AdjustEvery      time.Duration `help:"How often to measure CPU use when targeting it" default:"10s"`
+	ClipLast         int           `help:"Number of directories from the end path to use sending to poc-server" default:"2"`
+	KeyTemplate      string        `help:"Template of the server keys of directories given on the command line, e.g. {{.env}}/{{.component}}.  Overrides --clip-last."`
+	KeyMatch         string        `help:"Regular expression matched against directories given on the command line, whose named groups the key template can use"`
+	Config           string        `help:"Agent configuration file describing the repos and components to plan" type:"path" short:"f"`
+	Name             string        `help:"Name by which the agent identifies itself to the server (defaults to the host name)"`
+	Secret           string        `help:"Secret shared with the server, with which uploads are signed" env:"OLYMPUS_SECRET"`
+	Profile          string        `help:"How much of each plan to send, unless configured otherwise (minimal|diff-only|full)" enum:"minimal,diff-only,full" default:"diff-only"`
+	Spool            string        `help:"Directory in which to keep results which could not be sent, to retry later (empty to disable)" default:"~/.olympus/spool"`
+	SpoolSize        int           `help:"Most megabytes of results to keep in the spool" default:"256"`
+	SpoolAge         time.Duration `help:"Longest to keep results in the spool" default:"72h"`
+	Compress         string        `help:"How to compress results sent to the server (none|gzip|zstd)" enum:"none,gzip,zstd" default:"none"`
+	Workspaces       []string      `help:"Workspaces to plan in each directory given on the command line.  Patterns select from those listed by --workspace-command."`
+	WorkspaceCommand string        `help:"Command listing the workspaces of a component, for workspace patterns" default:"terraform workspace list"`
+
+	Directories []string `arg:"" optional:"" help:"Directories in which to run terraform"`
+
+	spool *spool
 }
 
 func (options *Options) Run() error {
 
+	components, err := options.components()
+	if err != nil {
+		return err
+	}
+
+	if len(components) == 0 {
+		return errors.New("nothing to plan: give directories or a config file with components")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := options.openSpool(); err != nil {
+		return err
+	}
+	if options.spool != nil {
+		if sent, waiting := options.spool.drain(ctx, true); sent+waiting > 0 {
+			log.Info().Int("sent", sent).Int("waiting", waiting).Msg("Retried spooled results")
+		}
+	}
+
 	log.Debug().Int("parallel", options.Parallel).Msg("Running plans concurrently")
-	wg := sizedwaitgroup.New(options.Parallel)
+	wg := options.limiter(ctx)
 
 	durations := make(chan time.Duration, 10000)
 
 	start := time.Now()
 
-	for _, dir := range options.Directories {
-		wg.Add()
-		go func(dir string) {
+	for _, c := range components {
+		if err := wg.AddWithContext(ctx); err != nil {
+			return err
+		}
+		go func(c Component) {
 			defer wg.Done()
-			info, err := os.Stat(dir)
+			info, err := os.Stat(c.Dir)
 			if err != nil {
-				log.Error().Err(err).Str("dir", dir).Msg("Directory not found")
+				log.Error().Err(err).Str("dir", c.Dir).Msg("Directory not found")
 				return
 			} else if !info.IsDir() {
-				log.Info().Str("dir", dir).Msg("Directory is not a directory.  Skipping")
+				log.Info().Str("dir", c.Dir).Msg("Directory is not a directory.  Skipping")
 				return
 			}
 			start := time.Now()
-			options.processDir(dir)
+			options.process(c)
 			durations <- time.Since(start)
-		}(dir)
+		}(c)
 	}
 
 	wg.Wait()
@@ -69,7 +114,10 @@ func (options *Options) Run() error {
 		fmt.Print(" ", d.String())
 	}
 
-	average := total.Milliseconds() / count
+	var average int64
+	if count > 0 {
+		average = total.Milliseconds() / count
+	}
 	aDur := time.Duration(average) * time.Millisecond
 
 	fmt.Println("")
@@ -80,10 +128,125 @@ func (options *Options) Run() error {
 	return nil
 }
 
-// processDir processes a single directory
-func (options *Options) processDir(dir string) {
+// limiter returns what bounds the number of plans run at once.  When targeting CPU use, it adapts until the context is
+// cancelled.
+func (options *Options) limiter(ctx context.Context) limiter {
+	if options.TargetCPU <= 0 {
+		wg := sizedwaitgroup.New(options.Parallel)
+		return &wg
+	}
+
+	a := newAdaptiveLimit(options.Parallel, options.MaxParallel, float64(options.TargetCPU)/100)
+	go a.monitor(ctx, procStat, options.AdjustEvery)
+	return a
+}
+
+// openSpool prepares the spool of results which could not be sent, unless it is disabled
+func (options *Options) openSpool() error {
+	if options.Spool == "" {
+		return nil
+	}
+
+	s, err := newSpool(expandHome(options.Spool), int64(options.SpoolSize)*1024*1024, options.SpoolAge, options.send)
+	if err != nil {
+		return err
+	}
+	options.spool = s
+	return nil
+}
+
+// components returns everything to plan, from both the command line and the config file
+func (options *Options) components() ([]Component, error) {
+	var result []Component
+
+	keys := KeyTemplate{Template: options.KeyTemplate, Match: options.KeyMatch}
+	if err := keys.compile(); err != nil {
+		return nil, err
+	}
+
+	commands, err := ParseSteps(options.Command...)
+	if err != nil {
+		return nil, fmt.Errorf("bad --command: %w", err)
+	}
+
+	for _, dir := range options.Directories {
+		key, err := options.directoryKey(dir, keys)
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, Component{
+			Dir:        dir,
+			Key:        key,
+			Commands:   commands,
+			Workspaces: options.Workspaces,
+		})
+	}
+
+	if options.Config != "" {
+		config, err := LoadConfig(options.Config)
+		if err != nil {
+			return nil, err
+		}
+
+		if config.Collector != "" {
+			options.Collector = config.Collector
+		}
+
+		fromConfig, err := config.Components(commands)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, fromConfig...)
+	}
 
-	log := log.Logger.With().Str("dir", dir).Logger()
+	return result, nil
+}
+
+// directoryKey decides the server key of a directory given on the command line
+func (options *Options) directoryKey(dir string, keys KeyTemplate) (string, error) {
+	if keys.Template == "" {
+		return checkKey(clip(dir, options.ClipLast))
+	}
+
+	rel := filepath.ToSlash(filepath.Clean(dir))
+	remote, err := git.RemotePath(dir)
+	if err != nil {
+		log.Debug().Err(err).Str("dir", dir).Msg("No git remote for key template")
+	}
+
+	return keys.render(rel, keyData("", rel, "", remote))
+}
+
+// process plans a component in each of its workspaces and sends the results to the collector.  It returns true if
+// every plan succeeded and was sent.
+func (options *Options) process(c Component) bool {
+	if len(c.Workspaces) == 0 {
+		return options.processWorkspace(c)
+	}
+
+	workspaces, err := options.workspaces(c)
+	if err != nil {
+		log.Error().Err(err).Str("dir", c.Dir).Msg("Failed to list workspaces")
+		return false
+	}
+
+	succeeded := true
+	for _, w := range workspaces {
+		wc := c
+		wc.Workspace = w
+		wc.Workspaces = nil
+		succeeded = options.processWorkspace(wc) && succeeded
+	}
+	return succeeded
+}
+
+// processWorkspace plans a component in its workspace and sends the result to the collector.  It returns true if the
+// plan succeeded and was sent.
+func (options *Options) processWorkspace(c Component) bool {
+	dir := c.Dir
+
+	log := log.Logger.With().Str("dir", dir).Str("workspace", string(c.Workspace)).Logger()
 	log.Info().Msg("Processing dir")
 	sha, err := git.CurrentSHA(dir)
 
@@ -91,107 +254,374 @@ func (options *Options) processDir(dir string) {
 		log.Error().Err(err).Msg("Failed to get git HEAD sha")
 	}
 
-	run := &run.PlanRecord{Start: time.Now(), CommitSHA: sha}
+	branch, err := git.CurrentBranch(dir)
 
-	plan, err := options.getPlan(dir)
 	if err != nil {
-		return
+		log.Error().Err(err).Msg("Failed to get git branch")
 	}
 
-	run.Plan = plan
+	run := &run.PlanRecord{
+		Start:     time.Now(),
+		CommitSHA: sha,
+		Branch:    branch,
+		Workspace: c.Workspace,
+		Command:   c.Commands.String(),
+	}
+
+	plan, err := options.getPlan(c)
+	run.End = time.Now()
 
-	b, err := json.Marshal(run)
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to get git HEAD sha")
-		return
+		// Report the failure so it's not confused with a component that has never been planned
+		var failure *commandError
+		if errors.As(err, &failure) {
+			run.Command = failure.command
+			run.Output = redactOutput(failure.output, c.Env, failure.env)
+		} else {
+			run.Output = err.Error()
+		}
+
+		run.Failure = terraform.FailureError
+		if run.Lock = terraform.ParseLock(run.Output); run.Lock != nil {
+			run.Failure = terraform.FailureLock
+		}
+	} else {
+		run.Plan = plan
+		run.Succeeded = true
+	}
+
+	url := fmt.Sprintf("%s/%s", options.Collector, c.Key)
+	u, err := options.encode(url, run)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to marshal results")
+		return false
 	}
 
-	if options.ClipLast > 0 {
-		parts := strings.Split(dir, "/") // todo:  better separator
-		if len(parts) > options.ClipLast {
-			last := len(parts) - options.ClipLast
-			parts = parts[last:]
+	id := uploadID(url, string(run.Branch), string(run.Workspace))
+	log.Info().Str("url", url).Int64("bytes", u.size()).Msg("Posting results")
+	if err := options.send(context.Background(), u); err != nil {
+		log.Error().Err(err).Msg("Failed to send results")
 
-			dir = filepath.Join(parts...)
+		if options.spool != nil && retryable(err) {
+			if err := options.spool.add(id, u); err != nil {
+				log.Error().Err(err).Msg("Failed to spool results")
+				u.remove()
+			} else {
+				log.Warn().Str("spool", options.spool.dir).Msg("Spooled results to send later")
+			}
+		} else {
+			u.remove()
 		}
+		return false
+	}
+	u.remove()
+
+	// Anything older still waiting would only hide these results
+	if options.spool != nil {
+		options.spool.remove(id)
+	}
+
+	return run.Succeeded
+}
+
+// bodyExt is the extension of files holding the bodies of uploads
+const bodyExt = ".body"
+
+// upload is a request body ready to send to the server
+type upload struct {
+	URL             string `json:"url"`
+	ContentType     string `json:"content-type"`
+	ContentEncoding string `json:"content-encoding,omitempty"`
+	// Body holds requests small enough to build in memory
+	Body []byte `json:"body,omitempty"`
+	// File holds requests which may be too large to, such as plan records
+	File string `json:"file,omitempty"`
+}
+
+// open returns a reader of the body of the upload and its length
+func (u upload) open() (io.ReadSeekCloser, int64, error) {
+	if u.File == "" {
+		return nopCloser{bytes.NewReader(u.Body)}, int64(len(u.Body)), nil
 	}
 
-	url := fmt.Sprintf("%s/%s", options.Collector, dir)
-	log.Info().Str("url", url).Msg("Posting results")
-	_, err = http.Post(url, "text/json", bytes.NewReader(b))
+	f, err := os.Open(u.File)
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to send results")
+		return nil, 0, err
 	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, info.Size(), nil
 }
 
-func (options *Options) getPlan(dir string) (*tfjson.Plan, error) {
+// size is the length of the body of the upload, or 0 if it can't be read
+func (u upload) size() int64 {
+	if u.File == "" {
+		return int64(len(u.Body))
+	}
+	info, err := os.Stat(u.File)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
 
-	var env []string
+// remove deletes the file holding the body of the upload, if there is one
+func (u upload) remove() {
+	if u.File == "" {
+		return
+	}
+	if err := os.Remove(u.File); err != nil && !os.IsNotExist(err) {
+		log.Error().Err(err).Str("file", u.File).Msg("Failed to remove upload")
+	}
+}
 
-	for _, e := range os.Environ() {
-		if !strings.HasPrefix(e, "TERM=") {
-			env = append(env, e)
-		}
+type nopCloser struct {
+	io.ReadSeeker
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// encode prepares a plan record for upload, compressed if the agent is configured to compress.  The record is encoded
+// and compressed as it is written to a file, in the spool if there is one so that it can be kept there if sending it
+// fails, and it is signed and sent from that file.  The caller must remove the file once it is done with it.
+func (options *Options) encode(url string, record *run.PlanRecord) (upload, error) {
+	encoding, err := compression.Parse(options.Compress)
+	if err != nil {
+		return upload{}, err
 	}
 
-	for _, c := range options.Command[0 : len(options.Command)-1] {
+	dir := os.TempDir()
+	if options.spool != nil {
+		dir = options.spool.dir
+	}
 
-		cmd := strings.Split(strings.TrimSpace(c), " ")
-		ctx, cancel := context.WithTimeout(context.Background(), options.RunTimeout+60*time.Second)
-		defer cancel()
+	f, err := os.CreateTemp(dir, "*"+bodyExt)
+	if err != nil {
+		return upload{}, err
+	}
+	u := upload{URL: url, ContentType: "text/json", ContentEncoding: string(encoding), File: f.Name()}
 
-		command := exec.CommandContext(ctx, cmd[0], cmd[1:]...)
-		command.Dir = dir
-		command.Env = env
+	if err := write(f, encoding, record); err != nil {
+		u.remove()
+		return upload{}, err
+	}
 
-		log := log.Logger.With().Str("dir", dir).Logger()
+	return u, nil
+}
 
-		var err error
+// write encodes the record into the file, closing it
+func write(f *os.File, encoding compression.Encoding, record *run.PlanRecord) error {
+	w, err := encoding.NewWriter(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
 
-		clog := log.With().Str("command", strings.Join(cmd, " ")).Logger()
+	if err := json.NewEncoder(w).Encode(record); err != nil {
+		w.Close()
+		f.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
 
-		clog.Debug().Msg("running command")
+// send posts an upload to the server, failing unless the server accepts it
+func (options *Options) send(ctx context.Context, u upload) error {
+	response, err := options.post(ctx, u)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, response.Body)
 
-		done := sigintAfter(options, command)
-		bytes, err := command.CombinedOutput()
-		done()
-		if err != nil {
-			log.Error().Err(err).Str("command", command.String()).Str("output", stripansi.Strip(string(bytes))).Msg("Error running command")
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return &statusError{url: u.URL, status: response.StatusCode}
+	}
+	return nil
+}
+
+// post sends a request to the server, signed if the agent has a secret.  The signature covers the body as sent, so
+// compressed bodies are signed compressed.  Bodies in files are read once to sign them and again to send them.
+func (options *Options) post(ctx context.Context, u upload) (*http.Response, error) {
+	body, size, err := u.open()
+	if err != nil {
+		return nil, err
+	}
 
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, u.URL, body)
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	request.ContentLength = size
+	request.Header.Set("Content-Type", u.ContentType)
+	if u.ContentEncoding != "" {
+		request.Header.Set("Content-Encoding", u.ContentEncoding)
+	}
+
+	if options.Secret != "" {
+		if err := auth.SignReader(request, options.name(), options.Secret, body); err != nil {
+			body.Close()
+			return nil, err
+		}
+		if _, err := body.Seek(0, io.SeekStart); err != nil {
+			body.Close()
 			return nil, err
 		}
 	}
 
-	cmd := strings.Split(strings.TrimSpace(options.Command[len(options.Command)-1]), " ")
-	ctx, cancel := context.WithTimeout(context.Background(), options.RunTimeout)
-	defer cancel()
+	// The client closes the body once it has been sent
+	return http.DefaultClient.Do(request)
+}
 
-	command := exec.CommandContext(ctx, cmd[0], cmd[1:]...)
-	command.Dir = dir
-	command.Env = env
+// name returns the name by which the agent identifies itself
+func (options *Options) name() string {
+	if options.Name != "" {
+		return options.Name
+	}
+	name, _ := os.Hostname()
+	return name
+}
 
-	clog := log.With().Str("command", strings.Join(cmd, " ")).Logger()
+func (options *Options) getPlan(component Component) (*tfjson.Plan, error) {
+	steps := component.Commands
+	if len(steps) == 0 {
+		return nil, errors.New("no commands to run")
+	}
 
-	clog.Debug().Msg("running command")
-	done := sigintAfter(options, command)
-	bytes, err := command.Output()
-	done()
+	env := componentEnv(component, component.Workspace)
 
+	for _, step := range steps[:len(steps)-1] {
+		if _, err := options.runStep(component.Dir, step, env, false); err != nil {
+			return nil, err
+		}
+	}
+
+	last := steps[len(steps)-1]
+	bytes, err := options.runStep(component.Dir, last, env, true)
 	if err != nil {
-		clog.Error().Err(err).Msg("Error running command")
 		return nil, err
 	}
 
 	var plan tfjson.Plan
 	err = json.Unmarshal(bytes, &plan)
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to parse json output")
+		log.Error().Err(err).Str("step", last.describe()).Msg("Failed to parse json output")
+		return nil, &commandError{command: last.describe(), output: err.Error(), err: err}
+	}
+
+	profile := component.Profile
+	if profile == "" {
+		profile = terraform.Profile(options.Profile)
 	}
+	profile.Strip(&plan)
 
+	scrub(&plan, component.Redact)
+
+	return &plan, nil
+}
+
+// componentEnv is the environment in which the component's commands run, selecting the workspace if one is given
+func componentEnv(component Component, workspace terraform.Workspace) []string {
+	var env []string
+
+	for _, e := range os.Environ() {
+		if !strings.HasPrefix(e, "TERM=") {
+			env = append(env, e)
+		}
+	}
+
+	// Later values override earlier ones
+	for k, v := range component.Env {
+		env = append(env, k+"="+v)
+	}
+	if workspace != "" {
+		env = append(env, "TF_WORKSPACE="+string(workspace))
+	}
+
+	return env
+}
+
+// runStep runs one step of planning the component in dir.  The last step produces the plan, so only what it writes to
+// stdout is returned; earlier steps return everything they wrote.
+func (options *Options) runStep(dir string, step Step, env []string, last bool) ([]byte, error) {
+	if len(step.Args) == 0 {
+		return nil, &commandError{command: step.describe(), err: errors.New("empty command")}
+	}
+
+	// Earlier steps get longer since they are given a chance to stop after being interrupted
+	timeout := options.RunTimeout + 60*time.Second
+	if last {
+		timeout = options.RunTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	command := exec.CommandContext(ctx, step.Args[0], step.Args[1:]...)
+	command.Dir = step.dir(dir)
+	command.Env = env
+	for k, v := range step.Env {
+		command.Env = append(command.Env[:len(command.Env):len(command.Env)], k+"="+v)
+	}
+
+	clog := log.Logger.With().Str("dir", dir).Str("step", step.describe()).Logger()
+	clog.Debug().Msg("running command")
+
+	done := sigintAfter(options, command)
+	var bytes []byte
+	var err error
+	if last {
+		bytes, err = command.Output()
+	} else {
+		bytes, err = command.CombinedOutput()
+	}
+	done()
+
+	if err != nil {
+		output := string(bytes)
+		if last {
+			output = stderr(err)
+		}
+		clog.Error().Err(err).Str("output", stripansi.Strip(output)).Msg("Error running command")
+
+		return nil, &commandError{command: step.describe(), output: output, env: step.Env, err: err}
+	}
+
+	return bytes, nil
+}
+
+// scrub removes everything from a plan which must not leave the agent, returning what it removed
+func scrub(plan *tfjson.Plan, rules []terraform.RedactionRule) []terraform.Redaction {
 	// Get rid of variables immediately -- they likely contain sensitive information
 	plan.Variables = make(map[string]*tfjson.PlanVariable)
 
-	return &plan, nil
+	return terraform.Redact(plan, rules...)
+}
+
+// commandError records which command failed and what it said
+type commandError struct {
+	command string
+	output  string
+	// env is what the step added to the environment, so its secrets can be kept out of the output
+	env map[string]string
+	err error
+}
+
+func (e *commandError) Error() string {
+	return fmt.Sprintf("%s: %s", e.command, e.err)
+}
+
+func (e *commandError) Unwrap() error {
+	return e.err
 }
 
 func sigintAfter(options *Options, command *exec.Cmd) func() {
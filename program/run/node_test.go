@@ -0,0 +1,108 @@
+package run
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/deweysasser/olympus/auth"
+	"github.com/deweysasser/olympus/compression"
+	"github.com/deweysasser/olympus/run"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOptions_encode(t *testing.T) {
+	record := &run.PlanRecord{Branch: "main", Output: strings.Repeat("no changes\n", 1000)}
+	plain, err := json.Marshal(record)
+	require.NoError(t, err)
+
+	for _, c := range []string{"none", "gzip", "zstd"} {
+		options := &Options{Compress: c}
+		u, err := options.encode("http://server/plan/a", record)
+		require.NoError(t, err, c)
+
+		body, err := os.ReadFile(u.File)
+		require.NoError(t, err, c)
+
+		if c == "none" {
+			assert.Empty(t, u.ContentEncoding)
+		} else {
+			assert.Equal(t, c, u.ContentEncoding)
+			assert.Less(t, len(body), len(plain)/10, c)
+		}
+
+		b, err := compression.Decompress(body)
+		require.NoError(t, err, c)
+		decoded := &run.PlanRecord{}
+		require.NoError(t, json.Unmarshal(b, decoded), c)
+		assert.Equal(t, record.Output, decoded.Output, c)
+
+		u.remove()
+		assert.NoFileExists(t, u.File, c)
+	}
+}
+
+func TestOptions_send_signed(t *testing.T) {
+	verifier, err := auth.NewVerifier([]auth.Agent{{Name: "agent", SecretSHA256: auth.HashSecret("s3cret")}})
+	require.NoError(t, err)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		assert.Equal(t, int64(len(body)), r.ContentLength)
+
+		if _, err := verifier.Verify(r, body); err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+
+	options := &Options{Name: "agent", Secret: "s3cret", Compress: "zstd"}
+
+	// Records are signed and sent from their files
+	u, err := options.encode(server.URL+"/plan/a", &run.PlanRecord{Branch: "main"})
+	require.NoError(t, err)
+	defer u.remove()
+	assert.NoError(t, options.send(context.Background(), u))
+
+	assert.NoError(t, options.send(context.Background(), jsonUpload(server.URL+"/api/v1/lease", "{}")))
+}
+
+func TestOptions_process_spool(t *testing.T) {
+	status := http.StatusServiceUnavailable
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	options := &Options{Collector: server.URL + "/plan", RunTimeout: time.Minute, Spool: dir}
+	require.NoError(t, options.openSpool())
+
+	component := Component{
+		Dir:      t.TempDir(),
+		Key:      "infra/app",
+		Commands: Steps{{Args: []string{"echo", `{"format_version":"1.1"}`}}},
+	}
+
+	// Results which could not be sent are kept in the spool, body and all
+	assert.False(t, options.process(component))
+	entries := options.spool.entries()
+	require.Len(t, entries, 1)
+	assert.Equal(t, dir, filepath.Dir(entries[0].File))
+	assert.FileExists(t, entries[0].File)
+
+	// and nothing is left behind once they are
+	status = http.StatusOK
+	assert.True(t, options.process(component))
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, files)
+}
@@ -0,0 +1,51 @@
+package run
+
+import (
+	"github.com/acarl005/stripansi"
+	"github.com/deweysasser/olympus/terraform"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// maxOutput is the most command output sent to the server.  Errors are at the end, so that's what is kept.
+const maxOutput = 16 * 1024
+
+// sensitiveName matches the names of environment variables whose values must never leave the agent
+var sensitiveName = regexp.MustCompile(`(?i)(secret|token|password|passwd|credential|private|key)`)
+
+// redactOutput makes command output safe to send to the server by removing terminal escapes, removing the values of
+// sensitive environment variables and limiting its size.  The variables are those of the agent and those configured
+// for the command in envs.
+func redactOutput(output string, envs ...map[string]string) string {
+	output = stripansi.Strip(output)
+
+	var values []string
+	add := func(name, value string) {
+		// Very short values would redact too much of the output to be useful
+		if len(value) >= 4 && sensitiveName.MatchString(name) {
+			values = append(values, value, terraform.Redacted)
+		}
+	}
+
+	for _, e := range os.Environ() {
+		if name, value, found := strings.Cut(e, "="); found {
+			add(name, value)
+		}
+	}
+	for _, env := range envs {
+		for name, value := range env {
+			add(name, value)
+		}
+	}
+
+	if len(values) > 0 {
+		output = strings.NewReplacer(values...).Replace(output)
+	}
+
+	if len(output) > maxOutput {
+		output = "..." + output[len(output)-maxOutput:]
+	}
+
+	return output
+}
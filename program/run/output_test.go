@@ -0,0 +1,57 @@
+package run
+
+import (
+	"encoding/json"
+	"github.com/deweysasser/olympus/run"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_redactOutput(t *testing.T) {
+	t.Setenv("TEST_API_TOKEN", "hunter2hunter2")
+	t.Setenv("TEST_SHORT_SECRET", "abc")
+	t.Setenv("TEST_PLAIN", "visible-value")
+
+	out := redactOutput("\x1b[31mError:\x1b[0m token hunter2hunter2 rejected for visible-value (abc)")
+	assert.Equal(t, "Error: token [REDACTED] rejected for visible-value (abc)", out)
+
+	// Configured variables are redacted as well
+	out = redactOutput("db hunter3hunter3 step s3cr3t-value", map[string]string{"TF_VAR_db_password": "hunter3hunter3"}, nil, map[string]string{"STEP_TOKEN": "s3cr3t-value"})
+	assert.Equal(t, "db [REDACTED] step [REDACTED]", out)
+
+	long := strings.Repeat("x", maxOutput) + "the end"
+	out = redactOutput(long)
+	assert.True(t, strings.HasPrefix(out, "..."))
+	assert.True(t, strings.HasSuffix(out, "the end"))
+	assert.Equal(t, maxOutput+3, len(out))
+}
+
+func TestOptions_process_redactsEnv(t *testing.T) {
+	var received *run.PlanRecord
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = &run.PlanRecord{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(received))
+	}))
+	defer server.Close()
+
+	o := &Options{Collector: server.URL + "/plan", RunTimeout: time.Minute}
+
+	// Secrets from the configuration file don't reach the server when a step fails
+	o.process(Component{
+		Dir: t.TempDir(),
+		Key: "infra/app",
+		Env: map[string]string{"TF_VAR_db_password": "component-secret"},
+		Commands: Steps{{
+			Args: []string{"sh", "-c", `echo "$TF_VAR_db_password $API_TOKEN" >&2; exit 1`},
+			Env:  map[string]string{"API_TOKEN": "step-secret"},
+		}},
+	})
+
+	require.NotNil(t, received)
+	assert.Equal(t, "[REDACTED] [REDACTED]\n", received.Output)
+}
@@ -0,0 +1,121 @@
+package run
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/deweysasser/olympus/queue"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// leased plans requests leased from the server until the context is cancelled.  A request is only claimed when there
+// is capacity to plan it right away, so that any backlog stays on the server where autoscalers can see it.
+func (o *AgentOptions) leased(ctx context.Context, components []Component, limit limiter) error {
+	byKey := make(map[string]Component)
+	var repos, keys []string
+	for _, c := range components {
+		if c.Repo == "" {
+			continue
+		}
+		byKey[c.Key] = c
+		keys = append(keys, c.Key)
+		if !contains(repos, c.Repo) {
+			repos = append(repos, c.Repo)
+		}
+	}
+
+	if len(repos) == 0 {
+		return errors.New("pull mode needs a config file with repos to plan")
+	}
+
+	// Plans must go to the server which leased them to complete the lease
+	o.Collector = strings.TrimSuffix(o.Server, "/") + "/api/v1/plans"
+
+	for {
+		if err := limit.AddWithContext(ctx); err != nil {
+			return nil
+		}
+
+		lease, err := o.claim(ctx, repos, keys)
+
+		var c Component
+		ok := false
+		switch {
+		case err != nil:
+			if ctx.Err() == nil {
+				log.Error().Err(err).Str("server", o.Server).Msg("Failed to lease a plan request")
+			}
+		case lease != nil:
+			if c, ok = byKey[lease.Key]; !ok || c.Repo != lease.Repo {
+				// The lease expires and the request goes to an agent which knows about it.  A server which ignores the
+				// keys offers it again, so wait as if there were nothing to do.
+				log.Error().Str("key", lease.Key).Str("repo", lease.Repo).Msg("Leased a component which is not configured")
+				ok = false
+			}
+		}
+
+		if !ok {
+			limit.Done()
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(o.PollEvery):
+			}
+			continue
+		}
+
+		log.Info().Str("key", lease.Key).Str("branch", string(lease.Branch)).Str("workspace", string(lease.Workspace)).
+			Str("lease", lease.ID).Msg("Leased plan request")
+
+		c.Branch = lease.Branch
+		c.Workspace = lease.Workspace
+		c.Workspaces = nil
+
+		go func(c Component) {
+			defer limit.Done()
+			o.plan(c)
+		}(c)
+	}
+}
+
+// claim asks the server for a single request to plan from the repos, and only for the keys configured.  It returns nil
+// if there is nothing to do.
+func (o *AgentOptions) claim(ctx context.Context, repos, keys []string) (*queue.Lease, error) {
+	b, err := json.Marshal(map[string]any{"agent": o.name(), "repos": repos, "keys": keys})
+	if err != nil {
+		return nil, err
+	}
+
+	url := strings.TrimSuffix(o.Server, "/") + "/api/v1/lease"
+	response, err := o.post(ctx, upload{URL: url, ContentType: "application/json", Body: b})
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	switch response.StatusCode {
+	case http.StatusNoContent:
+		return nil, nil
+	case http.StatusOK:
+		lease := &queue.Lease{}
+		if err := json.NewDecoder(response.Body).Decode(lease); err != nil {
+			return nil, fmt.Errorf("invalid lease from %s: %w", url, err)
+		}
+		return lease, nil
+	default:
+		return nil, fmt.Errorf("%s returned %s", url, response.Status)
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,118 @@
+package run
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/deweysasser/olympus/queue"
+	"github.com/deweysasser/olympus/run"
+	"github.com/remeh/sizedwaitgroup"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAgentOptions_leased(t *testing.T) {
+	requests := []queue.Request{
+		{Key: "infra/a", Repo: "infra", Branch: "main", Workspace: "default"},
+		{Key: "infra/b", Repo: "infra", Branch: "main", Workspace: "blue"},
+		{Key: "elsewhere", Repo: "infra", Branch: "main", Workspace: "default"},
+		{Key: "infra/a", Repo: "infra", Branch: "feature", Workspace: "default"},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var lock sync.Mutex
+	var outstanding, maxOutstanding int
+	var received []run.PlanRecord
+	var receivedKeys []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		switch {
+		case r.URL.Path == "/api/v1/lease":
+			body := struct {
+				Agent string
+				Repos []string
+				Keys  []string
+			}{}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			assert.Equal(t, "test-agent", body.Agent)
+			assert.Equal(t, []string{"infra"}, body.Repos)
+			assert.Equal(t, []string{"infra/a", "infra/b"}, body.Keys)
+
+			if len(requests) == 0 {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			lease := queue.Lease{Request: requests[0], ID: "lease", Agent: body.Agent}
+			requests = requests[1:]
+			if lease.Key != "elsewhere" {
+				outstanding++
+			}
+			if outstanding > maxOutstanding {
+				maxOutstanding = outstanding
+			}
+			require.NoError(t, json.NewEncoder(w).Encode(lease))
+
+		case strings.HasPrefix(r.URL.Path, "/api/v1/plans/"):
+			record := run.PlanRecord{}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&record))
+			received = append(received, record)
+			receivedKeys = append(receivedKeys, strings.TrimPrefix(r.URL.Path, "/api/v1/plans/"))
+			outstanding--
+			if len(received) == 3 {
+				cancel()
+			}
+			w.WriteHeader(http.StatusCreated)
+
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	commands := Steps{{Args: []string{"sleep", "0.05"}}, {Args: []string{"echo", `{"format_version":"1.1"}`}}}
+	o := &AgentOptions{
+		Options:   Options{Parallel: 2, RunTimeout: time.Minute, Name: "test-agent"},
+		Server:    server.URL,
+		PollEvery: 10 * time.Millisecond,
+	}
+	components := []Component{
+		{Key: "infra/a", Dir: t.TempDir(), Repo: "infra", Commands: commands},
+		{Key: "infra/b", Dir: t.TempDir(), Repo: "infra", Commands: commands},
+		{Key: "unmanaged", Dir: t.TempDir(), Commands: commands},
+	}
+	o.prepare(components)
+
+	limit := sizedwaitgroup.New(o.Parallel)
+	done := make(chan error)
+	go func() {
+		done <- o.leased(ctx, components, &limit)
+	}()
+
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("agent did not plan the leased requests")
+	}
+	limit.Wait()
+
+	assert.Equal(t, 2, maxOutstanding, "never claims more than it can run")
+	assert.ElementsMatch(t, []string{"infra/a", "infra/b", "infra/a"}, receivedKeys)
+	for _, r := range received {
+		assert.True(t, r.Succeeded)
+	}
+
+	status := o.snapshot()
+	assert.Equal(t, "infra/a", status[0].Key)
+	assert.Equal(t, 2, status[0].Runs)
+}
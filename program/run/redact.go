@@ -0,0 +1,67 @@
+package run
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/deweysasser/olympus/terraform"
+	tfjson "github.com/hashicorp/terraform-json"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+)
+
+// RedactOptions shows what the agent would send for a plan, so that redaction rules and profiles can be checked
+type RedactOptions struct {
+	Config  string `help:"Agent configuration file with the redaction rules and profile to apply" type:"path" short:"f"`
+	Repo    string `help:"Also apply the rules and profile of this repo in the configuration file"`
+	Profile string `help:"How much of the plan to send, unless configured otherwise (minimal|diff-only|full)" enum:"minimal,diff-only,full" default:"diff-only"`
+	Check   bool   `help:"List what would be redacted rather than showing the redacted plan"`
+
+	Plan string `arg:"" help:"Terraform JSON plan (as written by terraform show -json)" type:"existingfile"`
+
+	out io.Writer
+}
+
+func (o *RedactOptions) Run() error {
+	if o.out == nil {
+		o.out = os.Stdout
+	}
+
+	var rules []terraform.RedactionRule
+	profile := terraform.Profile(o.Profile)
+	if o.Config != "" {
+		config, err := LoadConfig(o.Config)
+		if err != nil {
+			return err
+		}
+		rules = config.RedactionRules(o.Repo)
+		if p := config.UploadProfile(o.Repo); p != "" {
+			profile = p
+		}
+	}
+
+	b, err := os.ReadFile(o.Plan)
+	if err != nil {
+		return err
+	}
+
+	plan := &tfjson.Plan{}
+	if err := json.Unmarshal(b, plan); err != nil {
+		return errors.Wrap(err, "while reading plan "+o.Plan)
+	}
+
+	// Whatever the profile doesn't send needs no redacting
+	profile.Strip(plan)
+	redactions := scrub(plan, rules)
+
+	if !o.Check {
+		return json.NewEncoder(o.out).Encode(plan)
+	}
+
+	for _, r := range redactions {
+		fmt.Fprintln(o.out, r.String())
+	}
+	fmt.Fprintf(o.out, "%d values redacted (variables are always removed)\n", len(redactions))
+
+	return nil
+}
@@ -0,0 +1,73 @@
+package run
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const redactPlan = `{
+  "format_version": "1.1",
+  "variables": {"region": {"value": "us-east-1"}},
+  "resource_changes": [{
+    "address": "aws_instance.web", "mode": "managed", "type": "aws_instance", "name": "web",
+    "change": {"actions": ["create"], "after": {"ami": "ami-123", "user_data": "export PASSWORD=hunter2"}}
+  }]
+}`
+
+func TestRedactOptions_Run(t *testing.T) {
+	dir := t.TempDir()
+	plan := filepath.Join(dir, "plan.json")
+	require.NoError(t, os.WriteFile(plan, []byte(redactPlan), 0644))
+	config := writeConfig(t, dir, `
+redact:
+  - type: aws_instance
+    attribute: user_data
+`)
+
+	var out bytes.Buffer
+	options := &RedactOptions{Config: config, Plan: plan, out: &out}
+	require.NoError(t, options.Run())
+
+	assert.NotContains(t, out.String(), "hunter2")
+	assert.NotContains(t, out.String(), "us-east-1")
+	assert.Contains(t, out.String(), "ami-123")
+
+	out.Reset()
+	options.Check = true
+	require.NoError(t, options.Run())
+
+	assert.Equal(t, "aws_instance.web: after.user_data (rule type aws_instance, attribute user_data)\n"+
+		"1 values redacted (variables are always removed)\n", out.String())
+}
+
+func TestRedactOptions_Run_profile(t *testing.T) {
+	dir := t.TempDir()
+	plan := filepath.Join(dir, "plan.json")
+	require.NoError(t, os.WriteFile(plan, []byte(redactPlan), 0644))
+
+	var out bytes.Buffer
+	options := &RedactOptions{Plan: plan, Profile: "minimal", out: &out}
+	require.NoError(t, options.Run())
+	assert.NotContains(t, out.String(), "ami-123")
+	assert.Contains(t, out.String(), "aws_instance.web")
+
+	// The configuration decides, and a repo's profile overrides the agent's
+	options.Config = writeConfig(t, dir, `
+profile: full
+repos:
+  - name: infra
+    path: .
+    profile: minimal
+`)
+	for repo, shown := range map[string]bool{"": true, "infra": false} {
+		out.Reset()
+		options.Repo = repo
+		require.NoError(t, options.Run())
+		assert.Equal(t, shown, strings.Contains(out.String(), "ami-123"), repo)
+	}
+}
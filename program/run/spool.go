@@ -0,0 +1,350 @@
+package run
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Retries of spooled uploads back off exponentially between these
+const (
+	minBackoff = 30 * time.Second
+	maxBackoff = 30 * time.Minute
+)
+
+// drainEvery is how often the agent daemon looks for spooled uploads due to be retried
+const drainEvery = 30 * time.Second
+
+// statusError is an upload the server did not accept
+type statusError struct {
+	url    string
+	status int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%s responded %d %s", e.url, e.status, http.StatusText(e.status))
+}
+
+// retryable reports whether an upload which failed with err might succeed later.  Uploads the server rejected outright
+// won't, so there is no point keeping them.
+func retryable(err error) bool {
+	var status *statusError
+	if !errors.As(err, &status) {
+		return true
+	}
+	return status.status >= 500 || status.status == http.StatusRequestTimeout || status.status == http.StatusTooManyRequests
+}
+
+// spooled is an upload waiting to be retried
+type spooled struct {
+	// ID identifies what the upload is a plan of.  A newer plan of the same thing replaces it.
+	ID string `json:"id"`
+	upload
+	Created  time.Time `json:"created"`
+	Attempts int       `json:"attempts"`
+	Next     time.Time `json:"next"`
+}
+
+// spool keeps uploads which could not be sent on disk until they can be.  Only the newest upload of each plan is kept,
+// since an older one arriving late would hide it.  Each upload is described by a JSON file, and the body of a large one
+// is kept in a file of its own alongside.
+type spool struct {
+	dir      string
+	maxBytes int64
+	maxAge   time.Duration
+	send     func(ctx context.Context, u upload) error
+	now      func() time.Time
+
+	// lock keeps the files from changing while they are being read or replaced
+	lock sync.Mutex
+}
+
+func newSpool(dir string, maxBytes int64, maxAge time.Duration, send func(ctx context.Context, u upload) error) (*spool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("cannot create spool %s: %w", dir, err)
+	}
+
+	return &spool{dir: dir, maxBytes: maxBytes, maxAge: maxAge, send: send, now: time.Now}, nil
+}
+
+// file is where the upload with the ID is kept
+func (s *spool) file(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+// add keeps an upload to retry later, replacing any older one with the same ID.  The spool takes over the file
+// holding the body of the upload, if there is one, moving it into the spool if it isn't there already.
+func (s *spool) add(id string, u upload) error {
+	now := s.now()
+	entry := &spooled{ID: id, upload: u, Created: now, Attempts: 1, Next: now.Add(backoff(1))}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if u.File != "" && filepath.Dir(u.File) != filepath.Clean(s.dir) {
+		file, err := s.moveIn(u.File)
+		if err != nil {
+			return err
+		}
+		entry.File = file
+	}
+
+	older, _ := s.read(s.file(id))
+	if err := s.write(entry); err != nil {
+		return err
+	}
+	if older != nil && older.File != entry.File {
+		older.remove()
+	}
+
+	s.prune()
+	return nil
+}
+
+// moveIn moves a file into the spool under a name of its own, returning the new name
+func (s *spool) moveIn(file string) (string, error) {
+	f, err := os.CreateTemp(s.dir, "*"+bodyExt)
+	if err != nil {
+		return "", err
+	}
+	f.Close()
+
+	if err := os.Rename(file, f.Name()); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// remove forgets any upload with the ID, once a newer one has been sent
+func (s *spool) remove(id string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if e, err := s.read(s.file(id)); err == nil {
+		s.discard(e)
+	}
+}
+
+// discard removes an upload and its body from the spool.  The caller must hold the lock.
+func (s *spool) discard(e *spooled) {
+	if err := os.Remove(s.file(e.ID)); err != nil && !os.IsNotExist(err) {
+		log.Error().Err(err).Msg("Failed to remove spooled upload")
+	}
+	e.remove()
+}
+
+// drain sends the uploads due to be retried, or all of them if force is true.  It returns the number sent and the
+// number still waiting.
+func (s *spool) drain(ctx context.Context, force bool) (sent, waiting int) {
+	s.lock.Lock()
+	entries := s.entries()
+	s.lock.Unlock()
+
+	for i, e := range entries {
+		if ctx.Err() != nil {
+			return sent, waiting + len(entries) - i
+		}
+
+		if !force && s.now().Before(e.Next) {
+			waiting++
+			continue
+		}
+
+		err := s.send(ctx, e.upload)
+
+		s.lock.Lock()
+		// A newer plan may have replaced this one while it was being sent
+		current, _ := s.read(s.file(e.ID))
+		unchanged := current != nil && current.Created.Equal(e.Created)
+
+		switch {
+		case err == nil:
+			sent++
+			if unchanged {
+				s.discard(e)
+			}
+			log.Info().Str("url", e.URL).Int("attempts", e.Attempts+1).Msg("Sent spooled results")
+		case !retryable(err):
+			if unchanged {
+				s.discard(e)
+			}
+			log.Error().Err(err).Str("url", e.URL).Msg("Server rejected spooled results, dropping them")
+		default:
+			waiting++
+			if unchanged {
+				e.Attempts++
+				e.Next = s.now().Add(backoff(e.Attempts))
+				if err := s.write(e); err != nil {
+					log.Error().Err(err).Msg("Failed to update spooled upload")
+				}
+			}
+			log.Warn().Err(err).Str("url", e.URL).Int("attempts", e.Attempts).Time("next", e.Next).Msg("Failed to send spooled results")
+		}
+		s.lock.Unlock()
+	}
+
+	return sent, waiting
+}
+
+// watch retries spooled uploads as they come due until the context is cancelled.  Everything is retried right away at
+// first, since the agent may have been down for a while.
+func (s *spool) watch(ctx context.Context, every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+
+	for force := true; ; force = false {
+		s.drain(ctx, force)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// prune drops uploads which are too old, then the oldest ones until the spool fits in its size.  Bodies no upload
+// refers to were left behind by an agent which stopped while sending them, and are removed once they are too old too.
+// The caller must hold the lock.
+func (s *spool) prune() {
+	entries := s.entries()
+
+	var total int64
+	var kept []*spooled
+	for _, e := range entries {
+		if s.maxAge > 0 && s.now().Sub(e.Created) > s.maxAge {
+			s.drop(e, "too old")
+			continue
+		}
+		kept = append(kept, e)
+		total += e.size()
+	}
+
+	for len(kept) > 0 && s.maxBytes > 0 && total > s.maxBytes {
+		total -= kept[0].size()
+		s.drop(kept[0], "spool is full")
+		kept = kept[1:]
+	}
+
+	if s.maxAge > 0 {
+		s.removeOrphans(entries)
+	}
+}
+
+// removeOrphans removes the bodies older than the longest uploads are kept which none of the entries refer to.  Newer
+// ones may still be being sent.  The caller must hold the lock.
+func (s *spool) removeOrphans(entries []*spooled) {
+	files, err := filepath.Glob(filepath.Join(s.dir, "*"+bodyExt))
+	if err != nil {
+		return
+	}
+
+	used := make(map[string]bool)
+	for _, e := range entries {
+		used[e.File] = true
+	}
+
+	for _, f := range files {
+		if info, err := os.Stat(f); err == nil && !used[f] && s.now().Sub(info.ModTime()) > s.maxAge {
+			log.Warn().Str("file", f).Msg("Removing abandoned upload")
+			os.Remove(f)
+		}
+	}
+}
+
+func (s *spool) drop(e *spooled, reason string) {
+	log.Warn().Str("url", e.URL).Time("created", e.Created).Str("reason", reason).Msg("Dropping spooled results")
+	s.discard(e)
+}
+
+// entries reads every spooled upload, oldest first.  The caller must hold the lock.
+func (s *spool) entries() []*spooled {
+	files, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return nil
+	}
+
+	var result []*spooled
+	for _, f := range files {
+		e, err := s.read(f)
+		if err != nil {
+			log.Error().Err(err).Str("file", f).Msg("Dropping unreadable spooled upload")
+			os.Remove(f)
+			continue
+		}
+		result = append(result, e)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Created.Before(result[j].Created)
+	})
+
+	return result
+}
+
+func (s *spool) read(file string) (*spooled, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &spooled{}
+	if err := json.Unmarshal(b, e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// write replaces the file of the upload all at once, so that a crash can't leave half of it behind
+func (s *spool) write(e *spooled) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(s.dir, ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.file(e.ID))
+}
+
+// backoff is how long to wait after the given number of failed attempts
+func backoff(attempts int) time.Duration {
+	d := minBackoff
+	for i := 1; i < attempts && d < maxBackoff; i++ {
+		d *= 2
+	}
+	if d > maxBackoff {
+		d = maxBackoff
+	}
+	return d
+}
+
+// uploadID identifies what a plan record is a plan of, so that only the newest of each is spooled
+func uploadID(url string, branch, workspace string) string {
+	return strings.Join([]string{url, branch, workspace}, "\n")
+}
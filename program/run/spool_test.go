@@ -0,0 +1,230 @@
+package run
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fakeSender records what is sent and fails with whatever err holds
+type fakeSender struct {
+	err  error
+	sent []string
+}
+
+func (f *fakeSender) send(_ context.Context, u upload) error {
+	if f.err != nil {
+		return f.err
+	}
+	body, _, err := u.open()
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	b, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	f.sent = append(f.sent, u.URL+" "+string(b))
+	return nil
+}
+
+func jsonUpload(url, body string) upload {
+	return upload{URL: url, ContentType: "text/json", Body: []byte(body)}
+}
+
+func testSpool(t *testing.T, sender *fakeSender) (*spool, *time.Time) {
+	s, err := newSpool(t.TempDir(), 0, 0, sender.send)
+	require.NoError(t, err)
+
+	now := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+	return s, &now
+}
+
+func TestSpool_drain(t *testing.T) {
+	sender := &fakeSender{err: errors.New("connection refused")}
+	s, now := testSpool(t, sender)
+	ctx := context.Background()
+
+	require.NoError(t, s.add("a", jsonUpload("http://server/a", "1")))
+
+	sent, waiting := s.drain(ctx, false)
+	assert.Equal(t, 0, sent)
+	assert.Equal(t, 1, waiting, "not due yet")
+
+	*now = now.Add(minBackoff)
+	sent, waiting = s.drain(ctx, false)
+	assert.Equal(t, 0, sent)
+	assert.Equal(t, 1, waiting)
+
+	entries := s.entries()
+	require.Len(t, entries, 1)
+	assert.Equal(t, 2, entries[0].Attempts)
+	assert.Equal(t, now.Add(2*minBackoff), entries[0].Next, "backs off")
+
+	sender.err = nil
+	sent, waiting = s.drain(ctx, true)
+	assert.Equal(t, 1, sent)
+	assert.Equal(t, 0, waiting)
+	assert.Equal(t, []string{"http://server/a 1"}, sender.sent)
+	assert.Empty(t, s.entries())
+}
+
+func TestSpool_add(t *testing.T) {
+	sender := &fakeSender{}
+	s, now := testSpool(t, sender)
+
+	require.NoError(t, s.add("a", jsonUpload("http://server/a", "old")))
+	*now = now.Add(time.Second)
+	require.NoError(t, s.add("a", jsonUpload("http://server/a", "new")))
+	require.NoError(t, s.add("b", jsonUpload("http://server/b", "other")))
+
+	s.drain(context.Background(), true)
+	assert.ElementsMatch(t, []string{"http://server/a new", "http://server/b other"}, sender.sent, "newer plans replace older ones")
+
+	require.NoError(t, s.add("a", jsonUpload("http://server/a", "sent later")))
+	s.remove("a")
+	assert.Empty(t, s.entries())
+}
+
+func TestSpool_encoding(t *testing.T) {
+	var received upload
+	s, _ := testSpool(t, &fakeSender{})
+	s.send = func(_ context.Context, u upload) error {
+		received = u
+		return nil
+	}
+
+	sent := upload{URL: "http://server/a", ContentType: "text/json", ContentEncoding: "zstd", Body: []byte{0x28, 0xb5, 0x2f, 0xfd}}
+	require.NoError(t, s.add("a", sent))
+	s.drain(context.Background(), true)
+	assert.Equal(t, sent, received, "compressed uploads are retried as they were")
+}
+
+func TestSpool_files(t *testing.T) {
+	sender := &fakeSender{}
+	s, now := testSpool(t, sender)
+
+	file := func(body string) upload {
+		f := filepath.Join(t.TempDir(), "upload"+bodyExt)
+		require.NoError(t, os.WriteFile(f, []byte(body), 0600))
+		return upload{URL: "http://server/a", ContentType: "text/json", File: f}
+	}
+
+	// Bodies are moved into the spool
+	u := file("old")
+	require.NoError(t, s.add("a", u))
+	assert.NoFileExists(t, u.File)
+
+	entries := s.entries()
+	require.Len(t, entries, 1)
+	old := entries[0].File
+	assert.Equal(t, s.dir, filepath.Dir(old))
+	assert.Equal(t, int64(3), entries[0].size())
+
+	*now = now.Add(time.Second)
+	require.NoError(t, s.add("a", file("new")))
+	assert.NoFileExists(t, old, "replaced bodies are removed")
+
+	s.drain(context.Background(), true)
+	assert.Equal(t, []string{"http://server/a new"}, sender.sent)
+
+	files, err := os.ReadDir(s.dir)
+	require.NoError(t, err)
+	assert.Empty(t, files, "sent bodies are removed")
+
+	// Bodies nothing refers to are removed once they are too old to have been waiting to be sent
+	s.maxAge = time.Hour
+	abandoned := filepath.Join(s.dir, "abandoned"+bodyExt)
+	sending := filepath.Join(s.dir, "sending"+bodyExt)
+	for _, f := range []string{abandoned, sending} {
+		require.NoError(t, os.WriteFile(f, []byte("1"), 0600))
+	}
+	require.NoError(t, os.Chtimes(abandoned, now.Add(-2*time.Hour), now.Add(-2*time.Hour)))
+	require.NoError(t, os.Chtimes(sending, *now, *now))
+
+	require.NoError(t, s.add("b", jsonUpload("http://server/b", "1")))
+	assert.NoFileExists(t, abandoned)
+	assert.FileExists(t, sending)
+}
+
+func TestSpool_prune(t *testing.T) {
+	s, now := testSpool(t, &fakeSender{})
+	s.maxAge = time.Hour
+	s.maxBytes = 10
+
+	require.NoError(t, s.add("old", jsonUpload("http://server/old", "1")))
+	*now = now.Add(2 * time.Hour)
+	require.NoError(t, s.add("a", jsonUpload("http://server/a", "12345")))
+	*now = now.Add(time.Second)
+	require.NoError(t, s.add("b", jsonUpload("http://server/b", "12345")))
+
+	var ids []string
+	for _, e := range s.entries() {
+		ids = append(ids, e.ID)
+	}
+	assert.Equal(t, []string{"a", "b"}, ids, "too old")
+
+	*now = now.Add(time.Second)
+	require.NoError(t, s.add("c", jsonUpload("http://server/c", "1")))
+
+	ids = nil
+	for _, e := range s.entries() {
+		ids = append(ids, e.ID)
+	}
+	assert.Equal(t, []string{"b", "c"}, ids, "oldest dropped when full")
+}
+
+func TestSpool_rejected(t *testing.T) {
+	sender := &fakeSender{err: &statusError{url: "http://server/a", status: http.StatusBadRequest}}
+	s, _ := testSpool(t, sender)
+
+	require.NoError(t, s.add("a", jsonUpload("http://server/a", "1")))
+	sent, waiting := s.drain(context.Background(), true)
+	assert.Equal(t, 0, sent+waiting)
+	assert.Empty(t, s.entries(), "rejected uploads are dropped")
+}
+
+func TestOptions_send(t *testing.T) {
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	options := &Options{}
+	assert.NoError(t, options.send(context.Background(), jsonUpload(server.URL, "")))
+
+	for code, retry := range map[int]bool{
+		http.StatusServiceUnavailable: true,
+		http.StatusTooManyRequests:    true,
+		http.StatusBadRequest:         false,
+		http.StatusForbidden:          false,
+	} {
+		status = code
+		err := options.send(context.Background(), jsonUpload(server.URL, ""))
+		assert.Error(t, err, code)
+		assert.Equal(t, retry, retryable(err), code)
+	}
+
+	server.Close()
+	err := options.send(context.Background(), jsonUpload(server.URL, ""))
+	assert.Error(t, err)
+	assert.True(t, retryable(err))
+}
+
+func TestBackoff(t *testing.T) {
+	assert.Equal(t, minBackoff, backoff(1))
+	assert.Equal(t, 4*minBackoff, backoff(3))
+	assert.Equal(t, maxBackoff, backoff(100))
+}
@@ -0,0 +1,260 @@
+package run
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"path/filepath"
+	"strings"
+)
+
+// Step is one command run to plan a component.  Commands are run directly rather than by a shell, so there are no
+// pipes, redirections or variable expansion.
+type Step struct {
+	// Name identifies the step when it fails.  It defaults to the command.
+	Name string
+	// Args is the command and its arguments
+	Args []string
+	// Dir is where the command runs.  Relative paths are relative to the component directory.
+	Dir string
+	// Env adds to (or overrides) the environment variables of the component
+	Env map[string]string
+}
+
+// stepConfig is how a step is written as a mapping in the config file.  Exactly one of Run and Args is given.
+type stepConfig struct {
+	Name string `yaml:"name,omitempty"`
+	// Run is a command line, split into words the way a shell would
+	Run  string            `yaml:"run,omitempty"`
+	Args []string          `yaml:"args,omitempty"`
+	Dir  string            `yaml:"dir,omitempty"`
+	Env  map[string]string `yaml:"env,omitempty"`
+}
+
+// String shows the command the way it could be typed to a shell
+func (s Step) String() string {
+	words := make([]string, len(s.Args))
+	for i, a := range s.Args {
+		words[i] = quoteWord(a)
+	}
+	return strings.Join(words, " ")
+}
+
+// describe names the step for failure reports
+func (s Step) describe() string {
+	if s.Name == "" {
+		return s.String()
+	}
+	return fmt.Sprintf("%s (%s)", s.Name, s.String())
+}
+
+// dir is where the step runs for a component in the directory
+func (s Step) dir(component string) string {
+	if s.Dir == "" {
+		return component
+	}
+	if filepath.IsAbs(s.Dir) {
+		return s.Dir
+	}
+	return filepath.Join(component, s.Dir)
+}
+
+// Steps is a command sequence.  In the config file it is a command line (which may hold several commands separated by
+// ";", "&&" or new lines), or a list whose items are command lines, lists of arguments or mappings giving a name, dir
+// and env as well.
+type Steps []Step
+
+func (s Steps) String() string {
+	commands := make([]string, len(s))
+	for i, step := range s {
+		commands[i] = step.String()
+	}
+	return strings.Join(commands, "; ")
+}
+
+func (s *Steps) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		steps, err := ParseSteps(node.Value)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", node.Line, err)
+		}
+		*s = steps
+		return nil
+	}
+
+	if node.Kind != yaml.SequenceNode {
+		return fmt.Errorf("line %d: commands must be a command line or a list", node.Line)
+	}
+
+	var result Steps
+	for _, item := range node.Content {
+		switch item.Kind {
+		case yaml.ScalarNode:
+			steps, err := ParseSteps(item.Value)
+			if err != nil {
+				return fmt.Errorf("line %d: %w", item.Line, err)
+			}
+			result = append(result, steps...)
+		case yaml.SequenceNode:
+			var args []string
+			if err := item.Decode(&args); err != nil {
+				return err
+			}
+			if len(args) == 0 {
+				return fmt.Errorf("line %d: empty command", item.Line)
+			}
+			result = append(result, Step{Args: args})
+		case yaml.MappingNode:
+			step, err := decodeStep(item)
+			if err != nil {
+				return err
+			}
+			result = append(result, step)
+		default:
+			return fmt.Errorf("line %d: bad command", item.Line)
+		}
+	}
+
+	*s = result
+	return nil
+}
+
+// stepFields are the fields of stepConfig.  Decoding a node doesn't catch misspellings as the config file does.
+var stepFields = map[string]bool{"name": true, "run": true, "args": true, "dir": true, "env": true}
+
+func decodeStep(node *yaml.Node) (Step, error) {
+	for i := 0; i < len(node.Content); i += 2 {
+		if key := node.Content[i]; !stepFields[key.Value] {
+			return Step{}, fmt.Errorf("line %d: unknown command field %s", key.Line, key.Value)
+		}
+	}
+
+	var c stepConfig
+	if err := node.Decode(&c); err != nil {
+		return Step{}, err
+	}
+
+	step := Step{Name: c.Name, Args: c.Args, Dir: c.Dir, Env: c.Env}
+
+	switch {
+	case c.Run != "" && len(c.Args) > 0:
+		return Step{}, fmt.Errorf("line %d: a command may have run or args, but not both", node.Line)
+	case c.Run != "":
+		words, err := ParseSteps(c.Run)
+		if err != nil {
+			return Step{}, fmt.Errorf("line %d: %w", node.Line, err)
+		}
+		if len(words) != 1 {
+			return Step{}, fmt.Errorf("line %d: run must be a single command", node.Line)
+		}
+		step.Args = words[0].Args
+	case len(c.Args) == 0:
+		return Step{}, fmt.Errorf("line %d: a command needs run or args", node.Line)
+	}
+
+	return step, nil
+}
+
+// ParseSteps splits command lines into commands and their arguments the way a shell would.  Commands are separated by
+// ";", "&&" or new lines.  Words are separated by spaces, and quotes and backslashes work as they do in a shell, but
+// nothing is expanded.
+func ParseSteps(lines ...string) (Steps, error) {
+	var steps Steps
+	for _, line := range lines {
+		s, err := parseLine(line)
+		if err != nil {
+			return nil, err
+		}
+		steps = append(steps, s...)
+	}
+	return steps, nil
+}
+
+func parseLine(line string) (Steps, error) {
+	var steps Steps
+	var args []string
+	var word strings.Builder
+	inWord := false
+
+	endWord := func() {
+		if inWord {
+			args = append(args, word.String())
+			word.Reset()
+			inWord = false
+		}
+	}
+	endCommand := func() {
+		endWord()
+		if len(args) > 0 {
+			steps = append(steps, Step{Args: args})
+			args = nil
+		}
+	}
+
+	runes := []rune(line)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+
+		switch {
+		case r == ' ' || r == '\t' || r == '\r':
+			endWord()
+		case r == '\n' || r == ';':
+			endCommand()
+		case r == '&' && i+1 < len(runes) && runes[i+1] == '&':
+			endCommand()
+			i++
+		case strings.ContainsRune("|&<>`", r):
+			return nil, fmt.Errorf("%q: %c is not supported since commands aren't run by a shell (use sh -c to run one)", line, r)
+		case r == '\\':
+			if i+1 >= len(runes) {
+				return nil, fmt.Errorf("%q: nothing after \\", line)
+			}
+			i++
+			// A backslash before a new line continues the line
+			if runes[i] != '\n' {
+				word.WriteRune(runes[i])
+				inWord = true
+			}
+		case r == '\'':
+			for i++; i < len(runes) && runes[i] != '\''; i++ {
+				word.WriteRune(runes[i])
+			}
+			if i >= len(runes) {
+				return nil, fmt.Errorf("%q: unterminated '", line)
+			}
+			inWord = true
+		case r == '"':
+			i++
+			for ; i < len(runes) && runes[i] != '"'; i++ {
+				// In double quotes backslashes only escape what would otherwise be special
+				if runes[i] == '\\' && i+1 < len(runes) && strings.ContainsRune("\"\\$`\n", runes[i+1]) {
+					i++
+					if runes[i] == '\n' {
+						continue
+					}
+				}
+				word.WriteRune(runes[i])
+			}
+			if i >= len(runes) {
+				return nil, fmt.Errorf("%q: unterminated \"", line)
+			}
+			inWord = true
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	endCommand()
+
+	return steps, nil
+}
+
+// quoteWord quotes a word if a shell would need it to be
+func quoteWord(s string) string {
+	if s == "" {
+		return "''"
+	}
+	if !strings.ContainsAny(s, " \t\n\r'\"\\;&|<>`$*?[]#~(){}") {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,147 @@
+package run
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSteps(t *testing.T) {
+	tests := []struct {
+		line string
+		want [][]string
+	}{
+		{"terraform plan", [][]string{{"terraform", "plan"}}},
+		{"  terraform   plan  ", [][]string{{"terraform", "plan"}}},
+		{"terraform plan; terraform show -json plan", [][]string{{"terraform", "plan"}, {"terraform", "show", "-json", "plan"}}},
+		{"terraform init && terraform plan", [][]string{{"terraform", "init"}, {"terraform", "plan"}}},
+		{"terraform init\nterraform plan\n", [][]string{{"terraform", "init"}, {"terraform", "plan"}}},
+		{`terraform plan -var-file="a b.tfvars"`, [][]string{{"terraform", "plan", "-var-file=a b.tfvars"}}},
+		{`terraform plan -var 'tags={"a":"b; c"}'`, [][]string{{"terraform", "plan", "-var", `tags={"a":"b; c"}`}}},
+		{`echo "say \"hi\" \n" 'it'\''s' a\ b ''`, [][]string{{"echo", `say "hi" \n`, "it's", "a b", ""}}},
+		{"terraform plan \\\n  -out plan", [][]string{{"terraform", "plan", "-out", "plan"}}},
+		{"echo $HOME ~", [][]string{{"echo", "$HOME", "~"}}},
+		{" ; ", nil},
+	}
+
+	for _, test := range tests {
+		steps, err := ParseSteps(test.line)
+		require.NoError(t, err, test.line)
+
+		var got [][]string
+		for _, s := range steps {
+			got = append(got, s.Args)
+		}
+		assert.Equal(t, test.want, got, test.line)
+	}
+
+	for _, line := range []string{`echo "unterminated`, "echo 'unterminated", `echo \`, "terraform show -json | jq", "terraform plan > out", "sleep 1 &", "echo `date`"} {
+		_, err := ParseSteps(line)
+		assert.Error(t, err, line)
+	}
+
+	steps, err := ParseSteps("terraform init", "terraform plan; terraform show -json")
+	require.NoError(t, err)
+	assert.Equal(t, 3, len(steps))
+}
+
+func TestSteps_String(t *testing.T) {
+	steps := Steps{{Args: []string{"terraform", "plan", "-var-file=a b.tfvars", "-var", "x=it's"}}, {Args: []string{"echo", ""}}}
+	assert.Equal(t, `terraform plan '-var-file=a b.tfvars' -var 'x=it'\''s'; echo ''`, steps.String())
+
+	// What's shown can be parsed back
+	parsed, err := ParseSteps(steps.String())
+	require.NoError(t, err)
+	assert.Equal(t, steps, parsed)
+}
+
+func TestSteps_UnmarshalYAML(t *testing.T) {
+	var config struct {
+		Line  Steps `yaml:"line"`
+		List  Steps `yaml:"list"`
+		Mixed Steps `yaml:"mixed"`
+	}
+
+	require.NoError(t, yaml.Unmarshal([]byte(`
+line: terraform init; terraform plan -out plan
+list:
+  - terraform init
+  - [terraform, plan, "-var-file=a b.tfvars"]
+mixed:
+  - name: init
+    run: terraform init -backend-config="key=a b"
+    dir: ..
+    env:
+      TF_LOG: debug
+  - name: show
+    args: [terraform, show, -json, plan]
+`), &config))
+
+	assert.Equal(t, "terraform init; terraform plan -out plan", config.Line.String())
+	assert.Equal(t, Steps{{Args: []string{"terraform", "init"}}, {Args: []string{"terraform", "plan", "-var-file=a b.tfvars"}}}, config.List)
+	assert.Equal(t, Steps{
+		{Name: "init", Args: []string{"terraform", "init", "-backend-config=key=a b"}, Dir: "..", Env: map[string]string{"TF_LOG": "debug"}},
+		{Name: "show", Args: []string{"terraform", "show", "-json", "plan"}},
+	}, config.Mixed)
+
+	for name, doc := range map[string]string{
+		"run and args":  "line: [{run: terraform plan, args: [terraform, plan]}]",
+		"neither":       "line: [{name: plan}]",
+		"several runs":  "line: [{run: terraform init; terraform plan}]",
+		"empty argv":    "line: [[]]",
+		"bad quoting":   `line: 'echo "unterminated'`,
+		"mapping":       "line: {run: terraform plan}",
+		"unknown field": "line: [{run: terraform plan, cwd: ..}]",
+	} {
+		var s struct {
+			Line Steps `yaml:"line"`
+		}
+		decoder := yaml.NewDecoder(strings.NewReader(doc))
+		decoder.KnownFields(true)
+		assert.Error(t, decoder.Decode(&s), name)
+	}
+}
+
+func TestOptions_getPlan_steps(t *testing.T) {
+	dir := t.TempDir()
+	component := filepath.Join(dir, "component")
+	require.NoError(t, os.MkdirAll(filepath.Join(component, "sub"), os.ModePerm))
+
+	o := &Options{RunTimeout: time.Minute}
+
+	// Each step runs in its own directory with its own environment, and quoted arguments arrive intact
+	plan, err := o.getPlan(Component{
+		Dir: component,
+		Env: map[string]string{"GREETING": "hello", "TARGET": "component"},
+		Commands: Steps{
+			{Name: "write", Args: []string{"sh", "-c", `printf '%s' "$GREETING $TARGET" > "$1"`, "sh", "out file"}, Dir: "sub", Env: map[string]string{"TARGET": "step"}},
+			{Args: []string{"sh", "-c", `test "$(cat 'sub/out file')" = "hello step" && echo '{"format_version":"1.1"}'`}},
+		},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "1.1", plan.FormatVersion)
+
+	// Failures say which step broke
+	_, err = o.getPlan(Component{
+		Dir: component,
+		Commands: Steps{
+			{Name: "init", Args: []string{"true"}},
+			{Name: "validate", Args: []string{"sh", "-c", "echo broken >&2; exit 3"}},
+			{Name: "show", Args: []string{"echo", "{}"}},
+		},
+	})
+	var failure *commandError
+	require.True(t, errors.As(err, &failure))
+	assert.Equal(t, `validate (sh -c 'echo broken >&2; exit 3')`, failure.command)
+	assert.Contains(t, failure.output, "broken")
+
+	_, err = o.getPlan(Component{Dir: component, Commands: Steps{{Name: "show", Args: []string{"echo", "not json"}}}})
+	require.True(t, errors.As(err, &failure))
+	assert.Equal(t, "show (echo 'not json')", failure.command)
+}
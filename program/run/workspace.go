@@ -0,0 +1,127 @@
+package run
+
+import (
+	"context"
+	"fmt"
+	"github.com/deweysasser/olympus/terraform"
+	"github.com/rs/zerolog/log"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+// validateWorkspaces makes sure workspace names and patterns can be used
+func validateWorkspaces(patterns []string) error {
+	for _, p := range patterns {
+		if p == "" {
+			return fmt.Errorf("empty workspace")
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("bad workspace pattern %s", p)
+		}
+	}
+	return nil
+}
+
+// isPattern reports whether a workspace is a pattern rather than a name
+func isPattern(workspace string) bool {
+	return strings.ContainsAny(workspace, "*?[")
+}
+
+// workspaces decides which workspaces of the component to plan.  Names are planned as they are, and patterns select
+// from those the workspace command lists, so new workspaces are picked up without changing the configuration.
+func (options *Options) workspaces(c Component) ([]terraform.Workspace, error) {
+	if len(c.Workspaces) == 0 {
+		return []terraform.Workspace{c.Workspace}, nil
+	}
+
+	var listed []terraform.Workspace
+	for _, p := range c.Workspaces {
+		if isPattern(p) {
+			var err error
+			if listed, err = options.listWorkspaces(c); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+
+	var result []terraform.Workspace
+	add := func(w terraform.Workspace) {
+		for _, r := range result {
+			if r == w {
+				return
+			}
+		}
+		result = append(result, w)
+	}
+
+	for _, p := range c.Workspaces {
+		if !isPattern(p) {
+			add(terraform.Workspace(p))
+			continue
+		}
+
+		matched := false
+		for _, w := range listed {
+			if ok, _ := path.Match(p, string(w)); ok {
+				add(w)
+				matched = true
+			}
+		}
+		if !matched {
+			log.Warn().Str("dir", c.Dir).Str("pattern", p).Msg("No workspaces match")
+		}
+	}
+
+	return result, nil
+}
+
+// listWorkspaces runs the workspace command in the component's directory
+func (options *Options) listWorkspaces(c Component) ([]terraform.Workspace, error) {
+	steps, err := ParseSteps(options.WorkspaceCommand)
+	if err != nil {
+		return nil, fmt.Errorf("bad --workspace-command: %w", err)
+	}
+	if len(steps) != 1 {
+		return nil, fmt.Errorf("--workspace-command must be a single command")
+	}
+	step := steps[0]
+
+	ctx, cancel := context.WithTimeout(context.Background(), options.RunTimeout)
+	defer cancel()
+
+	command := exec.CommandContext(ctx, step.Args[0], step.Args[1:]...)
+	command.Dir = c.Dir
+	// The selected workspace may not exist yet, and it doesn't matter which is selected to list them all
+	command.Env = componentEnv(c, "")
+
+	log.Debug().Str("dir", c.Dir).Str("command", step.String()).Msg("Listing workspaces")
+
+	output, err := command.Output()
+	if err != nil {
+		return nil, &commandError{command: step.String(), output: stderr(err), err: err}
+	}
+
+	return parseWorkspaces(string(output)), nil
+}
+
+// parseWorkspaces reads the output of terraform workspace list, which marks the selected workspace with a "*"
+func parseWorkspaces(output string) []terraform.Workspace {
+	var result []terraform.Workspace
+	for _, line := range strings.Split(output, "\n") {
+		name := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), "*"))
+		if name != "" {
+			result = append(result, terraform.Workspace(name))
+		}
+	}
+	return result
+}
+
+// stderr returns what a failed command wrote to stderr, if it was captured
+func stderr(err error) string {
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return string(exitErr.Stderr)
+	}
+	return ""
+}
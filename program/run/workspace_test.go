@@ -0,0 +1,77 @@
+package run
+
+import (
+	"encoding/json"
+	"github.com/deweysasser/olympus/run"
+	"github.com/deweysasser/olympus/terraform"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseWorkspaces(t *testing.T) {
+	assert.Equal(t, []terraform.Workspace{"default", "staging", "prod"}, parseWorkspaces("  default\n* staging\n  prod\n\n"))
+	assert.Nil(t, parseWorkspaces(""))
+}
+
+func TestOptions_workspaces(t *testing.T) {
+	o := &Options{RunTimeout: time.Minute, WorkspaceCommand: `printf '  default\n* prod\n  prod-eu\n  staging\n'`}
+	dir := t.TempDir()
+
+	workspaces, err := o.workspaces(Component{Dir: dir, Workspace: "blue"})
+	require.NoError(t, err)
+	assert.Equal(t, []terraform.Workspace{"blue"}, workspaces)
+
+	workspaces, err = o.workspaces(Component{Dir: dir, Workspaces: []string{"staging", "prod*", "default", "missing-*"}})
+	require.NoError(t, err)
+	assert.Equal(t, []terraform.Workspace{"staging", "prod", "prod-eu", "default"}, workspaces)
+
+	// Names alone don't need listing
+	o.WorkspaceCommand = "false"
+	workspaces, err = o.workspaces(Component{Dir: dir, Workspaces: []string{"a", "b"}})
+	require.NoError(t, err)
+	assert.Equal(t, []terraform.Workspace{"a", "b"}, workspaces)
+
+	_, err = o.workspaces(Component{Dir: dir, Workspaces: []string{"*"}})
+	assert.Error(t, err)
+}
+
+func TestOptions_process_workspaces(t *testing.T) {
+	var lock sync.Mutex
+	var received []*run.PlanRecord
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		record := &run.PlanRecord{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(record))
+		assert.Equal(t, "/plan/infra/app", r.URL.Path)
+
+		lock.Lock()
+		defer lock.Unlock()
+		received = append(received, record)
+	}))
+	defer server.Close()
+
+	o := &Options{
+		Collector:        server.URL + "/plan",
+		RunTimeout:       time.Minute,
+		WorkspaceCommand: `printf '* default\n  prod\n  staging\n'`,
+	}
+
+	// The plan shows which workspace terraform was told to use
+	succeeded := o.process(Component{
+		Dir:        t.TempDir(),
+		Key:        "infra/app",
+		Workspaces: []string{"staging", "p*"},
+		Commands:   Steps{{Args: []string{"sh", "-c", `echo "{\"format_version\":\"1.1\",\"terraform_version\":\"$TF_WORKSPACE\"}"`}}},
+	})
+	assert.True(t, succeeded)
+
+	require.Equal(t, 2, len(received))
+	for i, w := range []terraform.Workspace{"staging", "prod"} {
+		assert.Equal(t, w, received[i].Workspace)
+		assert.Equal(t, string(w), received[i].Plan.TerraformVersion)
+	}
+}
@@ -0,0 +1,234 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/deweysasser/olympus/compression"
+	"github.com/deweysasser/olympus/git"
+	"github.com/deweysasser/olympus/middleware"
+	"github.com/deweysasser/olympus/run"
+	"github.com/deweysasser/olympus/storage"
+	"github.com/deweysasser/olympus/terraform"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+)
+
+const defaultWorkspace = terraform.Workspace("default")
+
+// addAPI adds the versioned data API to the router
+func (o *Options) addAPI(r *gin.Engine) {
+	api := r.Group("/api/v1")
+
+	api.POST("/plans/*key", o.limitBody, o.authenticate, o.decompress, o.receivePlan)
+	api.GET("/branches", o.listBranches)
+	api.GET("/workspaces", o.listWorkspaces)
+	api.GET("/summary/*key", o.summary)
+
+	api.POST("/queue", o.limitBody, o.authenticate, o.enqueue)
+	api.GET("/queue", o.listQueue)
+	api.POST("/lease", o.limitBody, o.authenticate, o.lease)
+}
+
+// agentKey is where authenticate records the agent which sent a request
+const agentKey = "agent"
+
+// authenticate rejects requests which are not signed by a known agent, if agents are configured
+func (o *Options) authenticate(c *gin.Context) {
+	if o.verifier == nil {
+		return
+	}
+
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.AbortWithStatusJSON(middleware.ReadStatus(err), gin.H{"error": "failed to read request"})
+		return
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+	agent, err := o.verifier.Verify(c.Request, body)
+	if err != nil {
+		log.Warn().Err(err).Str("agent", agent).Str("path", c.Request.URL.Path).Msg("Rejected request")
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Set(agentKey, agent)
+}
+
+// limitBody stops clients sending more than the server is willing to read
+func (o *Options) limitBody(c *gin.Context) {
+	c.Request.Body = middleware.LimitBody(c.Writer, c.Request.Body, o.MaxBody)
+}
+
+// decompress replaces a compressed request body with its content.  The limit applies again to the content, so that a
+// small body can't expand into more than the server is willing to read.
+func (o *Options) decompress(c *gin.Context) {
+	encoding, err := compression.Parse(c.GetHeader("Content-Encoding"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusUnsupportedMediaType, gin.H{"error": err.Error()})
+		return
+	}
+	if encoding == compression.None {
+		return
+	}
+
+	body, err := encoding.NewReader(c.Request.Body)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid " + string(encoding) + " body"})
+		return
+	}
+
+	c.Request.Body = middleware.LimitBody(c.Writer, body, o.MaxBody)
+	c.Request.Header.Del("Content-Encoding")
+}
+
+// authorize checks that the agent which sent the request may write the key, branch and workspace
+func (o *Options) authorize(c *gin.Context, key string, branch git.Branch, workspace terraform.Workspace) error {
+	if o.verifier == nil {
+		return nil
+	}
+	return o.verifier.Authorize(c.GetString(agentKey), key, string(branch), string(workspace))
+}
+
+// receivePlan validates and stores a plan record uploaded by an agent
+func (o *Options) receivePlan(c *gin.Context) {
+	key, err := keyParam(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	log := log.With().Str("key", key.String()).Str("agent", c.GetString(agentKey)).Logger()
+
+	record := &run.PlanRecord{}
+	if err := c.ShouldBindJSON(record); err != nil {
+		log.Debug().Err(err).Msg("Failed to parse plan record")
+		c.JSON(middleware.ReadStatus(err), gin.H{"error": "invalid plan record: " + err.Error()})
+		return
+	}
+
+	if err := validate(key, record); err != nil {
+		log.Debug().Err(err).Msg("Rejected plan record")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := o.authorize(c, key.String(), record.Branch, record.Workspace); err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Agents should never send sensitive values, but the server must not keep them if one does
+	terraform.Redact(record.Plan)
+
+	if err := o.storage.Store(key, record); err != nil {
+		log.Error().Err(err).Msg("Failed to store plan record")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to store plan record"})
+		return
+	}
+
+	log.Debug().Str("branch", string(record.Branch)).Str("workspace", string(record.Workspace)).Msg("Stored plan record")
+
+	for _, lease := range o.queue.Complete(key.String(), record.Branch, record.Workspace) {
+		log.Debug().Str("lease", lease.ID).Str("agent", lease.Agent).Msg("Completed lease")
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"key":       key.String(),
+		"branch":    record.Branch,
+		"workspace": record.Workspace,
+		"end-time":  record.End,
+	})
+}
+
+// validate checks that a record has what we need to store and find it again under key, filling in defaults
+func validate(key storage.Key, r *run.PlanRecord) error {
+	if r.End.IsZero() {
+		return errors.New("end-time is required")
+	}
+	if r.Branch == "" {
+		return errors.New("branch is required")
+	}
+	if r.Workspace == "" {
+		r.Workspace = defaultWorkspace
+	}
+	if r.Succeeded && r.Plan == nil {
+		return errors.New("successful runs must include a plan")
+	}
+	return storage.ValidateRecord(key, r)
+}
+
+func (o *Options) listBranches(c *gin.Context) {
+	var result []string
+	for _, b := range o.storage.Branches().ToSlice() {
+		result = append(result, string(b))
+	}
+	sort.Strings(result)
+	c.JSON(http.StatusOK, result)
+}
+
+func (o *Options) listWorkspaces(c *gin.Context) {
+	var result []string
+	for _, w := range o.storage.Workspaces().ToSlice() {
+		result = append(result, string(w))
+	}
+	sort.Strings(result)
+	c.JSON(http.StatusOK, result)
+}
+
+// summary returns the summary tree below a key, optionally as of some time in the past
+func (o *Options) summary(c *gin.Context) {
+	// The whole estate is summarized from the root, but any other key must be valid
+	var key storage.Key
+	var err error
+	if p := c.Param("key"); p != "" && p != "/" {
+		if key, err = keyParam(c); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	branch := git.Branch(c.Query("branch"))
+	if branch == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "branch is required"})
+		return
+	}
+	workspace := terraform.Workspace(c.DefaultQuery("workspace", string(defaultWorkspace)))
+
+	var set run.Set
+	if asOf := c.Query("as-of"); asOf != "" {
+		t, err := time.Parse(time.RFC3339, asOf)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid as-of time %s, must be RFC3339", asOf)})
+			return
+		}
+		set, err = o.storage.AsOf(key, branch, workspace, t)
+	} else {
+		set, err = o.storage.Summary(key, branch, workspace)
+	}
+
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "no data for " + key.String()})
+	case err != nil:
+		log.Error().Err(err).Str("key", key.String()).Msg("Failed to summarize")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to summarize " + key.String()})
+	default:
+		c.JSON(http.StatusOK, set)
+	}
+}
+
+// keyParam parses the wildcard key from the request path
+func keyParam(c *gin.Context) (storage.Key, error) {
+	return parseKey(c.Param("key"))
+}
+
+// parseKey parses a key given by a client
+func parseKey(s string) (storage.Key, error) {
+	return storage.ValidKey(s)
+}
@@ -0,0 +1,290 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/deweysasser/olympus/auth"
+	"github.com/deweysasser/olympus/compression"
+	"github.com/deweysasser/olympus/queue"
+	"github.com/deweysasser/olympus/run"
+	"github.com/deweysasser/olympus/storage"
+	tfjson "github.com/hashicorp/terraform-json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func post(t *testing.T, url string, r *run.PlanRecord) *http.Response {
+	b, err := json.Marshal(r)
+	require.NoError(t, err)
+	resp, err := http.Post(url, "application/json", bytes.NewReader(b))
+	require.NoError(t, err)
+	return resp
+}
+
+func get(t *testing.T, url string, v any) int {
+	resp, err := http.Get(url)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	if resp.StatusCode == http.StatusOK {
+		require.NoError(t, json.Unmarshal(b, v))
+	}
+	return resp.StatusCode
+}
+
+func TestOptions_API(t *testing.T) {
+	o := &Options{storage: storage.New(t.TempDir())}
+
+	server := httptest.NewServer(o.createServer())
+	defer server.Close()
+
+	end := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	plan := &tfjson.Plan{FormatVersion: "1.1", ResourceChanges: []*tfjson.ResourceChange{
+		{Type: "null_resource", Name: "a", Change: &tfjson.Change{Actions: tfjson.Actions{tfjson.ActionCreate}}},
+	}}
+
+	resp := post(t, server.URL+"/api/v1/plans/prod/network", &run.PlanRecord{End: end, Branch: "main", Plan: plan, Succeeded: true})
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	resp = post(t, server.URL+"/api/v1/plans/prod/app", &run.PlanRecord{End: end, Branch: "main", Workspace: "blue", Succeeded: false, Command: "terraform plan"})
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	t.Run("rejects invalid records", func(t *testing.T) {
+		for name, r := range map[string]*run.PlanRecord{
+			"no time":             {Branch: "main"},
+			"no branch":           {End: end},
+			"success but no plan": {End: end, Branch: "main", Succeeded: true},
+		} {
+			resp := post(t, server.URL+"/api/v1/plans/prod/network", r)
+			assert.Equal(t, http.StatusBadRequest, resp.StatusCode, name)
+		}
+
+		resp := post(t, server.URL+"/api/v1/plans/", &run.PlanRecord{End: end, Branch: "main"})
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+		resp = post(t, server.URL+"/api/v1/plans/prod//network", &run.PlanRecord{End: end, Branch: "main"})
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+		resp, err := http.Post(server.URL+"/api/v1/plans/prod/network", "application/json", bytes.NewReader([]byte("not json")))
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+
+	var names []string
+	assert.Equal(t, http.StatusOK, get(t, server.URL+"/api/v1/branches", &names))
+	assert.Equal(t, []string{"main"}, names)
+
+	assert.Equal(t, http.StatusOK, get(t, server.URL+"/api/v1/workspaces", &names))
+	assert.Equal(t, []string{"blue", "default"}, names)
+
+	var set run.Set
+	assert.Equal(t, http.StatusOK, get(t, server.URL+"/api/v1/summary/prod?branch=main", &set))
+	assert.Equal(t, "prod", set.Name)
+	require.Equal(t, 1, len(set.Records))
+	assert.Equal(t, "network", set.Records[0].Name)
+	assert.Equal(t, 1, set.Changes.Added)
+
+	set = run.Set{}
+	assert.Equal(t, http.StatusOK, get(t, server.URL+"/api/v1/summary/prod?branch=main&workspace=blue", &set))
+	require.Equal(t, 1, len(set.Records))
+	assert.Equal(t, "app", set.Records[0].Name)
+
+	set = run.Set{}
+	assert.Equal(t, http.StatusOK, get(t, server.URL+"/api/v1/summary/prod?branch=main&as-of=1999-12-31T00:00:00Z", &set))
+	assert.Equal(t, 0, len(set.Records))
+
+	assert.Equal(t, http.StatusBadRequest, get(t, server.URL+"/api/v1/summary/prod", &set))
+	assert.Equal(t, http.StatusBadRequest, get(t, server.URL+"/api/v1/summary/prod?branch=main&as-of=yesterday", &set))
+	assert.Equal(t, http.StatusNotFound, get(t, server.URL+"/api/v1/summary/missing?branch=main", &set))
+	assert.Equal(t, http.StatusBadRequest, get(t, server.URL+"/api/v1/summary/prod/a%20b?branch=main", &set))
+	assert.Equal(t, http.StatusBadRequest, get(t, server.URL+"/api/v1/summary/prod/.hidden?branch=main", &set))
+	assert.Equal(t, http.StatusOK, get(t, server.URL+"/api/v1/summary/?branch=main", &set))
+}
+
+func TestOptions_summary_sqlite(t *testing.T) {
+	s, err := storage.Open("sqlite", t.TempDir())
+	require.NoError(t, err)
+	defer s.Close()
+
+	o := &Options{storage: s}
+	server := httptest.NewServer(o.createServer())
+	defer server.Close()
+
+	resp := post(t, server.URL+"/api/v1/plans/prod/network", &run.PlanRecord{End: time.Now(), Branch: "main", Command: "terraform plan"})
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	var set run.Set
+	assert.Equal(t, http.StatusOK, get(t, server.URL+"/api/v1/summary/prod?branch=main", &set))
+	assert.Equal(t, http.StatusNotFound, get(t, server.URL+"/api/v1/summary/missing?branch=main", &set))
+	assert.Equal(t, http.StatusNotFound, get(t, server.URL+"/api/v1/summary/pro?branch=main", &set))
+}
+
+func TestOptions_keys(t *testing.T) {
+	dir := t.TempDir()
+	data := filepath.Join(dir, "data")
+	o := &Options{storage: storage.New(data)}
+
+	server := httptest.NewServer(o.createServer())
+	defer server.Close()
+
+	b, err := json.Marshal(&run.PlanRecord{End: time.Now(), Branch: "main", Output: "failed"})
+	require.NoError(t, err)
+
+	for _, path := range []string{
+		"/api/v1/plans/%2e%2e/escaped",
+		"/api/v1/plans/prod/%2e%2e/%2e%2e/escaped",
+		"/api/v1/plans/..%2fescaped",
+		"/api/v1/plans/prod%5c..%5c..%5cescaped",
+		"/api/v1/plans/prod/net%00work",
+		"/api/v1/plans/prod/.git",
+		"/api/v1/plans/prod/CON",
+		"/api/v1/plans/prod/a__b",
+	} {
+		request, err := http.NewRequest(http.MethodPost, server.URL+path, bytes.NewReader(b))
+		require.NoError(t, err)
+
+		resp, err := http.DefaultClient.Do(request)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, path)
+	}
+
+	for name, r := range map[string]*run.PlanRecord{
+		"branch":              {End: time.Now(), Branch: "x/../../../escaped"},
+		"relative branch":     {End: time.Now(), Branch: "../escaped"},
+		"empty branch part":   {End: time.Now(), Branch: "feature//x"},
+		"workspace":           {End: time.Now(), Branch: "main", Workspace: "../../escaped"},
+		"workspace separator": {End: time.Now(), Branch: "main", Workspace: "a/b"},
+		"hidden workspace":    {End: time.Now(), Branch: "main", Workspace: ".git"},
+	} {
+		resp := post(t, server.URL+"/api/v1/plans/prod/app", r)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, name)
+	}
+
+	for _, body := range []string{
+		`{"key": "../escaped", "repo": "infra", "branch": "main", "workspace": "default"}`,
+		`{"key": "prod/app", "repo": "infra", "branch": "../../escaped", "workspace": "default"}`,
+		`{"key": "prod/app", "repo": "infra", "branch": "main", "workspace": "../escaped"}`,
+	} {
+		resp, err := http.Post(server.URL+"/api/v1/queue", "application/json", strings.NewReader(body))
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, body)
+	}
+
+	// Branches may have several parts
+	resp := post(t, server.URL+"/api/v1/plans/prod/app", &run.PlanRecord{End: time.Now(), Branch: "feature/foo", Output: "failed"})
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	var branches []string
+	assert.Equal(t, http.StatusOK, get(t, server.URL+"/api/v1/branches", &branches))
+	assert.Equal(t, []string{"feature/foo"}, branches)
+
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	for _, f := range files {
+		assert.Equal(t, "data", f.Name())
+	}
+}
+
+func TestOptions_authenticate(t *testing.T) {
+	verifier, err := auth.NewVerifier([]auth.Agent{{Name: "prod", SecretSHA256: auth.HashSecret("s3cret"), Keys: []string{"production"}, Branches: []string{"main"}}})
+	require.NoError(t, err)
+	o := &Options{storage: storage.New(t.TempDir()), verifier: verifier}
+
+	server := httptest.NewServer(o.createServer())
+	defer server.Close()
+
+	send := func(path, secret string, v any) int {
+		b, err := json.Marshal(v)
+		require.NoError(t, err)
+		request, err := http.NewRequest(http.MethodPost, server.URL+path, bytes.NewReader(b))
+		require.NoError(t, err)
+		if secret != "" {
+			auth.Sign(request, "prod", secret, b)
+		}
+		r, err := http.DefaultClient.Do(request)
+		require.NoError(t, err)
+		return r.StatusCode
+	}
+
+	record := &run.PlanRecord{End: time.Now(), Branch: "main", Output: "failed"}
+	assert.Equal(t, http.StatusUnauthorized, send("/api/v1/plans/production/network", "", record))
+	assert.Equal(t, http.StatusUnauthorized, send("/api/v1/plans/production/network", "guess", record))
+	assert.Equal(t, http.StatusCreated, send("/api/v1/plans/production/network", "s3cret", record))
+	assert.Equal(t, http.StatusForbidden, send("/api/v1/plans/staging/network", "s3cret", record))
+	assert.Equal(t, http.StatusForbidden, send("/api/v1/plans/production/network", "s3cret", &run.PlanRecord{End: time.Now(), Branch: "feature"}))
+
+	assert.Equal(t, http.StatusUnauthorized, send("/api/v1/lease", "", map[string]any{"agent": "prod", "repos": []string{"infra"}}))
+	assert.Equal(t, http.StatusForbidden, send("/api/v1/lease", "s3cret", map[string]any{"agent": "dev", "repos": []string{"infra"}}))
+	assert.Equal(t, http.StatusNoContent, send("/api/v1/lease", "s3cret", map[string]any{"agent": "prod", "repos": []string{"infra"}}))
+
+	o.queue.Add(queue.Request{Key: "staging/network", Repo: "infra", Branch: "main", Workspace: "default"})
+	assert.Equal(t, http.StatusNoContent, send("/api/v1/lease", "s3cret", map[string]any{"agent": "prod", "repos": []string{"infra"}}),
+		"agents are not given requests they may not upload")
+	o.queue.Add(queue.Request{Key: "production/network", Repo: "infra", Branch: "main", Workspace: "default"})
+	assert.Equal(t, http.StatusOK, send("/api/v1/lease", "s3cret", map[string]any{"agent": "prod", "repos": []string{"infra"}}))
+
+	request := map[string]any{"key": "production/app", "repo": "infra", "branch": "main"}
+	assert.Equal(t, http.StatusUnauthorized, send("/api/v1/queue", "", request))
+	assert.Equal(t, http.StatusUnauthorized, send("/api/v1/queue", "guess", request))
+	assert.Equal(t, http.StatusForbidden, send("/api/v1/queue", "s3cret", map[string]any{"key": "staging/app", "repo": "infra", "branch": "main"}))
+	assert.Equal(t, http.StatusForbidden, send("/api/v1/queue", "s3cret", map[string]any{"key": "production/app", "repo": "infra", "branch": "feature"}))
+	assert.Equal(t, http.StatusCreated, send("/api/v1/queue", "s3cret", request))
+}
+
+func TestOptions_compressed(t *testing.T) {
+	verifier, err := auth.NewVerifier([]auth.Agent{{Name: "prod", SecretSHA256: auth.HashSecret("s3cret")}})
+	require.NoError(t, err)
+	o := &Options{storage: storage.New(t.TempDir()), verifier: verifier, MaxBody: 1}
+	o.storage.Compress(compression.Zstd)
+
+	server := httptest.NewServer(o.createServer())
+	defer server.Close()
+
+	send := func(encoding compression.Encoding, header string, v any) int {
+		b, err := json.Marshal(v)
+		require.NoError(t, err)
+		b, err = encoding.Compress(b)
+		require.NoError(t, err)
+
+		request, err := http.NewRequest(http.MethodPost, server.URL+"/api/v1/plans/prod/network", bytes.NewReader(b))
+		require.NoError(t, err)
+		request.Header.Set("Content-Encoding", header)
+		auth.Sign(request, "prod", "s3cret", b)
+
+		r, err := http.DefaultClient.Do(request)
+		require.NoError(t, err)
+		r.Body.Close()
+		return r.StatusCode
+	}
+
+	end := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	record := &run.PlanRecord{End: end, Branch: "main", Command: "terraform plan"}
+
+	assert.Equal(t, http.StatusCreated, send(compression.Zstd, "zstd", record))
+	assert.Equal(t, http.StatusCreated, send(compression.Gzip, "gzip", record))
+	assert.Equal(t, http.StatusCreated, send(compression.None, "", record))
+	assert.Equal(t, http.StatusUnsupportedMediaType, send(compression.None, "br", record))
+	assert.Equal(t, http.StatusBadRequest, send(compression.None, "gzip", record), "not actually compressed")
+
+	// Compresses to almost nothing, but is too large once decompressed
+	huge := &run.PlanRecord{End: end, Branch: "main", Output: strings.Repeat("x", 2*1024*1024)}
+	assert.Equal(t, http.StatusRequestEntityTooLarge, send(compression.Zstd, "zstd", huge))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, send(compression.None, "", huge))
+
+	entries, err := o.storage.History(storage.ParseKey("prod/network"), "main", "default")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	r, err := o.storage.Get(entries[0])
+	require.NoError(t, err)
+	assert.Equal(t, "terraform plan", r.Command)
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"github.com/deweysasser/olympus/queue"
+	"github.com/deweysasser/olympus/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+	"net/http"
+)
+
+// leaseRequest is what an agent sends when it is ready for work
+type leaseRequest struct {
+	Agent string   `json:"agent" binding:"required"`
+	Repos []string `json:"repos" binding:"required"`
+	// Keys, if given, are the only components the agent knows how to plan
+	Keys []string `json:"keys,omitempty"`
+}
+
+// enqueue asks for a component to be planned
+func (o *Options) enqueue(c *gin.Context) {
+	request := queue.Request{}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request: " + err.Error()})
+		return
+	}
+
+	key, err := parseKey(request.Key)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	request.Key = key.String()
+
+	switch {
+	case request.Repo == "":
+		c.JSON(http.StatusBadRequest, gin.H{"error": "repo is required"})
+		return
+	case request.Branch == "":
+		c.JSON(http.StatusBadRequest, gin.H{"error": "branch is required"})
+		return
+	case request.Workspace == "":
+		request.Workspace = defaultWorkspace
+	}
+
+	if err := storage.ValidBranch(request.Branch); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := storage.ValidWorkspace(request.Workspace); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Asking for a plan is as good as uploading one, so only those who may upload it may ask
+	if err := o.authorize(c, request.Key, request.Branch, request.Workspace); err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !o.queue.Add(request) {
+		c.JSON(http.StatusOK, gin.H{"queued": false, "request": request})
+		return
+	}
+
+	log.Debug().Str("key", request.Key).Str("branch", string(request.Branch)).Str("workspace", string(request.Workspace)).Msg("Queued plan request")
+	c.JSON(http.StatusCreated, gin.H{"queued": true, "request": request})
+}
+
+func (o *Options) listQueue(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"pending": o.queue.Pending(),
+		"leases":  o.queue.Leases(),
+	})
+}
+
+// lease gives an agent a single request to plan, or nothing if there is nothing it can plan
+func (o *Options) lease(c *gin.Context) {
+	request := leaseRequest{}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid lease request: " + err.Error()})
+		return
+	}
+
+	if agent, ok := c.Get(agentKey); ok && agent != request.Agent {
+		c.JSON(http.StatusForbidden, gin.H{"error": "agents may only lease requests for themselves"})
+		return
+	}
+
+	// Only give agents what they can plan and would be allowed to upload
+	allowed := func(r queue.Request) bool {
+		if len(request.Keys) > 0 && !contains(request.Keys, r.Key) {
+			return false
+		}
+		return o.verifier == nil || o.verifier.Allowed(request.Agent, r.Key, string(r.Branch), string(r.Workspace))
+	}
+
+	lease, err := o.queue.Lease(request.Agent, request.Repos, allowed)
+	switch {
+	case err != nil:
+		log.Error().Err(err).Msg("Failed to lease request")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to lease request"})
+	case lease == nil:
+		c.Status(http.StatusNoContent)
+	default:
+		log.Debug().Str("key", lease.Key).Str("agent", lease.Agent).Str("lease", lease.ID).Msg("Leased plan request")
+		c.JSON(http.StatusOK, lease)
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/deweysasser/olympus/queue"
+	"github.com/deweysasser/olympus/run"
+	"github.com/deweysasser/olympus/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func postJSON(t *testing.T, url string, v any) *http.Response {
+	b, err := json.Marshal(v)
+	require.NoError(t, err)
+	resp, err := http.Post(url, "application/json", bytes.NewReader(b))
+	require.NoError(t, err)
+	return resp
+}
+
+func TestOptions_queue(t *testing.T) {
+	o := &Options{storage: storage.New(t.TempDir()), LeaseTimeout: time.Hour}
+
+	server := httptest.NewServer(o.createServer())
+	defer server.Close()
+
+	resp := postJSON(t, server.URL+"/api/v1/queue", queue.Request{Key: "/prod/network/", Repo: "infra", Branch: "main"})
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	resp = postJSON(t, server.URL+"/api/v1/queue", queue.Request{Key: "prod/network", Repo: "infra", Branch: "main"})
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "duplicates are accepted but not queued")
+
+	for name, r := range map[string]queue.Request{
+		"no key":      {Repo: "infra", Branch: "main"},
+		"empty parts": {Key: "prod//network", Repo: "infra", Branch: "main"},
+		"no repo":     {Key: "prod/network", Branch: "main"},
+		"no branch":   {Key: "prod/network", Repo: "infra"},
+	} {
+		resp := postJSON(t, server.URL+"/api/v1/queue", r)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, name)
+	}
+
+	resp = postJSON(t, server.URL+"/api/v1/lease", leaseRequest{Agent: "agent-1", Repos: []string{"app"}})
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	resp = postJSON(t, server.URL+"/api/v1/lease", map[string]string{"agent": "agent-1"})
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp = postJSON(t, server.URL+"/api/v1/lease", leaseRequest{Agent: "agent-1", Repos: []string{"app", "infra"}})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	lease := queue.Lease{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&lease))
+	resp.Body.Close()
+	assert.Equal(t, queue.Request{Key: "prod/network", Repo: "infra", Branch: "main", Workspace: "default"}, lease.Request)
+	assert.Equal(t, "agent-1", lease.Agent)
+
+	resp = postJSON(t, server.URL+"/api/v1/lease", leaseRequest{Agent: "agent-2", Repos: []string{"infra"}})
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode, "leased requests are not given to another agent")
+
+	var status struct {
+		Pending []queue.Request
+		Leases  []queue.Lease
+	}
+	assert.Equal(t, http.StatusOK, get(t, server.URL+"/api/v1/queue", &status))
+	assert.Empty(t, status.Pending)
+	require.Len(t, status.Leases, 1)
+	assert.Equal(t, lease.ID, status.Leases[0].ID)
+
+	resp = post(t, server.URL+"/api/v1/plans/prod/network", &run.PlanRecord{End: time.Now(), Branch: "main", Output: "failed"})
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	assert.Equal(t, http.StatusOK, get(t, server.URL+"/api/v1/queue", &status))
+	assert.Empty(t, status.Pending)
+	assert.Empty(t, status.Leases, "uploading the plan completes the lease")
+}
+
+func TestOptions_lease_keys(t *testing.T) {
+	o := &Options{storage: storage.New(t.TempDir()), LeaseTimeout: time.Hour}
+
+	server := httptest.NewServer(o.createServer())
+	defer server.Close()
+
+	resp := postJSON(t, server.URL+"/api/v1/queue", queue.Request{Key: "prod/network", Repo: "infra", Branch: "main"})
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	resp = postJSON(t, server.URL+"/api/v1/lease", leaseRequest{Agent: "agent-1", Repos: []string{"infra"}, Keys: []string{"prod/app"}})
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode, "agents are not given components they don't know")
+
+	resp = postJSON(t, server.URL+"/api/v1/lease", leaseRequest{Agent: "agent-1", Repos: []string{"infra"}, Keys: []string{"prod/app", "prod/network"}})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
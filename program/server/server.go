@@ -2,22 +2,67 @@ package server
 
 import (
 	"fmt"
+	"github.com/deweysasser/olympus/auth"
+	"github.com/deweysasser/olympus/compression"
 	"github.com/deweysasser/olympus/middleware"
+	"github.com/deweysasser/olympus/program/store"
+	"github.com/deweysasser/olympus/queue"
+	"github.com/deweysasser/olympus/storage"
 	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+	"time"
 )
 
 type Options struct {
-	Port int `help:"Port on which to listen" default:"8081"`
-	// DataDirectory string `help:"Directory into which to write data" type:"existingdir" default:"received"`
+	Port          int             `help:"Port on which to listen" default:"8081"`
+	DataDirectory string          `help:"Directory into which to write data" type:"path" default:"received"`
+	Backend       string          `help:"How to store data (file|sqlite)" enum:"file,sqlite" default:"file"`
+	PruneEvery    time.Duration   `help:"How often to prune stored history by the retention policy (0 to never prune)" default:"0"`
+	Retention     store.Retention `embed:"" prefix:"retention."`
+	LeaseTimeout  time.Duration   `help:"How long an agent has to upload a plan it leased before the request is given to another" default:"30m"`
+	Agents        string          `help:"File listing the agents allowed to upload, with their hashed secrets.  Without it, uploads are not authenticated." type:"path"`
+	MaxBody       int             `help:"Largest plan record to accept, in megabytes after decompression (0 for no limit)" default:"256"`
+	Compress      string          `help:"How to compress stored records (none|gzip|zstd)" enum:"none,gzip,zstd" default:"none"`
+
+	storage  *storage.Storage
+	queue    *queue.Queue
+	verifier *auth.Verifier
 }
 
 func (o *Options) Run() error {
+	s, err := storage.Open(o.Backend, o.DataDirectory)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	o.storage = s
+
+	encoding, err := compression.Parse(o.Compress)
+	if err != nil {
+		return err
+	}
+	o.storage.Compress(encoding)
+
+	o.Retention.Schedule(o.storage, o.PruneEvery)
+
+	if o.Agents != "" {
+		if o.verifier, err = auth.Load(o.Agents); err != nil {
+			return err
+		}
+	} else {
+		log.Warn().Msg("No agents file given.  Anyone who can reach the server can upload plans.")
+	}
 
 	r := o.createServer()
 	return r.Run(fmt.Sprintf(":%d", o.Port))
 }
 
 func (o *Options) createServer() *gin.Engine {
+	if o.queue == nil {
+		o.queue = queue.New(o.LeaseTimeout)
+	}
+
 	r := gin.New()
 	// r.Use(ginzerolog.Logger("gin"))
 	r.Use(middleware.GinRequestLogger())
@@ -25,5 +70,7 @@ func (o *Options) createServer() *gin.Engine {
 		context.JSON(200, gin.H{"status": "alive"})
 	})
 
+	o.addAPI(r)
+
 	return r
 }
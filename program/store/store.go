@@ -0,0 +1,91 @@
+package store
+
+import (
+	"fmt"
+	"github.com/deweysasser/olympus/storage"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"os"
+	"time"
+)
+
+// Options holds the commands which manage stored plan data
+type Options struct {
+	Prune PruneOptions `cmd:"" help:"Remove historical plan records according to the retention policy"`
+}
+
+// PruneOptions removes old records once
+type PruneOptions struct {
+	DataPath string    `help:"Path to find data" type:"path" default:"received"`
+	Backend  string    `help:"How data is stored (file|sqlite)" enum:"file,sqlite" default:"file"`
+	DryRun   bool      `help:"Show what would be removed without removing anything"`
+	Policy   Retention `embed:"" prefix:"retention."`
+}
+
+// Retention is the command line form of a storage.Policy
+type Retention struct {
+	KeepLast      int           `help:"Number of most recent records to keep for each component" default:"10"`
+	KeepDaily     int           `help:"Number of days for which to keep the newest record of the day" default:"7"`
+	KeepWeekly    int           `help:"Number of weeks for which to keep the newest record of the week" default:"4"`
+	MaxAge        time.Duration `help:"Remove records older than this (0 to keep regardless of age)" default:"0"`
+	KeepSucceeded bool          `help:"Always keep the most recent successful record" default:"true" negatable:""`
+}
+
+func (o *PruneOptions) Run() error {
+	// Files must already be there, but opening a database creates it
+	if o.Backend == "file" {
+		if info, err := os.Stat(o.DataPath); err != nil {
+			return err
+		} else if !info.IsDir() {
+			return errors.New("Data directory not a directory: " + o.DataPath)
+		}
+	}
+
+	s, err := storage.Open(o.Backend, o.DataPath)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	removed, err := s.Prune(o.Policy.Policy(), o.DryRun)
+
+	for _, e := range removed {
+		verb := "Removed"
+		if o.DryRun {
+			verb = "Would remove"
+		}
+		fmt.Println(verb, e.Key, e.Time.Format(time.RFC3339), e.Branch, e.Workspace)
+	}
+
+	return err
+}
+
+// Policy converts the options into a storage policy
+func (r Retention) Policy() storage.Policy {
+	return storage.Policy{
+		KeepLast:      r.KeepLast,
+		KeepDaily:     r.KeepDaily,
+		KeepWeekly:    r.KeepWeekly,
+		MaxAge:        r.MaxAge,
+		KeepSucceeded: r.KeepSucceeded,
+	}
+}
+
+// Schedule prunes the storage periodically in the background.  A zero period disables pruning.
+func (r Retention) Schedule(s *storage.Storage, every time.Duration) {
+	if every <= 0 {
+		return
+	}
+
+	go func() {
+		log.Debug().Str("every", every.String()).Msg("Pruning stored history periodically")
+		for range time.Tick(every) {
+			removed, err := s.Prune(r.Policy(), false)
+			if err != nil {
+				log.Error().Err(err).Msg("Failed to prune stored history")
+			} else if len(removed) > 0 {
+				log.Info().Int("removed", len(removed)).Msg("Pruned stored history")
+			}
+		}
+	}()
+}
@@ -0,0 +1,94 @@
+package ui
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"path"
+	"strings"
+	"time"
+)
+
+// Health controls how the condition of each component is highlighted
+type Health struct {
+	LockTolerance int           `help:"Number of consecutive state lock failures to tolerate before showing a component as failed" default:"3"`
+	StuckLock     time.Duration `help:"Highlight state locks held for longer than this (0 to never highlight)" default:"2h"`
+	StaleAfter    time.Duration `help:"Highlight plans older than this (0 to never highlight)" default:"24h"`
+	StaleRules    []string      `name:"stale-rule" help:"Staleness threshold for cells matching a column/row pattern, e.g. production/*=6h.  The first matching rule wins." placeholder:"PATTERN=DURATION"`
+
+	rules []staleRule
+}
+
+// staleRule is a parsed staleness threshold for a column/row pattern
+type staleRule struct {
+	pattern string
+	after   time.Duration
+}
+
+// parseRules checks and parses the staleness rules
+func (h *Health) parseRules() error {
+	h.rules = nil
+	for _, r := range h.StaleRules {
+		pattern, after, found := strings.Cut(r, "=")
+		if !found {
+			return errors.New("stale rule must be PATTERN=DURATION: " + r)
+		}
+
+		if _, err := path.Match(pattern, ""); err != nil {
+			return errors.Wrap(err, "bad pattern in stale rule "+r)
+		}
+
+		d, err := time.ParseDuration(after)
+		if err != nil {
+			return errors.Wrap(err, "bad duration in stale rule "+r)
+		}
+
+		h.rules = append(h.rules, staleRule{pattern: pattern, after: d})
+	}
+	return nil
+}
+
+// staleAfter returns the staleness threshold for a cell
+func (h *Health) staleAfter(column string, row RowName) time.Duration {
+	name := column + "/" + string(row)
+	for _, r := range h.rules {
+		if ok, _ := path.Match(r.pattern, name); ok {
+			return r.after
+		}
+	}
+	return h.StaleAfter
+}
+
+// Apply marks the cells of the table according to the health of their components
+func (h *Health) Apply(tab *ChangeTable, now time.Time) {
+	for _, row := range tab.Rows {
+		for _, cell := range row.Contents {
+			if cell == nil {
+				continue
+			}
+
+			if oldest := cell.Summary.Oldest(); !oldest.IsZero() {
+				cell.Age = now.Sub(oldest)
+				after := h.staleAfter(cell.ColumnName, cell.RowName)
+				cell.Stale = after > 0 && cell.Age > after
+			}
+
+			failures := cell.Summary.LockFailures()
+			if failures == 0 {
+				continue
+			}
+
+			lock := cell.Summary.Lock()
+
+			if failures > h.LockTolerance {
+				cell.Failed = true
+				cell.Failure = fmt.Sprintf("%d consecutive runs could not get the state lock: %s", failures, lock)
+			} else {
+				cell.Locked = true
+			}
+
+			if h.StuckLock > 0 && lock.HeldFor(now) > h.StuckLock {
+				cell.StuckLock = true
+			}
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package ui
+
+import (
+	"github.com/deweysasser/olympus/terraform"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stubSummary is a plan summary with fixed answers
+type stubSummary struct {
+	lockFailures int
+	lock         *terraform.LockInfo
+	time         time.Time
+}
+
+func (s *stubSummary) Name() string                      { return "stub" }
+func (s *stubSummary) Changes() terraform.Changes        { return terraform.Changes{} }
+func (s *stubSummary) UpToDate() bool                    { return s.lockFailures == 0 }
+func (s *stubSummary) Children() []terraform.PlanSummary { return nil }
+func (s *stubSummary) ChangedResources() string          { return "" }
+func (s *stubSummary) Failed() bool                      { return false }
+func (s *stubSummary) Failure() string                   { return "" }
+func (s *stubSummary) LockFailures() int                 { return s.lockFailures }
+func (s *stubSummary) Lock() *terraform.LockInfo         { return s.lock }
+func (s *stubSummary) Oldest() time.Time                 { return s.time }
+func (s *stubSummary) Newest() time.Time                 { return s.time }
+
+func TestHealth_Apply(t *testing.T) {
+	now := time.Date(2000, 1, 1, 12, 0, 0, 0, time.UTC)
+	recent := &terraform.LockInfo{ID: "1", Who: "someone", Created: now.Add(-time.Minute)}
+	old := &terraform.LockInfo{ID: "2", Who: "someone", Created: now.Add(-time.Hour * 5)}
+
+	tests := []struct {
+		name    string
+		summary *stubSummary
+		status  string
+		failed  bool
+		locked  bool
+		stuck   bool
+	}{
+		{name: "not locked", summary: &stubSummary{}, status: "none"},
+		{name: "tolerated", summary: &stubSummary{lockFailures: 3, lock: recent}, status: "none locked", locked: true},
+		{name: "too many", summary: &stubSummary{lockFailures: 4, lock: recent}, status: "error", failed: true},
+		{name: "stuck", summary: &stubSummary{lockFailures: 1, lock: old}, status: "none stuck-lock", locked: true, stuck: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cell := &Cell{Summary: tt.summary}
+			tab := &ChangeTable{Rows: []Row{{Contents: []*Cell{cell, nil}}}}
+
+			h := &Health{LockTolerance: 3, StuckLock: 2 * time.Hour}
+			h.Apply(tab, now)
+
+			assert.Equal(t, tt.status, cell.Status())
+			assert.Equal(t, tt.failed, cell.Failed)
+			assert.Equal(t, tt.locked, cell.Locked)
+			assert.Equal(t, tt.stuck, cell.StuckLock)
+			if tt.failed {
+				assert.Contains(t, cell.Failure, "4 consecutive runs could not get the state lock")
+			}
+		})
+	}
+}
+
+func TestHealth_stale(t *testing.T) {
+	now := time.Date(2000, 1, 10, 12, 0, 0, 0, time.UTC)
+
+	h := &Health{
+		StaleAfter: 24 * time.Hour,
+		StaleRules: []string{"production/*=6h", "*/10-bootstrap=0"},
+	}
+	require.NoError(t, h.parseRules())
+
+	tests := []struct {
+		column string
+		row    RowName
+		age    time.Duration
+		stale  bool
+		label  string
+	}{
+		{column: "staging", row: "network", age: 0, label: ""},
+		{column: "staging", row: "network", age: 30 * time.Minute, label: "30m"},
+		{column: "staging", row: "network", age: 23 * time.Hour, label: "23h"},
+		{column: "staging", row: "network", age: 72 * time.Hour, stale: true, label: "3d"},
+		{column: "production", row: "network", age: 7 * time.Hour, stale: true, label: "7h"},
+		{column: "production", row: "10-bootstrap", age: 7 * time.Hour, stale: true, label: "7h"},
+		{column: "staging", row: "10-bootstrap", age: 30 * 24 * time.Hour, stale: false, label: "30d"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.column+"/"+string(tt.row)+"/"+tt.label, func(t *testing.T) {
+			summary := &stubSummary{}
+			if tt.age > 0 {
+				summary.time = now.Add(-tt.age)
+			}
+			cell := &Cell{Summary: summary, ColumnName: tt.column, RowName: tt.row}
+			h.Apply(&ChangeTable{Rows: []Row{{Contents: []*Cell{cell}}}}, now)
+
+			assert.Equal(t, tt.stale, cell.Stale)
+			assert.Equal(t, tt.label, cell.AgeLabel())
+			assert.Equal(t, tt.stale, strings.HasSuffix(cell.Status(), " stale"))
+		})
+	}
+
+	bad := &Health{StaleRules: []string{"production/*"}}
+	assert.Error(t, bad.parseRules())
+	bad = &Health{StaleRules: []string{"production/*=soon"}}
+	assert.Error(t, bad.parseRules())
+	bad = &Health{StaleRules: []string{"[=1h"}}
+	assert.Error(t, bad.parseRules())
+}
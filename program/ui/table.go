@@ -1,8 +1,11 @@
 package ui
 
 import (
+	"fmt"
 	"github.com/deweysasser/olympus/terraform"
 	"sort"
+	"strings"
+	"time"
 )
 
 type ChangeTable struct {
@@ -19,11 +22,66 @@ type Cell struct {
 	Summary    terraform.PlanSummary
 	RowName    RowName
 	ColumnName string
+
+	// Failed means the component should be shown as failed
+	Failed bool
+	// Failure explains why the component failed
+	Failure string
+	// Locked means the most recent runs could not get the state lock, but not yet enough to count as a failure
+	Locked bool
+	// StuckLock means the state lock has been held for too long
+	StuckLock bool
+	// Age is how long ago the oldest plan in the cell was made
+	Age time.Duration
+	// Stale means the plan is too old to be trusted
+	Stale bool
+}
+
+// Status returns the style classes for the cell
+func (c *Cell) Status() string {
+	classes := []string{c.Summary.Changes().Highest()}
+
+	if c.Failed {
+		classes = []string{"error"}
+	}
+
+	switch {
+	case c.StuckLock:
+		classes = append(classes, "stuck-lock")
+	case c.Locked:
+		classes = append(classes, "locked")
+	}
+
+	if c.Stale {
+		classes = append(classes, "stale")
+	}
+
+	return strings.Join(classes, " ")
+}
+
+// AgeLabel briefly describes the age of the cell's plans
+func (c *Cell) AgeLabel() string {
+	switch {
+	case c.Age <= 0:
+		return ""
+	case c.Age < time.Hour:
+		return fmt.Sprintf("%dm", int(c.Age.Minutes()))
+	case c.Age < 48*time.Hour:
+		return fmt.Sprintf("%dh", int(c.Age.Hours()))
+	default:
+		return fmt.Sprintf("%dd", int(c.Age.Hours()/24))
+	}
+}
+
+// LockDescription describes the state lock blocking the component, if any
+func (c *Cell) LockDescription() string {
+	return c.Summary.Lock().String()
 }
 
 type RowName string
 
-// CreateTable parses out a set of summaries and arranges it for nice display
+// CreateTable parses out a set of summaries and arranges it for nice display.  Rows planned in workspaces other than
+// the default have a row for each workspace, named after it, so that each workspace's changes and failures can be seen.
 func CreateTable(summaries []terraform.PlanSummary) *ChangeTable {
 	tab := &ChangeTable{}
 	table := make(map[string]map[RowName]terraform.PlanSummary)
@@ -35,8 +93,15 @@ func CreateTable(summaries []terraform.PlanSummary) *ChangeTable {
 		table[s.Name()] = make(map[RowName]terraform.PlanSummary)
 
 		for _, child := range s.Children() {
-			table[s.Name()][RowName(child.Name())] = child
-			rowNameMap[child.Name()] = true
+			workspaces := terraform.ByWorkspace(child)
+			for w, part := range workspaces {
+				name := child.Name()
+				if len(workspaces) > 1 || w != terraform.DefaultWorkspace {
+					name = fmt.Sprintf("%s (%s)", name, w)
+				}
+				table[s.Name()][RowName(name)] = part
+				rowNameMap[name] = true
+			}
 		}
 	}
 
@@ -61,6 +126,8 @@ func CreateTable(summaries []terraform.PlanSummary) *ChangeTable {
 					Summary:    summary,
 					RowName:    rowName,
 					ColumnName: sumName,
+					Failed:     summary.Failed(),
+					Failure:    summary.Failure(),
 				})
 			} else {
 				row.Contents = append(row.Contents, nil)
@@ -2,6 +2,7 @@ package ui
 
 import (
 	"github.com/deweysasser/olympus/terraform"
+	tfjson "github.com/hashicorp/terraform-json"
 	"github.com/stretchr/testify/assert"
 	"testing"
 )
@@ -22,3 +23,31 @@ func TestCreateTable(t *testing.T) {
 	assert.Equal(t, []string{"10-bootstrap", "20-domains", "20-user", "30-network", "35-interconnect", "40-infrastructure", "50-persistence", "60-service", "70-application", "80-control", "90-publish", "91-tracking", "93-monitoring", "95-legacy", "account"},
 		names)
 }
+
+func TestCreateTable_workspaces(t *testing.T) {
+	summary := func(workspace terraform.Workspace, failed bool) terraform.PlanSummary {
+		e := &terraform.Envelope{Workspace: workspace, Succeeded: !failed, Command: "terraform plan"}
+		if !failed {
+			e.Plan = &tfjson.Plan{FormatVersion: "1.1"}
+		}
+		return e.Summary(string(workspace))
+	}
+
+	tab := CreateTable([]terraform.PlanSummary{
+		terraform.NewPlanDir("prod",
+			terraform.NewPlanDir("app", summary("default", false), summary("staging", true)),
+			terraform.NewPlanDir("db", terraform.NewPlanDir("primary", summary("blue", false))),
+			terraform.NewPlanDir("network", summary("default", false)),
+		),
+	})
+
+	var names []string
+	failed := make(map[string]bool)
+	for _, row := range tab.Rows {
+		names = append(names, string(row.Name))
+		failed[string(row.Name)] = row.Contents[0].Failed
+	}
+
+	assert.Equal(t, []string{"app (default)", "app (staging)", "db (blue)", "network"}, names)
+	assert.Equal(t, map[string]bool{"app (default)": false, "app (staging)": true, "db (blue)": false, "network": false}, failed)
+}
@@ -3,7 +3,9 @@ package ui
 import (
 	"embed"
 	"fmt"
+	"github.com/deweysasser/olympus/git"
 	"github.com/deweysasser/olympus/middleware"
+	"github.com/deweysasser/olympus/storage"
 	"github.com/deweysasser/olympus/terraform"
 	"github.com/gorilla/mux"
 	"github.com/pkg/errors"
@@ -24,9 +26,13 @@ type Options struct {
 	TemplateReloads time.Duration `help:"frequency at which to reload templates" default:"500ms"`
 	UIFilePath      string        `help:"path for HTML templates" type:"path" optional:"1"`
 	DataPath        string        `help:"Path to find data" type:"path" default:"received"`
+	Backend         string        `help:"How data is stored (file|sqlite)" enum:"file,sqlite" default:"file"`
+	Branch          string        `help:"Branch whose plans are shown, unless a page asks for another with ?branch=" default:"main"`
 
 	templates *template.Template
+	storage   *storage.Storage
 	Meta      SiteMeta `embed:"" prefix:"site."`
+	Health    Health   `embed:""`
 }
 
 type SiteMeta struct {
@@ -39,6 +45,7 @@ func (ui *Options) Run() error {
 	if err != nil {
 		return err
 	}
+	defer ui.storage.Close()
 
 	server.Use(middleware.RequestLogger)
 
@@ -63,6 +70,14 @@ func (ui *Options) Router() (*mux.Router, error) {
 		}
 	}
 
+	if err := ui.Health.parseRules(); err != nil {
+		return nil, err
+	}
+
+	if ui.storage, err = storage.Open(ui.Backend, ui.DataPath); err != nil {
+		return nil, err
+	}
+
 	ui.templates, err = ui.parseTemplates()
 
 	if err != nil {
@@ -99,6 +114,11 @@ func (ui *Options) Router() (*mux.Router, error) {
 	return server, nil
 }
 
+// Storage returns the storage the UI reads, once the router has been created
+func (ui *Options) Storage() *storage.Storage {
+	return ui.storage
+}
+
 func (ui *Options) parseTemplates() (*template.Template, error) {
 	if ui.UIFilePath != "" {
 		templates := filepath.Join(ui.UIFilePath, "templates")
@@ -159,23 +179,44 @@ func (ui *Options) ServeStatic() (http.Handler, error) {
 func (ui *Options) Render(writer http.ResponseWriter, request *http.Request) {
 	log := log.Logger.With().Str("uri", request.RequestURI).Logger()
 
-	dir := ui.DataPath
-	if request.RequestURI != "/" {
-		dir = filepath.Join(dir, request.RequestURI[1:])
+	var key storage.Key
+	if request.URL.Path != "/" {
+		var err error
+		if key, err = storage.ValidKey(request.URL.Path); err != nil {
+			log.Debug().Err(err).Msg("Bad key")
+			http.NotFound(writer, request)
+			return
+		}
 	}
 
-	log.Debug().Str("data_dir", dir).Msg("Reading plan data")
+	branch := git.Branch(ui.Branch)
+	if b := request.URL.Query().Get("branch"); b != "" {
+		branch = git.Branch(b)
+	}
 
-	summaries, err := terraform.ReadDir(dir)
-	if err != nil {
-		log.Debug().Err(err).Str("dir", dir).Msg("could not read data")
+	log.Debug().Str("key", key.String()).Str("branch", string(branch)).Msg("Reading plan data")
+
+	summaries, err := ui.storage.Tree(key, branch)
+	switch {
+	case errors.Is(err, storage.ErrNotFound) && len(key) == 0:
+		// Nothing has been received yet
+		summaries = terraform.NewPlanDir("")
+	case errors.Is(err, storage.ErrNotFound):
+		log.Debug().Str("key", key.String()).Msg("No data")
 		http.NotFound(writer, request)
 		return
+	case err != nil:
+		log.Error().Err(err).Str("key", key.String()).Msg("Could not read data")
+		http.Error(writer, "could not read data", http.StatusInternalServerError)
+		return
 	}
 
+	table := CreateTable(summaries.Children())
+	ui.Health.Apply(table, time.Now())
+
 	data := map[string]any{
 		"site": ui.Meta,
-		"data": CreateTable(summaries.Children()),
+		"data": table,
 	}
 
 	err = ui.templates.ExecuteTemplate(writer, "index.html", data)
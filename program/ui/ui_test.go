@@ -0,0 +1,99 @@
+package ui
+
+import (
+	"github.com/deweysasser/olympus/run"
+	"github.com/deweysasser/olympus/storage"
+	tfjson "github.com/hashicorp/terraform-json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOptions_Render_keys(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "data", "prod"), 0755))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "secret"), 0755))
+
+	ui := &Options{DataPath: filepath.Join(dir, "data"), Branch: "main", storage: storage.New(filepath.Join(dir, "data"))}
+	var err error
+	ui.templates, err = ui.parseTemplates()
+	require.NoError(t, err)
+	require.NoError(t, ui.storage.Store(storage.ParseKey("prod/app"), &run.PlanRecord{End: time.Now(), Branch: "main", Workspace: "default"}))
+
+	for path, status := range map[string]int{
+		"/":                        http.StatusOK,
+		"/prod":                    http.StatusOK,
+		"/prod/":                   http.StatusOK,
+		"/missing":                 http.StatusNotFound,
+		"/..":                      http.StatusNotFound,
+		"/%2e%2e/secret":           http.StatusNotFound,
+		"/prod/..%2f..%2fsecret":   http.StatusNotFound,
+		"/prod%5c..%5c..%5csecret": http.StatusNotFound,
+		"/prod/%00":                http.StatusNotFound,
+		"/.git":                    http.StatusNotFound,
+		"/prod?x=/../../secret":    http.StatusOK,
+	} {
+		recorder := httptest.NewRecorder()
+		ui.Render(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		assert.Equal(t, status, recorder.Code, path)
+	}
+}
+
+func TestOptions_Render_sqlite(t *testing.T) {
+	ui := &Options{DataPath: t.TempDir(), Backend: "sqlite", Branch: "main"}
+	_, err := ui.Router()
+	require.NoError(t, err)
+	defer ui.storage.Close()
+
+	require.NoError(t, ui.storage.Store(storage.ParseKey("prod/network"), &run.PlanRecord{End: time.Now(), Branch: "main", Workspace: "default", Succeeded: false, Command: "terraform plan"}))
+
+	recorder := httptest.NewRecorder()
+	ui.Render(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "<th>prod</th>")
+	assert.Contains(t, recorder.Body.String(), "network")
+	assert.Contains(t, recorder.Body.String(), "failed")
+
+	recorder = httptest.NewRecorder()
+	ui.Render(recorder, httptest.NewRequest(http.MethodGet, "/staging", nil))
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+}
+
+func TestOptions_Render_empty(t *testing.T) {
+	for _, backend := range []string{"file", "sqlite"} {
+		ui := &Options{DataPath: t.TempDir(), Backend: backend, Branch: "main"}
+		_, err := ui.Router()
+		require.NoError(t, err)
+
+		for path, status := range map[string]int{"/": http.StatusOK, "/prod": http.StatusNotFound} {
+			recorder := httptest.NewRecorder()
+			ui.Render(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+			assert.Equal(t, status, recorder.Code, backend+" "+path)
+		}
+
+		require.NoError(t, ui.storage.Close())
+	}
+}
+
+func TestOptions_Render_branch(t *testing.T) {
+	ui := &Options{DataPath: t.TempDir(), Backend: "file", Branch: "main"}
+	_, err := ui.Router()
+	require.NoError(t, err)
+
+	// A newer run on another branch doesn't replace the plan of the branch shown
+	require.NoError(t, ui.storage.Store(storage.ParseKey("prod/network"), &run.PlanRecord{End: time.Now().Add(-time.Hour), Branch: "main", Workspace: "default", Succeeded: true, Plan: &tfjson.Plan{FormatVersion: "1.1"}}))
+	require.NoError(t, ui.storage.Store(storage.ParseKey("prod/network"), &run.PlanRecord{End: time.Now(), Branch: "feature/x", Workspace: "default", Command: "terraform plan"}))
+
+	for path, failed := range map[string]bool{"/": false, "/?branch=main": false, "/?branch=feature/x": true} {
+		recorder := httptest.NewRecorder()
+		ui.Render(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		assert.Equal(t, http.StatusOK, recorder.Code, path)
+		assert.Equal(t, failed, strings.Contains(recorder.Body.String(), "failed"), path)
+	}
+}
@@ -0,0 +1,190 @@
+// Package queue keeps track of the plans the server would like agents to run.  Agents lease requests one at a time,
+// so that any number of them can share the work without planning the same component twice.
+package queue
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/deweysasser/olympus/git"
+	"github.com/deweysasser/olympus/terraform"
+	"sync"
+	"time"
+)
+
+// Request is a plan the server wants run
+type Request struct {
+	// Key is the server key of the component
+	Key string `json:"key"`
+	// Repo is the name of the repo containing the component.  Only agents which can plan the repo are given the request.
+	Repo      string              `json:"repo"`
+	Branch    git.Branch          `json:"branch"`
+	Workspace terraform.Workspace `json:"workspace"`
+}
+
+// Lease is a request given to an agent.  If the agent does not upload a plan for it before it expires, the request
+// goes back on the queue.
+type Lease struct {
+	Request
+	ID      string    `json:"id"`
+	Agent   string    `json:"agent"`
+	Expires time.Time `json:"expires"`
+}
+
+// Queue holds requests waiting for an agent and those currently leased
+type Queue struct {
+	timeout time.Duration
+	now     func() time.Time
+
+	lock    sync.Mutex
+	pending []Request
+	leases  []*Lease
+}
+
+// New creates a queue whose leases last for timeout
+func New(timeout time.Duration) *Queue {
+	return &Queue{timeout: timeout, now: time.Now}
+}
+
+// Add puts a request at the back of the queue.  It returns false if the same request is already waiting or leased.
+func (q *Queue) Add(r Request) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for _, p := range q.pending {
+		if p == r {
+			return false
+		}
+	}
+	for _, l := range q.leases {
+		if l.Request == r {
+			return false
+		}
+	}
+
+	q.pending = append(q.pending, r)
+	return true
+}
+
+// Lease gives the agent the oldest request for any of its repos which it is allowed to plan (any, if allowed is nil).
+// It returns nil if there is nothing for it to do.
+func (q *Queue) Lease(agent string, repos []string, allowed func(Request) bool) (*Lease, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.expire()
+
+	for i, r := range q.pending {
+		if !contains(repos, r.Repo) || (allowed != nil && !allowed(r)) {
+			continue
+		}
+
+		id, err := newID()
+		if err != nil {
+			return nil, err
+		}
+
+		lease := &Lease{Request: r, ID: id, Agent: agent, Expires: q.now().Add(q.timeout)}
+
+		q.pending = append(q.pending[:i:i], q.pending[i+1:]...)
+		q.leases = append(q.leases, lease)
+
+		result := *lease
+		return &result, nil
+	}
+
+	return nil, nil
+}
+
+// Complete acknowledges that a plan was uploaded for the component, removing any matching lease.  Matching requests
+// which are still waiting are satisfied too, however the plan came to be made.  It returns the leases completed.
+func (q *Queue) Complete(key string, branch git.Branch, workspace terraform.Workspace) []Lease {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	matches := func(r Request) bool {
+		return r.Key == key && r.Branch == branch && r.Workspace == workspace
+	}
+
+	var completed []Lease
+	leases := q.leases[:0]
+	for _, l := range q.leases {
+		if matches(l.Request) {
+			completed = append(completed, *l)
+		} else {
+			leases = append(leases, l)
+		}
+	}
+	q.leases = leases
+
+	pending := q.pending[:0]
+	for _, r := range q.pending {
+		if !matches(r) {
+			pending = append(pending, r)
+		}
+	}
+	q.pending = pending
+
+	return completed
+}
+
+// Pending returns the requests waiting for an agent, oldest first
+func (q *Queue) Pending() []Request {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.expire()
+
+	return append([]Request{}, q.pending...)
+}
+
+// Leases returns the requests currently being planned
+func (q *Queue) Leases() []Lease {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.expire()
+
+	result := make([]Lease, 0, len(q.leases))
+	for _, l := range q.leases {
+		result = append(result, *l)
+	}
+	return result
+}
+
+// expire puts the requests of expired leases back at the front of the queue, since they have waited longest.  The
+// caller must hold the lock.
+func (q *Queue) expire() {
+	now := q.now()
+
+	var expired []Request
+	leases := q.leases[:0]
+	for _, l := range q.leases {
+		if now.Before(l.Expires) {
+			leases = append(leases, l)
+		} else {
+			expired = append(expired, l.Request)
+		}
+	}
+	q.leases = leases
+
+	if len(expired) > 0 {
+		q.pending = append(expired, q.pending...)
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+func newID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,76 @@
+package queue
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestQueue(t *testing.T) {
+	now := time.Date(2022, 10, 10, 12, 0, 0, 0, time.UTC)
+	q := New(10 * time.Minute)
+	q.now = func() time.Time { return now }
+
+	network := Request{Key: "infra/network", Repo: "infra", Branch: "main", Workspace: "default"}
+	dns := Request{Key: "infra/dns", Repo: "infra", Branch: "main", Workspace: "default"}
+	app := Request{Key: "app", Repo: "app", Branch: "main", Workspace: "default"}
+
+	assert.True(t, q.Add(network))
+	assert.True(t, q.Add(app))
+	assert.True(t, q.Add(dns))
+	assert.False(t, q.Add(network), "duplicates are not queued")
+
+	lease, err := q.Lease("agent-1", []string{"other"}, nil)
+	require.NoError(t, err)
+	assert.Nil(t, lease, "agents only get requests for their repos")
+
+	lease, err = q.Lease("agent-1", []string{"infra"}, func(r Request) bool { return r.Key != "infra/network" })
+	require.NoError(t, err)
+	assert.Equal(t, dns, lease.Request, "agents only get requests they are allowed")
+	assert.Len(t, q.Complete("infra/dns", "main", "default"), 1)
+	assert.True(t, q.Add(dns))
+
+	lease, err = q.Lease("agent-1", []string{"infra"}, nil)
+	require.NoError(t, err)
+	require.NotNil(t, lease)
+	assert.Equal(t, network, lease.Request)
+	assert.Equal(t, "agent-1", lease.Agent)
+	assert.Equal(t, now.Add(10*time.Minute), lease.Expires)
+	assert.NotEmpty(t, lease.ID)
+
+	assert.False(t, q.Add(network), "leased requests are not queued again")
+
+	second, err := q.Lease("agent-2", []string{"infra", "app"}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, app, second.Request)
+	assert.NotEqual(t, lease.ID, second.ID)
+
+	assert.Equal(t, []Request{dns}, q.Pending())
+	assert.Len(t, q.Leases(), 2)
+
+	t.Run("expired leases are re-issued first", func(t *testing.T) {
+		now = now.Add(10 * time.Minute)
+
+		assert.Equal(t, []Request{network, app, dns}, q.Pending())
+		assert.Empty(t, q.Leases())
+
+		again, err := q.Lease("agent-3", []string{"infra"}, nil)
+		require.NoError(t, err)
+		assert.Equal(t, network, again.Request)
+		assert.Equal(t, "agent-3", again.Agent)
+	})
+
+	t.Run("uploads complete leases and waiting requests", func(t *testing.T) {
+		completed := q.Complete("infra/network", "main", "other")
+		assert.Empty(t, completed, "a different workspace is a different request")
+
+		completed = q.Complete("infra/network", "main", "default")
+		require.Len(t, completed, 1)
+		assert.Equal(t, "agent-3", completed[0].Agent)
+
+		assert.Empty(t, q.Complete("app", "main", "default"))
+		assert.Equal(t, []Request{dns}, q.Pending())
+		assert.Empty(t, q.Leases())
+	})
+}
@@ -18,6 +18,10 @@ type PlanRecord struct {
 	Command   string              `json:"command"`
 	Output    string              `json:"output,omitempty"`
 	Succeeded bool                `json:"success"`
+	// Failure classifies why an unsuccessful run failed
+	Failure terraform.FailureClass `json:"failure,omitempty"`
+	// Lock describes the holder of the state lock when the run failed to acquire it
+	Lock *terraform.LockInfo `json:"lock,omitempty"`
 }
 
 type SummaryInfo struct {
@@ -0,0 +1,232 @@
+package storage
+
+import (
+	"github.com/deweysasser/olympus/compression"
+	"github.com/deweysasser/olympus/git"
+	"github.com/deweysasser/olympus/run"
+	"github.com/deweysasser/olympus/terraform"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// backends creates an empty backend of each kind
+var backends = map[string]func(t *testing.T) Backend{
+	"file": func(t *testing.T) Backend {
+		return NewFileBackend(t.TempDir())
+	},
+	"sqlite": func(t *testing.T) Backend {
+		b, err := NewSQLiteBackend(filepath.Join(t.TempDir(), "test.db"))
+		require.NoError(t, err)
+		t.Cleanup(func() { b.Close() })
+		return b
+	},
+}
+
+func TestBackends(t *testing.T) {
+	t1 := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	t2 := t1.Add(time.Hour)
+
+	for name, create := range backends {
+		t.Run(name, func(t *testing.T) {
+			b := create(t)
+
+			require.NoError(t, b.Store(ParseKey("prod/network"), &run.PlanRecord{End: t2, Branch: "main", Workspace: "default", Command: "second"}))
+			require.NoError(t, b.Store(ParseKey("prod/network"), &run.PlanRecord{End: t1, Branch: "main", Workspace: "default", Command: "first"}))
+			require.NoError(t, b.Store(ParseKey("prod/app"), &run.PlanRecord{End: t1, Branch: "feature", Workspace: "blue"}))
+			require.NoError(t, b.Store(ParseKey("production/app"), &run.PlanRecord{End: t1, Branch: "main", Workspace: "default"}))
+
+			assert.Equal(t, "feature,main", setAsString(b.Branches()))
+			assert.Equal(t, "blue,default", setAsString(b.Workspaces()))
+
+			entries, err := b.List(ParseKey("prod"))
+			require.NoError(t, err)
+			assert.Equal(t, 3, len(entries))
+
+			entries, err = b.List(Key{})
+			require.NoError(t, err)
+			assert.Equal(t, 4, len(entries))
+
+			_, err = b.List(ParseKey("pro"))
+			assert.ErrorIs(t, err, ErrNotFound)
+
+			entries, err = b.History(ParseKey("prod/network"), "main", "default")
+			require.NoError(t, err)
+			require.Equal(t, 2, len(entries))
+			assert.Equal(t, t1, entries[0].Time)
+			assert.Equal(t, t2, entries[1].Time)
+			assert.Equal(t, "prod/network", entries[1].Key.String())
+
+			r, err := b.Get(entries[1])
+			require.NoError(t, err)
+			assert.Equal(t, "second", r.Command)
+
+			require.NoError(t, b.Delete(entries[1]))
+
+			entries, err = b.History(ParseKey("prod/network"), "main", "default")
+			require.NoError(t, err)
+			require.Equal(t, 1, len(entries))
+			assert.Equal(t, t1, entries[0].Time)
+
+			s := &Storage{Backend: b}
+			set, err := s.Summary(ParseKey("prod"), "main", "default")
+			require.NoError(t, err)
+			require.Equal(t, 1, len(set.Records))
+			assert.Equal(t, "first", set.Records[0].Records[0].Command)
+		})
+	}
+}
+
+func TestBackends_invalidKey(t *testing.T) {
+	for name, create := range backends {
+		t.Run(name, func(t *testing.T) {
+			b := create(t)
+
+			for _, key := range []Key{{"..", "escaped"}, {"prod", ".."}, {"/etc"}, {"prod", "a\\b"}} {
+				assert.Error(t, b.Store(key, &run.PlanRecord{End: time.Now(), Branch: "main", Workspace: "default"}), key.String())
+			}
+		})
+	}
+}
+
+func TestBackends_invalidRecord(t *testing.T) {
+	for name, create := range backends {
+		t.Run(name, func(t *testing.T) {
+			b := create(t)
+
+			for _, branch := range []git.Branch{"x/../../../escaped", "../escaped", "feature//x", "/main", "main/", ".hidden", "a\\b", "a b", "a__b", "main\x00", "-f", "feature/con"} {
+				assert.Error(t, b.Store(ParseKey("prod/app"), &run.PlanRecord{End: time.Now(), Branch: branch, Workspace: "default"}), branch)
+			}
+
+			for _, workspace := range []terraform.Workspace{"", "..", "../../escaped", "a/b", "a\\b", ".x", "a__b", "nul", terraform.Workspace(strings.Repeat("w", MaxKeyPartLength+1))} {
+				assert.Error(t, b.Store(ParseKey("prod/app"), &run.PlanRecord{End: time.Now(), Branch: "main", Workspace: workspace}), workspace)
+			}
+
+			_, err := b.List(Key{})
+			assert.ErrorIs(t, err, ErrNotFound, "nothing was stored")
+		})
+	}
+}
+
+func TestBackends_branches(t *testing.T) {
+	t1 := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for name, create := range backends {
+		t.Run(name, func(t *testing.T) {
+			b := create(t)
+
+			require.NoError(t, b.Store(ParseKey("prod/app"), &run.PlanRecord{End: t1, Branch: "feature/foo", Workspace: "default", Command: "slash"}))
+			require.NoError(t, b.Store(ParseKey("prod/app"), &run.PlanRecord{End: t1, Branch: "feature", Workspace: "default"}))
+
+			entries, err := b.List(ParseKey("prod"))
+			require.NoError(t, err)
+			assert.Equal(t, 2, len(entries))
+
+			entries, err = b.History(ParseKey("prod/app"), "feature/foo", "default")
+			require.NoError(t, err)
+			require.Equal(t, 1, len(entries))
+
+			r, err := b.Get(entries[0])
+			require.NoError(t, err)
+			assert.Equal(t, "slash", r.Command)
+
+			assert.Equal(t, "feature,feature/foo", setAsString(b.Branches()))
+		})
+	}
+}
+
+func TestBackends_timeZone(t *testing.T) {
+	// An agent ahead of UTC finished at 08:00Z
+	end := time.Date(2000, 1, 1, 10, 0, 0, 0, time.FixedZone("agent", 2*60*60))
+
+	for name, create := range backends {
+		t.Run(name, func(t *testing.T) {
+			s := &Storage{Backend: create(t)}
+			require.NoError(t, s.Store(ParseKey("prod/app"), &run.PlanRecord{End: end, Branch: "main", Workspace: "default", Command: "zoned"}))
+
+			entries, err := s.History(ParseKey("prod/app"), "main", "default")
+			require.NoError(t, err)
+			require.Equal(t, 1, len(entries))
+			assert.True(t, end.Equal(entries[0].Time), entries[0].Time.String())
+
+			r, err := s.Get(entries[0])
+			require.NoError(t, err)
+			assert.Equal(t, "zoned", r.Command)
+
+			set, err := s.AsOf(ParseKey("prod"), "main", "default", time.Date(2000, 1, 1, 9, 0, 0, 0, time.UTC))
+			require.NoError(t, err)
+			assert.Equal(t, 1, len(set.Records))
+		})
+	}
+}
+
+func TestFileBackend_branches(t *testing.T) {
+	dir := t.TempDir()
+	b := NewFileBackend(dir)
+	require.NoError(t, b.Store(ParseKey("prod/app"), &run.PlanRecord{End: time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC), Branch: "feature/foo", Workspace: "default"}))
+
+	files, err := os.ReadDir(filepath.Join(dir, "prod", "app"))
+	require.NoError(t, err)
+	require.Equal(t, 1, len(files))
+	assert.Equal(t, "2000-01-01-00-00-00__feature+foo__default.json", files[0].Name())
+
+	// Found again when the backend is reopened
+	assert.Equal(t, "feature/foo", setAsString(NewFileBackend(dir).Branches()))
+}
+
+func TestBackends_compressed(t *testing.T) {
+	t1 := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	t2 := t1.Add(time.Hour)
+	key := ParseKey("prod/network")
+
+	for name, create := range backends {
+		t.Run(name, func(t *testing.T) {
+			s := &Storage{Backend: create(t)}
+
+			require.NoError(t, s.Store(key, &run.PlanRecord{End: t1, Branch: "main", Workspace: "default", Command: "plain"}))
+			s.Compress(compression.Zstd)
+			require.NoError(t, s.Store(key, &run.PlanRecord{End: t2, Branch: "main", Workspace: "default", Command: "compressed"}))
+
+			entries, err := s.History(key, "main", "default")
+			require.NoError(t, err)
+			require.Len(t, entries, 2)
+
+			for i, command := range []string{"plain", "compressed"} {
+				r, err := s.Get(entries[i])
+				require.NoError(t, err)
+				assert.Equal(t, command, r.Command)
+			}
+
+			// Storing a record again replaces it, however it was stored before
+			require.NoError(t, s.Store(key, &run.PlanRecord{End: t1, Branch: "main", Workspace: "default", Command: "again"}))
+			entries, err = s.History(key, "main", "default")
+			require.NoError(t, err)
+			require.Len(t, entries, 2)
+			r, err := s.Get(entries[0])
+			require.NoError(t, err)
+			assert.Equal(t, "again", r.Command)
+
+			require.NoError(t, s.Delete(entries[0]))
+			require.NoError(t, s.Delete(entries[1]))
+			entries, err = s.History(key, "main", "default")
+			require.NoError(t, err)
+			assert.Empty(t, entries)
+		})
+	}
+}
+
+func TestFileBackend_compressed(t *testing.T) {
+	dir := t.TempDir()
+	s := New(dir)
+	s.Compress(compression.Gzip)
+
+	r := &run.PlanRecord{End: time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC), Branch: "main", Workspace: "default"}
+	require.NoError(t, s.Store(ParseKey("prod/network"), r))
+
+	_, err := os.Stat(filepath.Join(dir, "prod", "network", "2000-01-01-00-00-00__main__default.json.gz"))
+	assert.NoError(t, err)
+}
@@ -0,0 +1,299 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	mapset "github.com/deckarep/golang-set/v2"
+	"github.com/deweysasser/olympus/compression"
+	"github.com/deweysasser/olympus/git"
+	"github.com/deweysasser/olympus/run"
+	"github.com/deweysasser/olympus/terraform"
+	"github.com/pkg/errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// FileBackend stores each record as a JSON file named for its time in UTC, branch and workspace in a directory per key.
+// Compressed files have the extension of their compression added.
+type FileBackend struct {
+	dir         string
+	compression compression.Encoding
+	branches    mapset.Set[git.Branch]
+	workspaces  mapset.Set[terraform.Workspace]
+}
+
+const timeFormat = "2006-01-02-15-04-05"
+
+// branchSeparator stands for the "/" between the parts of branches in file names.  It can't be part of a valid
+// branch, so names can be read back unambiguously.
+const branchSeparator = "+"
+
+func NewFileBackend(dir string) *FileBackend {
+	s := &FileBackend{
+		dir:        dir,
+		branches:   mapset.NewSet[git.Branch](),
+		workspaces: mapset.NewSet[terraform.Workspace](),
+	}
+
+	s.readFileNamesForMetadata()
+	return s
+}
+
+func (s *FileBackend) buildFile(key Key, r *run.PlanRecord) string {
+	return filepath.Join(
+		s.dir,
+		filepath.Join(
+			key...,
+		),
+		fmt.Sprintf("%s__%s__%s.json", r.End.UTC().Format(timeFormat), strings.ReplaceAll(string(r.Branch), "/", branchSeparator), r.Workspace),
+	)
+}
+
+// variants are the names the file of a record may have, however it was compressed
+func variants(file string) []string {
+	result := []string{file}
+	for _, ext := range compression.Extensions {
+		result = append(result, file+ext)
+	}
+	return result
+}
+
+func (s *FileBackend) compress(e compression.Encoding) {
+	s.compression = e
+}
+
+func (s *FileBackend) Store(key Key, r *run.PlanRecord) error {
+	if err := ValidateRecord(key, r); err != nil {
+		return err
+	}
+
+	file := s.buildFile(key, r)
+	bytes, err := json.Marshal(r)
+	if err == nil {
+		bytes, err = s.compression.Compress(bytes)
+	}
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(file)
+	dirinfo, err := os.Stat(dir)
+	switch {
+	case err != nil:
+		os.MkdirAll(dir, os.ModePerm)
+	case !dirinfo.IsDir():
+		return errors.New("Path " + dir + " is exists but is not a directory")
+	}
+
+	// A record stored again replaces the old one, however that was compressed
+	for _, v := range variants(file) {
+		os.Remove(v)
+	}
+
+	err = os.WriteFile(file+s.compression.Extension(), bytes, os.ModePerm)
+	if err == nil {
+		s.branches.Add(r.Branch)
+		s.workspaces.Add(r.Workspace)
+	}
+	return err
+}
+
+func (s *FileBackend) Branches() mapset.Set[git.Branch] {
+	return s.branches
+}
+func (s *FileBackend) Workspaces() mapset.Set[terraform.Workspace] {
+	return s.workspaces
+}
+
+func (s *FileBackend) List(key Key) ([]Entry, error) {
+	root := filepath.Join(s.dir, filepath.Join(key...))
+
+	info, err := os.Stat(root)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, errors.New("Path " + root + " is not a directory")
+	}
+
+	var entries []Entry
+
+	err = filepath.Walk(root, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		entry, ok := parseFileName(info.Name())
+		if !ok {
+			return nil
+		}
+
+		rel, err := filepath.Rel(s.dir, filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+		entry.Key = Key(strings.Split(filepath.ToSlash(rel), "/"))
+		entries = append(entries, entry)
+		return nil
+	})
+
+	if err == nil && len(entries) == 0 {
+		return nil, ErrNotFound
+	}
+
+	return entries, err
+}
+
+func (s *FileBackend) History(key Key, branch git.Branch, workspace terraform.Workspace) ([]Entry, error) {
+	files, err := os.ReadDir(filepath.Join(s.dir, filepath.Join(key...)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var entries []Entry
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		if e, ok := parseFileName(f.Name()); ok && e.Branch == branch && e.Workspace == workspace {
+			e.Key = key
+			entries = append(entries, e)
+		}
+	}
+
+	sortByTime(entries)
+	return entries, nil
+}
+
+func (s *FileBackend) Get(e Entry) (*run.PlanRecord, error) {
+	file, err := s.find(e)
+	if err != nil {
+		return nil, err
+	}
+
+	bytes, err := os.ReadFile(file)
+	if err == nil {
+		bytes, err = compression.Decompress(bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	r := &run.PlanRecord{}
+	if err := json.Unmarshal(bytes, r); err != nil {
+		return nil, errors.Wrap(err, "while reading file "+file)
+	}
+
+	return r, nil
+}
+
+func (s *FileBackend) Delete(e Entry) error {
+	file, err := s.find(e)
+	if err != nil {
+		return err
+	}
+	return os.Remove(file)
+}
+
+// find returns the file holding the entry's record
+func (s *FileBackend) find(e Entry) (string, error) {
+	file := s.buildFile(e.Key, e.record())
+	for _, v := range variants(file) {
+		if _, err := os.Stat(v); err == nil {
+			return v, nil
+		}
+	}
+	return "", &fs.PathError{Op: "open", Path: file, Err: fs.ErrNotExist}
+}
+
+func (s *FileBackend) readFileNamesForMetadata() {
+	filepath.Walk(s.dir, func(path string, info fs.FileInfo, err error) error {
+		if info != nil && !info.IsDir() {
+			if entry, ok := parseFileName(info.Name()); ok {
+				s.branches.Add(entry.Branch)
+				s.workspaces.Add(entry.Workspace)
+			}
+		}
+		return nil
+	})
+}
+
+// legacyPlans finds the plans saved as bare files before there were records.  The components are named by their
+// path relative to the data directory.
+func (s *FileBackend) legacyPlans(key Key) (map[string][]string, error) {
+	root := filepath.Join(s.dir, filepath.Join(key...))
+	result := make(map[string][]string)
+
+	if _, err := os.Stat(root); os.IsNotExist(err) {
+		return result, nil
+	}
+
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return err
+		}
+
+		files, err := os.ReadDir(path)
+		if err != nil {
+			return err
+		}
+
+		var plans []string
+		for _, f := range files {
+			if f.IsDir() {
+				continue
+			}
+			if _, ok := parseFileName(f.Name()); ok {
+				// Records supersede any plans saved before them
+				return nil
+			}
+			if filepath.Ext(compression.TrimExtension(f.Name())) == ".json" {
+				plans = append(plans, filepath.Join(path, f.Name()))
+			}
+		}
+
+		if len(plans) > 0 {
+			rel, err := filepath.Rel(s.dir, path)
+			if err != nil {
+				return err
+			}
+			result[filepath.ToSlash(rel)] = plans
+		}
+		return nil
+	})
+
+	return result, err
+}
+
+// parseFileName extracts the time, branch and workspace from a record file name.  The key is not filled in.
+func parseFileName(name string) (Entry, bool) {
+	name = compression.TrimExtension(name)
+	ext := filepath.Ext(name)
+	parts := strings.Split(name[:len(name)-len(ext)], "__")
+	if len(parts) != 3 || ext != ".json" {
+		return Entry{}, false
+	}
+
+	t, err := time.Parse(timeFormat, parts[0])
+	if err != nil {
+		return Entry{}, false
+	}
+
+	return Entry{
+		Time:      t,
+		Branch:    git.Branch(strings.ReplaceAll(parts[1], branchSeparator, "/")),
+		Workspace: terraform.Workspace(parts[2]),
+	}, true
+}
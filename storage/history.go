@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"github.com/deweysasser/olympus/git"
+	"github.com/deweysasser/olympus/run"
+	"github.com/deweysasser/olympus/terraform"
+	"github.com/pkg/errors"
+	"sort"
+	"time"
+)
+
+// ErrNotFound is returned when there is no record matching a request
+var ErrNotFound = errors.New("no matching records found")
+
+// Latest returns the most recent record for the component at key on the branch and workspace
+func (s *Storage) Latest(key Key, branch git.Branch, workspace terraform.Workspace) (*run.PlanRecord, error) {
+	entries, err := s.History(key, branch, workspace)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(entries) == 0 {
+		return nil, ErrNotFound
+	}
+
+	return s.Get(entries[len(entries)-1])
+}
+
+// AsOf builds the same tree as Summary, but from the newest records which existed at the given time
+func (s *Storage) AsOf(key Key, branch git.Branch, workspace terraform.Workspace, t time.Time) (run.Set, error) {
+	entries, err := s.List(key)
+	if err != nil {
+		return run.Set{}, err
+	}
+
+	return summarize(s, key, branch, workspace, before(entries, t))
+}
+
+// before returns only those entries recorded at or before t
+func before(entries []Entry, t time.Time) []Entry {
+	var result []Entry
+	for _, e := range entries {
+		if !e.Time.After(t) {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+func sortByTime(entries []Entry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Time.Before(entries[j].Time)
+	})
+}
@@ -0,0 +1,55 @@
+package storage
+
+import (
+	"github.com/deweysasser/olympus/run"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestStorage_History(t *testing.T) {
+	storage := New(t.TempDir())
+
+	t1 := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	t2 := t1.Add(time.Hour)
+	t3 := t2.Add(time.Hour)
+
+	for _, r := range []run.PlanRecord{
+		{End: t3, Branch: "main", Workspace: "default", Command: "third"},
+		{End: t1, Branch: "main", Workspace: "default", Command: "first"},
+		{End: t2, Branch: "main", Workspace: "default", Command: "second"},
+		{End: t3, Branch: "other", Workspace: "default", Command: "other"},
+	} {
+		r := r
+		require.NoError(t, storage.Store(ParseKey("prod/network"), &r))
+	}
+	require.NoError(t, storage.Store(ParseKey("prod/app"), &run.PlanRecord{End: t2, Branch: "main", Workspace: "default", Command: "app"}))
+
+	entries, err := storage.History(ParseKey("prod/network"), "main", "default")
+	require.NoError(t, err)
+	require.Equal(t, 3, len(entries))
+	assert.Equal(t, t1, entries[0].Time)
+	assert.Equal(t, t2, entries[1].Time)
+	assert.Equal(t, t3, entries[2].Time)
+	assert.Equal(t, "prod/network", entries[0].Key.String())
+
+	latest, err := storage.Latest(ParseKey("prod/network"), "main", "default")
+	require.NoError(t, err)
+	assert.Equal(t, "third", latest.Command)
+
+	_, err = storage.Latest(ParseKey("prod/missing"), "main", "default")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	set, err := storage.AsOf(ParseKey("prod"), "main", "default", t2.Add(time.Minute))
+	require.NoError(t, err)
+	require.Equal(t, 2, len(set.Records))
+	assert.Equal(t, "app", set.Records[0].Records[0].Command)
+	assert.Equal(t, "second", set.Records[1].Records[0].Command)
+	assert.Equal(t, t2, set.Newest)
+
+	set, err = storage.AsOf(ParseKey("prod"), "main", "default", t1)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(set.Records))
+	assert.Equal(t, "first", set.Records[0].Records[0].Command)
+}
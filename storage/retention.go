@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"sort"
+	"time"
+)
+
+// Policy describes which historical records to keep for each component.  A record is kept if any of the rules
+// selects it, except that records older than MaxAge are always dropped unless they are the last successful run.
+type Policy struct {
+	// KeepLast is the number of most recent records to keep
+	KeepLast int
+	// KeepDaily is the number of days for which the newest record of the day is kept
+	KeepDaily int
+	// KeepWeekly is the number of weeks for which the newest record of the week is kept
+	KeepWeekly int
+	// MaxAge drops records older than this.  Zero means never drop records by age
+	MaxAge time.Duration
+	// KeepSucceeded always keeps the most recent successful record
+	KeepSucceeded bool
+}
+
+// Prune removes the records not selected by the policy, returning the entries removed.  If dryRun is set, nothing
+// is removed and the entries that would have been removed are returned.
+func (s *Storage) Prune(p Policy, dryRun bool) ([]Entry, error) {
+	entries, err := s.List(Key{})
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	components := make(map[string][]Entry)
+	var names []string
+	for _, e := range entries {
+		name := fmt.Sprintf("%s__%s__%s", e.Key, e.Branch, e.Workspace)
+		if _, ok := components[name]; !ok {
+			names = append(names, name)
+		}
+		components[name] = append(components[name], e)
+	}
+	sort.Strings(names)
+
+	succeeded := func(e Entry) bool {
+		r, err := s.Get(e)
+		return err == nil && r.Succeeded
+	}
+
+	now := time.Now()
+	var removed []Entry
+
+	for _, name := range names {
+		for _, e := range p.expired(components[name], now, succeeded) {
+			if !dryRun {
+				if err := s.Delete(e); err != nil {
+					return removed, err
+				}
+			}
+			removed = append(removed, e)
+		}
+	}
+
+	return removed, nil
+}
+
+// expired returns the entries of a single component which the policy does not keep
+func (p Policy) expired(entries []Entry, now time.Time, succeeded func(Entry) bool) []Entry {
+	sorted := make([]Entry, len(entries))
+	copy(sorted, entries)
+	sortByTime(sorted)
+
+	// Newest first from here on
+	for i, j := 0, len(sorted)-1; i < j; i, j = i+1, j-1 {
+		sorted[i], sorted[j] = sorted[j], sorted[i]
+	}
+
+	keep := make([]bool, len(sorted))
+
+	for i := 0; i < len(sorted) && i < p.KeepLast; i++ {
+		keep[i] = true
+	}
+
+	keepNewestPer(sorted, keep, p.KeepDaily, func(t time.Time) string {
+		return t.UTC().Format("2006-01-02")
+	})
+
+	keepNewestPer(sorted, keep, p.KeepWeekly, func(t time.Time) string {
+		year, week := t.UTC().ISOWeek()
+		return fmt.Sprintf("%d-%d", year, week)
+	})
+
+	if p.MaxAge > 0 {
+		cutoff := now.Add(-p.MaxAge)
+		for i, e := range sorted {
+			if e.Time.Before(cutoff) {
+				keep[i] = false
+			}
+		}
+	}
+
+	if p.KeepSucceeded {
+		for i, e := range sorted {
+			if succeeded(e) {
+				keep[i] = true
+				break
+			}
+		}
+	}
+
+	var result []Entry
+	for i, e := range sorted {
+		if !keep[i] {
+			result = append(result, e)
+		}
+	}
+
+	return result
+}
+
+// keepNewestPer marks the newest entry in each of the most recent count periods.  Entries must be sorted newest first.
+func keepNewestPer(sorted []Entry, keep []bool, count int, period func(time.Time) string) {
+	last := ""
+	for i, e := range sorted {
+		if count <= 0 {
+			return
+		}
+		if p := period(e.Time); p != last {
+			keep[i] = true
+			last = p
+			count--
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"github.com/deweysasser/olympus/run"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func times(entries []Entry) []time.Time {
+	var result []time.Time
+	for _, e := range entries {
+		result = append(result, e.Time)
+	}
+	return result
+}
+
+func TestPolicy_expired(t *testing.T) {
+	now := time.Date(2000, 1, 31, 12, 0, 0, 0, time.UTC)
+
+	// Two runs a day for 30 days, newest last
+	var entries []Entry
+	for day := 30; day > 0; day-- {
+		for _, hour := range []int{1, 2} {
+			entries = append(entries, Entry{Time: now.Add(-time.Duration(day)*24*time.Hour + time.Duration(hour)*time.Hour)})
+		}
+	}
+
+	never := func(Entry) bool { return false }
+
+	tests := []struct {
+		name      string
+		policy    Policy
+		succeeded func(Entry) bool
+		kept      int
+	}{
+		{name: "keep nothing", policy: Policy{}, succeeded: never, kept: 0},
+		{name: "keep last", policy: Policy{KeepLast: 3}, succeeded: never, kept: 3},
+		{name: "keep daily", policy: Policy{KeepDaily: 7}, succeeded: never, kept: 7},
+		{name: "keep last and daily overlap", policy: Policy{KeepLast: 2, KeepDaily: 2}, succeeded: never, kept: 3},
+		{name: "keep weekly", policy: Policy{KeepWeekly: 2}, succeeded: never, kept: 2},
+		{name: "max age", policy: Policy{KeepLast: 100, MaxAge: 5 * 24 * time.Hour}, succeeded: never, kept: 10},
+		{name: "keep succeeded beyond max age",
+			policy:    Policy{MaxAge: time.Hour, KeepSucceeded: true},
+			succeeded: func(e Entry) bool { return e.Time.Before(now.Add(-20 * 24 * time.Hour)) },
+			kept:      1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expired := tt.policy.expired(entries, now, tt.succeeded)
+			assert.Equal(t, len(entries)-tt.kept, len(expired))
+		})
+	}
+
+	expired := Policy{KeepLast: 1, KeepDaily: 2}.expired(entries, now, never)
+	// With nothing kept, everything comes back newest first
+	all := Policy{}.expired(entries, now, never)
+	assert.NotContains(t, times(expired), all[0].Time)
+	assert.Contains(t, times(expired), all[1].Time)
+	assert.NotContains(t, times(expired), all[2].Time)
+}
+
+func TestStorage_Prune(t *testing.T) {
+	storage := New(t.TempDir())
+
+	t1 := time.Now().UTC().Add(-3 * time.Hour).Truncate(time.Second)
+	t2 := t1.Add(time.Hour)
+	t3 := t2.Add(time.Hour)
+
+	for _, r := range []run.PlanRecord{
+		{End: t1, Branch: "main", Workspace: "default", Succeeded: true},
+		{End: t2, Branch: "main", Workspace: "default"},
+		{End: t3, Branch: "main", Workspace: "default"},
+	} {
+		r := r
+		require.NoError(t, storage.Store(ParseKey("prod/network"), &r))
+	}
+
+	policy := Policy{KeepLast: 1, KeepSucceeded: true}
+
+	removed, err := storage.Prune(policy, true)
+	require.NoError(t, err)
+	assert.Equal(t, []time.Time{t2}, times(removed))
+
+	entries, err := storage.History(ParseKey("prod/network"), "main", "default")
+	require.NoError(t, err)
+	assert.Equal(t, 3, len(entries))
+
+	removed, err = storage.Prune(policy, false)
+	require.NoError(t, err)
+	assert.Equal(t, []time.Time{t2}, times(removed))
+
+	entries, err = storage.History(ParseKey("prod/network"), "main", "default")
+	require.NoError(t, err)
+	assert.Equal(t, []time.Time{t1, t3}, times(entries))
+}
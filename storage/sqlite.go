@@ -0,0 +1,212 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	mapset "github.com/deckarep/golang-set/v2"
+	"github.com/deweysasser/olympus/compression"
+	"github.com/deweysasser/olympus/git"
+	"github.com/deweysasser/olympus/run"
+	"github.com/deweysasser/olympus/terraform"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"strings"
+	"time"
+
+	// Registers the pure go "sqlite" driver
+	_ "modernc.org/sqlite"
+)
+
+// SQLiteBackend stores records in an embedded SQLite database, indexed so that large estates don't need to walk
+// directories to answer queries
+type SQLiteBackend struct {
+	db          *sql.DB
+	compression compression.Encoding
+}
+
+const schema = `
+CREATE TABLE IF NOT EXISTS records (
+	key       TEXT    NOT NULL,
+	branch    TEXT    NOT NULL,
+	workspace TEXT    NOT NULL,
+	time      INTEGER NOT NULL,
+	record    BLOB    NOT NULL,
+	PRIMARY KEY (key, branch, workspace, time)
+);
+CREATE INDEX IF NOT EXISTS records_branch ON records (branch);
+CREATE INDEX IF NOT EXISTS records_workspace ON records (workspace);
+CREATE INDEX IF NOT EXISTS records_time ON records (time);
+`
+
+// NewSQLiteBackend opens (creating if necessary) the database in file
+func NewSQLiteBackend(file string) (*SQLiteBackend, error) {
+	db, err := sql.Open("sqlite", file)
+	if err != nil {
+		return nil, errors.Wrap(err, "while opening database "+file)
+	}
+
+	// SQLite only allows a single writer
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "while creating schema in "+file)
+	}
+
+	return &SQLiteBackend{db: db}, nil
+}
+
+// NewSQLite creates a storage backed by the SQLite database in file
+func NewSQLite(file string) (*Storage, error) {
+	b, err := NewSQLiteBackend(file)
+	if err != nil {
+		return nil, err
+	}
+	return &Storage{Backend: b}, nil
+}
+
+func (s *SQLiteBackend) Close() error {
+	return s.db.Close()
+}
+
+func (s *SQLiteBackend) compress(e compression.Encoding) {
+	s.compression = e
+}
+
+func (s *SQLiteBackend) Store(key Key, r *run.PlanRecord) error {
+	if err := ValidateRecord(key, r); err != nil {
+		return err
+	}
+
+	bytes, err := json.Marshal(r)
+	if err == nil {
+		bytes, err = s.compression.Compress(bytes)
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(`INSERT OR REPLACE INTO records (key, branch, workspace, time, record) VALUES (?, ?, ?, ?, ?)`,
+		key.String(), string(r.Branch), string(r.Workspace), r.End.Unix(), bytes)
+	return err
+}
+
+func (s *SQLiteBackend) Get(e Entry) (*run.PlanRecord, error) {
+	var bytes []byte
+	err := s.db.QueryRow(`SELECT record FROM records WHERE key = ? AND branch = ? AND workspace = ? AND time = ?`,
+		e.Key.String(), string(e.Branch), string(e.Workspace), e.Time.Unix()).Scan(&bytes)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err == nil {
+		bytes, err = compression.Decompress(bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	r := &run.PlanRecord{}
+	if err := json.Unmarshal(bytes, r); err != nil {
+		return nil, errors.Wrap(err, "while reading record for "+e.Key.String())
+	}
+
+	return r, nil
+}
+
+func (s *SQLiteBackend) List(key Key) ([]Entry, error) {
+	var entries []Entry
+	var err error
+
+	if len(key) == 0 {
+		entries, err = s.entries(`SELECT key, branch, workspace, time FROM records`)
+	} else {
+		prefix := escapeLike(key.String()) + "/%"
+		entries, err = s.entries(`SELECT key, branch, workspace, time FROM records WHERE key = ? OR key LIKE ? ESCAPE '\'`,
+			key.String(), prefix)
+	}
+
+	if err == nil && len(entries) == 0 {
+		return nil, ErrNotFound
+	}
+
+	return entries, err
+}
+
+func (s *SQLiteBackend) History(key Key, branch git.Branch, workspace terraform.Workspace) ([]Entry, error) {
+	return s.entries(`SELECT key, branch, workspace, time FROM records WHERE key = ? AND branch = ? AND workspace = ? ORDER BY time`,
+		key.String(), string(branch), string(workspace))
+}
+
+func (s *SQLiteBackend) Delete(e Entry) error {
+	_, err := s.db.Exec(`DELETE FROM records WHERE key = ? AND branch = ? AND workspace = ? AND time = ?`,
+		e.Key.String(), string(e.Branch), string(e.Workspace), e.Time.Unix())
+	return err
+}
+
+func (s *SQLiteBackend) Branches() mapset.Set[git.Branch] {
+	result := mapset.NewSet[git.Branch]()
+	for _, b := range s.distinct("branch") {
+		result.Add(git.Branch(b))
+	}
+	return result
+}
+
+func (s *SQLiteBackend) Workspaces() mapset.Set[terraform.Workspace] {
+	result := mapset.NewSet[terraform.Workspace]()
+	for _, w := range s.distinct("workspace") {
+		result.Add(terraform.Workspace(w))
+	}
+	return result
+}
+
+// distinct returns the distinct values of an (indexed) column
+func (s *SQLiteBackend) distinct(column string) []string {
+	rows, err := s.db.Query(`SELECT DISTINCT ` + column + ` FROM records`)
+	if err != nil {
+		log.Error().Err(err).Str("column", column).Msg("Failed to query database")
+		return nil
+	}
+	defer rows.Close()
+
+	var result []string
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			log.Error().Err(err).Str("column", column).Msg("Failed to read database")
+			return result
+		}
+		result = append(result, v)
+	}
+	return result
+}
+
+// entries runs a query returning key, branch, workspace and time columns
+func (s *SQLiteBackend) entries(query string, args ...any) ([]Entry, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []Entry
+	for rows.Next() {
+		var key, branch, workspace string
+		var t int64
+		if err := rows.Scan(&key, &branch, &workspace, &t); err != nil {
+			return nil, err
+		}
+		result = append(result, Entry{
+			Key:       ParseKey(key),
+			Time:      time.Unix(t, 0).UTC(),
+			Branch:    git.Branch(branch),
+			Workspace: terraform.Workspace(workspace),
+		})
+	}
+
+	return result, rows.Err()
+}
+
+// escapeLike escapes the wildcard characters of a LIKE pattern
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
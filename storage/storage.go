@@ -1,97 +1,223 @@
 package storage
 
 import (
-	"encoding/json"
 	"fmt"
 	mapset "github.com/deckarep/golang-set/v2"
+	"github.com/deweysasser/olympus/compression"
 	"github.com/deweysasser/olympus/git"
 	"github.com/deweysasser/olympus/run"
 	"github.com/deweysasser/olympus/terraform"
 	"github.com/pkg/errors"
-	"io/fs"
+	"io"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
+	"time"
 )
 
+// Backend is the interface to anything which can persist plan records
+type Backend interface {
+	// Store saves a record for the component at key
+	Store(key Key, r *run.PlanRecord) error
+	// Get reads the record described by the entry
+	Get(e Entry) (*run.PlanRecord, error)
+	// List returns an entry for every record stored at or below key, or ErrNotFound if there are none
+	List(key Key) ([]Entry, error)
+	// History returns the entries for every run of the component at key on the branch and workspace, oldest first
+	History(key Key, branch git.Branch, workspace terraform.Workspace) ([]Entry, error)
+	// Delete removes the record described by the entry
+	Delete(e Entry) error
+	// Branches returns every branch for which there is a record
+	Branches() mapset.Set[git.Branch]
+	// Workspaces returns every workspace for which there is a record
+	Workspaces() mapset.Set[terraform.Workspace]
+}
+
+// Storage provides summaries, history and retention on top of any backend
 type Storage struct {
-	dir        string
-	branches   mapset.Set[git.Branch]
-	workspaces mapset.Set[terraform.Workspace]
+	Backend
 }
 
 type Key []string
 
+// Entry describes a single stored record without reading it
+type Entry struct {
+	Key       Key
+	Time      time.Time
+	Branch    git.Branch
+	Workspace terraform.Workspace
+}
+
+// record creates the minimal record needed to locate the entry's file
+func (e Entry) record() *run.PlanRecord {
+	return &run.PlanRecord{End: e.Time, Branch: e.Branch, Workspace: e.Workspace}
+}
+
 func ParseKey(s string) Key {
 	return Key(strings.Split(s, "/"))
 }
 
-const timeFormat = "2006-01-02-15-04-05"
+func (k Key) String() string {
+	return strings.Join(k, "/")
+}
+
+// Limits on keys, so that they can be used as paths on any file system
+const (
+	MaxKeyDepth      = 16
+	MaxKeyPartLength = 100
+)
+
+// keyPart is what each part of a key may look like.  Parts can't start with a dot, so there are no relative or hidden
+// parts, nor with a dash, so they can't be mistaken for options.
+var keyPart = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9._-]*$`)
+
+// reservedNames can't be used as files on Windows, whatever their extension
+var reservedNames = map[string]bool{"con": true, "prn": true, "aux": true, "nul": true}
 
-func (s *Storage) buildFile(key Key, r *run.PlanRecord) string {
-	return filepath.Join(
-		s.dir,
-		filepath.Join(
-			key...,
-		),
-		fmt.Sprintf("%s__%s__%s.json", r.End.Format(timeFormat), r.Branch, r.Workspace),
-	)
+func init() {
+	for i := 1; i <= 9; i++ {
+		reservedNames[fmt.Sprintf("com%d", i)] = true
+		reservedNames[fmt.Sprintf("lpt%d", i)] = true
+	}
 }
 
-func (s *Storage) Store(key Key, r *run.PlanRecord) error {
-	file := s.buildFile(key, r)
-	if bytes, err := json.Marshal(r); err != nil {
-		return err
-	} else {
-		dir := filepath.Dir(file)
-		dirinfo, err := os.Stat(dir)
-		switch {
-		case err != nil:
-			os.MkdirAll(dir, os.ModePerm)
-		case !dirinfo.IsDir():
-			return errors.New("Path " + dir + " is exists but is not a directory")
-		}
-		err = os.WriteFile(file, bytes, os.ModePerm)
-		if err == nil {
-			s.branches.Add(r.Branch)
-			s.workspaces.Add(r.Workspace)
+// ValidKey parses a key received from a client, which may have leading and trailing slashes, and validates it
+func ValidKey(s string) (Key, error) {
+	key := ParseKey(strings.Trim(s, "/"))
+	if err := key.Validate(); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Validate returns an error if the key cannot safely name the place records are stored.  Every key received from
+// outside must be validated before it is used.
+func (k Key) Validate() error {
+	if len(k) == 0 || k.String() == "" {
+		return errors.New("key is required")
+	}
+	if len(k) > MaxKeyDepth {
+		return errors.Errorf("key %q has more than %d parts", k.String(), MaxKeyDepth)
+	}
+
+	for _, part := range k {
+		if err := validatePart(part); err != nil {
+			return errors.Wrapf(err, "key %q", k.String())
 		}
-		return err
 	}
+
+	return nil
 }
 
-func (s *Storage) Branches() mapset.Set[git.Branch] {
-	return s.branches
+func validatePart(part string) error {
+	switch {
+	case part == "":
+		return errors.New("empty part")
+	case len(part) > MaxKeyPartLength:
+		return errors.Errorf("part longer than %d characters", MaxKeyPartLength)
+	case part == "." || part == "..":
+		return errors.New("relative part")
+	case !keyPart.MatchString(part):
+		return errors.Errorf("part %q may only contain letters, digits, '.', '_' and '-', and can't start with '.' or '-'", part)
+	case strings.HasSuffix(part, "."):
+		return errors.Errorf("part %q ends with '.'", part)
+	case strings.Contains(part, "__"):
+		// Separates the time, branch and workspace in record file names
+		return errors.Errorf("part %q contains '__'", part)
+	case reservedNames[strings.ToLower(strings.SplitN(part, ".", 2)[0])]:
+		return errors.Errorf("part %q is a reserved name", part)
+	}
+	return nil
 }
-func (s *Storage) Workspaces() mapset.Set[terraform.Workspace] {
-	return s.workspaces
+
+// ValidBranch returns an error if the branch cannot safely be stored.  Older agents don't send branches, so the branch
+// may be empty, but otherwise it is made of parts separated by "/" which follow the same rules as the parts of keys.
+func ValidBranch(b git.Branch) error {
+	if b == "" {
+		return nil
+	}
+
+	parts := strings.Split(string(b), "/")
+	if len(parts) > MaxKeyDepth {
+		return errors.Errorf("branch %q has more than %d parts", b, MaxKeyDepth)
+	}
+
+	for _, part := range parts {
+		if err := validatePart(part); err != nil {
+			return errors.Wrapf(err, "branch %q", b)
+		}
+	}
+
+	return nil
 }
 
-func (s *Storage) Summary(key Key, branch git.Branch, workspace terraform.Workspace) (run.Set, error) {
-	return run.Set{}, errors.New("Not yet implemented")
+// ValidWorkspace returns an error if the workspace cannot safely be stored.  It follows the same rules as the parts of
+// keys.
+func ValidWorkspace(w terraform.Workspace) error {
+	if err := validatePart(string(w)); err != nil {
+		return errors.Wrapf(err, "workspace %q", w)
+	}
+	return nil
 }
 
-func New(dir string) *Storage {
-	s := &Storage{
-		dir:        dir,
-		branches:   mapset.NewSet[git.Branch](),
-		workspaces: mapset.NewSet[terraform.Workspace](),
+// ValidateRecord checks everything which decides where a record is stored under key
+func ValidateRecord(key Key, r *run.PlanRecord) error {
+	if err := key.Validate(); err != nil {
+		return err
+	}
+	if err := ValidBranch(r.Branch); err != nil {
+		return err
 	}
+	return ValidWorkspace(r.Workspace)
+}
 
-	s.readFileNamesForMetadata()
-	return s
+// New creates a storage using the file system layout under dir
+func New(dir string) *Storage {
+	return &Storage{Backend: NewFileBackend(dir)}
 }
 
-func (s *Storage) readFileNamesForMetadata() {
-	filepath.Walk(s.dir, func(path string, info fs.FileInfo, err error) error {
-		if info != nil && !info.IsDir() {
-			if parts := strings.Split(info.Name(), "__"); len(parts) > 2 {
-				s.branches.Add(git.Branch(parts[1]))
-				lastPart := parts[2]
-				ext := filepath.Ext(lastPart)
-				s.workspaces.Add(terraform.Workspace(lastPart[:len(lastPart)-len(ext)]))
-			}
+// Open creates a storage using the named backend ("file" or "sqlite") to keep its data in dir
+func Open(backend, dir string) (*Storage, error) {
+	switch backend {
+	case "file":
+		return New(dir), nil
+	case "sqlite":
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			return nil, err
 		}
-		return nil
-	})
+		return NewSQLite(filepath.Join(dir, "olympus.db"))
+	default:
+		return nil, errors.New("unknown storage backend " + backend)
+	}
+}
+
+// Close releases whatever the backend holds open
+func (s *Storage) Close() error {
+	if c, ok := s.Backend.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// compressor is a backend which can compress the records it stores
+type compressor interface {
+	compress(e compression.Encoding)
+}
+
+// Compress makes the storage compress the records it stores from now on.  Records are read however they were stored.
+func (s *Storage) Compress(e compression.Encoding) {
+	if c, ok := s.Backend.(compressor); ok {
+		c.compress(e)
+	}
+}
+
+// Summary builds the tree of the newest records under key for the given branch and workspace
+func (s *Storage) Summary(key Key, branch git.Branch, workspace terraform.Workspace) (run.Set, error) {
+	entries, err := s.List(key)
+	if err != nil {
+		return run.Set{}, err
+	}
+
+	return summarize(s, key, branch, workspace, entries)
 }
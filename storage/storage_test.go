@@ -28,7 +28,7 @@ func TestStorage_buildFile(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			s := &Storage{
+			s := &FileBackend{
 				dir: "/",
 			}
 			key := ParseKey(tt.key)
@@ -124,3 +124,31 @@ func setAsString[T comparable](set mapset.Set[T]) string {
 	return strings.Join(s, ",")
 
 }
+
+func TestKey_Validate(t *testing.T) {
+	for _, key := range []string{"prod", "prod/network", "prod/us-east-1/app_v2", "acme.com/prod"} {
+		assert.NoError(t, ParseKey(key).Validate(), key)
+	}
+
+	for _, key := range []string{"", "/", "prod//network", "../prod", "prod/..", "./prod", `prod\network`, "c:/prod",
+		"prod/net\nwork", "prod/\x00", "prod/%2e%2e", "prod/..%2fsecret", "~/prod", ".ssh/keys", "prod/.git", "-rf",
+		"prod/network.", "prod/net work", "prod/ｎetwork", "prod/CON", "prod/nul.json", "lpt1/app",
+		"prod/2000-01-01__main", strings.Repeat("a/", MaxKeyDepth) + "a", strings.Repeat("a", MaxKeyPartLength+1)} {
+		assert.Error(t, ParseKey(key).Validate(), key)
+	}
+	assert.Error(t, Key{}.Validate())
+
+	assert.NoError(t, ParseKey(strings.Repeat("a/", MaxKeyDepth-1)+strings.Repeat("a", MaxKeyPartLength)).Validate())
+	assert.NoError(t, ParseKey("prod/console").Validate())
+}
+
+func TestValidKey(t *testing.T) {
+	key, err := ValidKey("/prod/network/")
+	require.NoError(t, err)
+	assert.Equal(t, Key{"prod", "network"}, key)
+
+	for _, s := range []string{"", "/", "/../../etc/passwd", "/prod/../../secret"} {
+		_, err := ValidKey(s)
+		assert.Error(t, err, s)
+	}
+}
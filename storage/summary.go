@@ -0,0 +1,147 @@
+package storage
+
+import (
+	"github.com/deweysasser/olympus/git"
+	"github.com/deweysasser/olympus/run"
+	"github.com/deweysasser/olympus/terraform"
+	"sort"
+	"strings"
+	"time"
+)
+
+// recordReader is anything which can read the record behind an entry
+type recordReader interface {
+	Get(e Entry) (*run.PlanRecord, error)
+}
+
+// summarize builds a set from the newest record of each component in entries which matches the branch and workspace.
+//
+// The immediate children of key become the groups of the set, and every component below a child becomes a record in
+// that group.
+func summarize(reader recordReader, key Key, branch git.Branch, workspace terraform.Workspace, entries []Entry) (run.Set, error) {
+	set := run.Set{
+		Branch:    branch,
+		Workspace: workspace,
+	}
+	if len(key) > 0 {
+		set.Name = key[len(key)-1]
+	}
+
+	newest := make(map[string]Entry)
+	for _, e := range entries {
+		if e.Branch != branch || e.Workspace != workspace {
+			continue
+		}
+		if current, ok := newest[e.Key.String()]; !ok || e.Time.After(current.Time) {
+			newest[e.Key.String()] = e
+		}
+	}
+
+	var components []string
+	for k := range newest {
+		components = append(components, k)
+	}
+	sort.Strings(components)
+
+	groups := make(map[string]*run.Group)
+	var groupNames []string
+
+	for _, component := range components {
+		e := newest[component]
+		r, err := reader.Get(e)
+		if err != nil {
+			return run.Set{}, err
+		}
+
+		groupName, name := set.Name, set.Name
+		if rel := e.Key[len(key):]; len(rel) > 0 {
+			groupName, name = rel[0], rel[0]
+			if len(rel) > 1 {
+				name = strings.Join(rel[1:], "/")
+			}
+		}
+
+		group, ok := groups[groupName]
+		if !ok {
+			group = &run.Group{}
+			group.Name = groupName
+			groups[groupName] = group
+			groupNames = append(groupNames, groupName)
+		}
+
+		group.Records = append(group.Records, run.Summary{
+			PlanRecord:  *r,
+			SummaryInfo: recordInfo(name, r),
+		})
+		widen(&group.Oldest, &group.Newest, r.End)
+	}
+
+	sort.Strings(groupNames)
+
+	var infos []run.SummaryInfo
+	for _, name := range groupNames {
+		group := groups[name]
+
+		var records []run.SummaryInfo
+		for _, r := range group.Records {
+			records = append(records, r.SummaryInfo)
+		}
+		group.SummaryInfo = combine(group.Name, records)
+
+		set.Records = append(set.Records, *group)
+		infos = append(infos, group.SummaryInfo)
+		widen(&set.Oldest, &set.Newest, group.Oldest)
+		widen(&set.Oldest, &set.Newest, group.Newest)
+	}
+
+	set.SummaryInfo = combine(set.Name, infos)
+
+	return set, nil
+}
+
+// recordInfo calculates the summary information for a single record
+func recordInfo(name string, r *run.PlanRecord) run.SummaryInfo {
+	info := run.SummaryInfo{Name: name}
+
+	if r.Plan != nil {
+		plan := terraform.NewPlanSummary(name, r.Plan)
+		info.Changes = plan.Changes()
+		info.UpToDate = plan.UpToDate()
+		info.ChangedResources = plan.ChangedResources()
+	}
+
+	return info
+}
+
+// combine adds up the summary information of children
+func combine(name string, children []run.SummaryInfo) run.SummaryInfo {
+	info := run.SummaryInfo{Name: name, UpToDate: true}
+
+	var resources []string
+	for _, c := range children {
+		info.Changes.Added += c.Changes.Added
+		info.Changes.Updated += c.Changes.Updated
+		info.Changes.Deleted += c.Changes.Deleted
+		info.UpToDate = info.UpToDate && c.UpToDate
+		if c.ChangedResources != "" {
+			resources = append(resources, c.ChangedResources)
+		}
+	}
+
+	info.ChangedResources = strings.Join(resources, "\n")
+
+	return info
+}
+
+// widen stretches the oldest..newest range to include t
+func widen(oldest, newest *time.Time, t time.Time) {
+	if t.IsZero() {
+		return
+	}
+	if oldest.IsZero() || t.Before(*oldest) {
+		*oldest = t
+	}
+	if newest.IsZero() || t.After(*newest) {
+		*newest = t
+	}
+}
@@ -0,0 +1,72 @@
+package storage
+
+import (
+	"github.com/deweysasser/olympus/run"
+	tfjson "github.com/hashicorp/terraform-json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func planWith(actions ...tfjson.Action) *tfjson.Plan {
+	plan := &tfjson.Plan{FormatVersion: "1.1"}
+	for i, a := range actions {
+		plan.ResourceChanges = append(plan.ResourceChanges, &tfjson.ResourceChange{
+			Type:   "null_resource",
+			Name:   string(rune('a' + i)),
+			Change: &tfjson.Change{Actions: tfjson.Actions{a}},
+		})
+	}
+	return plan
+}
+
+func TestStorage_Summary(t *testing.T) {
+	storage := New(t.TempDir())
+
+	t1 := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	t2 := t1.Add(time.Hour)
+	t3 := t2.Add(time.Hour)
+
+	records := []struct {
+		key string
+		r   run.PlanRecord
+	}{
+		{"prod/network", run.PlanRecord{End: t1, Branch: "main", Workspace: "default", Plan: planWith(tfjson.ActionCreate)}},
+		{"prod/network", run.PlanRecord{End: t3, Branch: "main", Workspace: "default", Plan: planWith(tfjson.ActionDelete, tfjson.ActionUpdate)}},
+		{"prod/app/web", run.PlanRecord{End: t2, Branch: "main", Workspace: "default", Plan: planWith()}},
+		{"prod/app/web", run.PlanRecord{End: t3, Branch: "other", Workspace: "default", Plan: planWith(tfjson.ActionCreate)}},
+		{"staging/network", run.PlanRecord{End: t1, Branch: "main", Workspace: "default", Plan: planWith(tfjson.ActionCreate)}},
+	}
+
+	for _, r := range records {
+		r := r
+		require.NoError(t, storage.Store(ParseKey(r.key), &r.r))
+	}
+
+	set, err := storage.Summary(ParseKey("prod"), "main", "default")
+	require.NoError(t, err)
+
+	assert.Equal(t, "prod", set.Name)
+	assert.Equal(t, t2, set.Oldest)
+	assert.Equal(t, t3, set.Newest)
+	assert.False(t, set.UpToDate)
+	assert.Equal(t, 0, set.Changes.Added)
+	assert.Equal(t, 1, set.Changes.Updated)
+	assert.Equal(t, 1, set.Changes.Deleted)
+
+	require.Equal(t, 2, len(set.Records))
+
+	app := set.Records[0]
+	assert.Equal(t, "app", app.Name)
+	assert.True(t, app.UpToDate)
+	require.Equal(t, 1, len(app.Records))
+	assert.Equal(t, "web", app.Records[0].Name)
+
+	network := set.Records[1]
+	assert.Equal(t, "network", network.Name)
+	assert.Equal(t, t3, network.Oldest)
+	require.Equal(t, 1, len(network.Records))
+	assert.Equal(t, "network", network.Records[0].Name)
+	assert.Equal(t, "-.null_resource.a\n~.null_resource.b", network.Records[0].ChangedResources)
+}
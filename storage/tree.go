@@ -0,0 +1,167 @@
+package storage
+
+import (
+	"github.com/deweysasser/olympus/git"
+	"github.com/deweysasser/olympus/terraform"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"sort"
+)
+
+// legacyReader is a backend which may also hold plans saved before there were records
+type legacyReader interface {
+	// legacyPlans returns the files of the legacy plans at or below key, by the key of their component
+	legacyPlans(key Key) (map[string][]string, error)
+}
+
+// Tree summarizes what is stored at or below key on the branch for display.  There is a directory for each part of
+// the keys below key, and each component shows the newest run of each of its workspaces.  Plans saved before there
+// were records, and records of components which aren't in git, have no branch, so are shown for any.  If there is
+// nothing, the error is ErrNotFound.
+func (s *Storage) Tree(key Key, branch git.Branch) (*terraform.PlanDir, error) {
+	all, err := s.List(key)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+
+	var entries []Entry
+	for _, e := range all {
+		if e.Branch == branch || e.Branch == "" {
+			entries = append(entries, e)
+		}
+	}
+
+	root := &treeNode{}
+	if len(key) > 0 {
+		root.name = key[len(key)-1]
+	}
+
+	for _, history := range histories(entries) {
+		e := history[0]
+
+		summary, err := terraform.History(len(history), func(i int) (terraform.PlanSummary, error) {
+			return s.summary(history[i], string(e.Workspace))
+		})
+		if err != nil {
+			log.Error().Err(err).Str("key", e.Key.String()).Msg("Error reading plan")
+			continue
+		}
+
+		node := root.find(e.Key[len(key):])
+		node.summaries = append(node.summaries, summary)
+	}
+
+	if l, ok := s.Backend.(legacyReader); ok {
+		plans, err := l.legacyPlans(key)
+		if err != nil {
+			return nil, err
+		}
+		for component, files := range plans {
+			var k Key
+			if component != "." {
+				k = ParseKey(component)
+			}
+			node := root.find(k[len(key):])
+			for _, file := range files {
+				if summary, err := terraform.ReadPlan(file); err == nil {
+					node.summaries = append(node.summaries, summary)
+				}
+			}
+		}
+	}
+
+	if len(root.children) == 0 && len(root.summaries) == 0 {
+		return nil, ErrNotFound
+	}
+
+	return root.dir(), nil
+}
+
+// summary reads the record of the entry and summarizes it under the given name
+func (s *Storage) summary(e Entry, name string) (terraform.PlanSummary, error) {
+	r, err := s.Get(e)
+	if err != nil {
+		return nil, err
+	}
+
+	envelope := terraform.Envelope{
+		Plan:      r.Plan,
+		End:       r.End,
+		Workspace: r.Workspace,
+		Command:   r.Command,
+		Output:    r.Output,
+		Succeeded: r.Succeeded,
+		Failure:   r.Failure,
+		Lock:      r.Lock,
+	}
+
+	return envelope.Summary(name), nil
+}
+
+// histories splits the entries into the runs of each component in each workspace, newest first
+func histories(entries []Entry) [][]Entry {
+	index := make(map[string][]Entry)
+	for _, e := range entries {
+		id := e.Key.String() + "\x00" + string(e.Workspace)
+		index[id] = append(index[id], e)
+	}
+
+	var ids []string
+	for id := range index {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var result [][]Entry
+	for _, id := range ids {
+		history := index[id]
+		sort.Slice(history, func(i, j int) bool {
+			return history[i].Time.After(history[j].Time)
+		})
+		result = append(result, history)
+	}
+
+	return result
+}
+
+// treeNode gathers the summaries at one part of a key
+type treeNode struct {
+	name      string
+	children  map[string]*treeNode
+	summaries []terraform.PlanSummary
+}
+
+// find returns the node at the relative key, creating it if necessary
+func (n *treeNode) find(rel Key) *treeNode {
+	if len(rel) == 0 {
+		return n
+	}
+
+	if n.children == nil {
+		n.children = make(map[string]*treeNode)
+	}
+
+	child, ok := n.children[rel[0]]
+	if !ok {
+		child = &treeNode{name: rel[0]}
+		n.children[rel[0]] = child
+	}
+
+	return child.find(rel[1:])
+}
+
+// dir converts the node and everything below it into a summary
+func (n *treeNode) dir() *terraform.PlanDir {
+	var names []string
+	for name := range n.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var children []terraform.PlanSummary
+	for _, name := range names {
+		children = append(children, n.children[name].dir())
+	}
+
+	return terraform.NewPlanDir(n.name, append(children, n.summaries...)...)
+}
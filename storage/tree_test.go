@@ -0,0 +1,189 @@
+package storage
+
+import (
+	"github.com/deweysasser/olympus/compression"
+	"github.com/deweysasser/olympus/run"
+	"github.com/deweysasser/olympus/terraform"
+	tfjson "github.com/hashicorp/terraform-json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStorage_Tree(t *testing.T) {
+	t1 := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	t2 := t1.Add(time.Hour)
+
+	for name, create := range backends {
+		t.Run(name, func(t *testing.T) {
+			s := &Storage{Backend: create(t)}
+
+			for _, r := range []struct {
+				key string
+				r   run.PlanRecord
+			}{
+				{"prod/network", run.PlanRecord{End: t1, Branch: "main", Workspace: "default", Succeeded: true, Plan: planWith(tfjson.ActionCreate)}},
+				{"prod/network", run.PlanRecord{End: t2, Branch: "main", Workspace: "default", Succeeded: true, Plan: planWith(tfjson.ActionDelete)}},
+				{"prod/app/web", run.PlanRecord{End: t1, Branch: "main", Workspace: "default", Succeeded: true, Plan: planWith()}},
+				{"prod/app/web", run.PlanRecord{End: t2, Branch: "main", Workspace: "default", Failure: terraform.FailureLock, Lock: &terraform.LockInfo{ID: "1"}}},
+				{"prod/network", run.PlanRecord{End: t2.Add(time.Hour), Branch: "feature", Workspace: "default", Succeeded: true, Plan: planWith(tfjson.ActionCreate, tfjson.ActionCreate)}},
+				{"staging/network", run.PlanRecord{End: t1, Branch: "main", Workspace: "default", Command: "terraform plan", Output: "Error: broken", Failure: terraform.FailureError}},
+			} {
+				r := r
+				require.NoError(t, s.Store(ParseKey(r.key), &r.r))
+			}
+
+			tree, err := s.Tree(Key{}, "main")
+			require.NoError(t, err)
+			require.Equal(t, 2, len(tree.Children()))
+
+			prod := tree.Children()[0]
+			assert.Equal(t, "prod", prod.Name())
+			require.Equal(t, 2, len(prod.Children()))
+
+			app, network := prod.Children()[0], prod.Children()[1]
+			assert.Equal(t, "app", app.Name())
+			assert.True(t, app.UpToDate(), "the plan before the lock failure")
+			assert.Equal(t, 1, app.LockFailures())
+			assert.Equal(t, "network", network.Name())
+			assert.Equal(t, 0, network.Changes().Added)
+			assert.Equal(t, 1, network.Changes().Deleted)
+
+			assert.True(t, tree.Children()[1].Failed())
+
+			tree, err = s.Tree(Key{}, "feature")
+			require.NoError(t, err)
+			require.Equal(t, 1, len(tree.Children()))
+			assert.Equal(t, 2, tree.Changes().Added)
+
+			_, err = s.Tree(ParseKey("staging"), "feature")
+			assert.ErrorIs(t, err, ErrNotFound)
+
+			tree, err = s.Tree(ParseKey("prod/app"), "main")
+			require.NoError(t, err)
+			assert.Equal(t, "app", tree.Name())
+			assert.Equal(t, 1, len(tree.Children()))
+		})
+	}
+}
+
+func TestStorage_Tree_legacy(t *testing.T) {
+	dir := t.TempDir()
+	s := New(dir)
+
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "prod", "old"), os.ModePerm))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "prod", "old", "plan.json"), []byte(`{"format_version": "1.1"}`), 0644))
+
+	// Records supersede older plans of the same component
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "prod", "new"), os.ModePerm))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "prod", "new", "plan.json"), []byte(`{"format_version": "1.1"}`), 0644))
+	require.NoError(t, s.Store(ParseKey("prod/new"), &run.PlanRecord{End: time.Now(), Branch: "main", Workspace: "default", Succeeded: true, Plan: planWith()}))
+
+	// Records of components which aren't in git have no branch either, so are shown for any
+	require.NoError(t, s.Store(ParseKey("prod/local"), &run.PlanRecord{End: time.Now(), Workspace: "default", Succeeded: true, Plan: planWith()}))
+
+	tree, err := s.Tree(ParseKey("prod"), "main")
+	require.NoError(t, err)
+	require.Equal(t, 3, len(tree.Children()))
+
+	for _, c := range tree.Children() {
+		require.Equal(t, 1, len(c.Children()), c.Name())
+		assert.True(t, c.UpToDate(), c.Name())
+	}
+}
+
+func TestStorage_Tree_workspaces(t *testing.T) {
+	t1 := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for name, create := range backends {
+		t.Run(name, func(t *testing.T) {
+			s := &Storage{Backend: create(t)}
+
+			for _, r := range []run.PlanRecord{
+				{End: t1, Branch: "main", Workspace: "staging", Succeeded: true, Plan: planWith(tfjson.ActionDelete)},
+				{End: t1.Add(time.Hour), Branch: "main", Workspace: "staging", Succeeded: true, Plan: planWith(tfjson.ActionCreate)},
+				{End: t1.Add(2 * time.Hour), Branch: "main", Workspace: "prod", Succeeded: true, Plan: planWith(tfjson.ActionDelete)},
+				{End: t1, Branch: "main", Workspace: "default", Command: "terraform plan", Output: "Error: broken", Failure: terraform.FailureError},
+			} {
+				r := r
+				require.NoError(t, s.Store(ParseKey("app"), &r))
+			}
+
+			tree, err := s.Tree(Key{}, "main")
+			require.NoError(t, err)
+			require.Equal(t, 1, len(tree.Children()))
+
+			app := tree.Children()[0]
+			assert.Equal(t, 3, len(app.Children()), "the newest record of each workspace")
+			assert.Equal(t, 1, app.Changes().Added, "staging")
+			assert.Equal(t, 1, app.Changes().Deleted, "prod")
+			assert.True(t, app.Failed(), "default")
+		})
+	}
+}
+
+func TestStorage_Tree_compressed(t *testing.T) {
+	t1 := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for name, create := range backends {
+		t.Run(name, func(t *testing.T) {
+			s := &Storage{Backend: create(t)}
+
+			require.NoError(t, s.Store(ParseKey("staging/network"), &run.PlanRecord{End: t1, Branch: "main", Workspace: "default", Succeeded: true, Plan: planWith()}))
+			s.Compress(compression.Zstd)
+			require.NoError(t, s.Store(ParseKey("staging/network"), &run.PlanRecord{End: t1.Add(time.Hour), Branch: "main", Workspace: "default", Succeeded: true, Plan: planWith(tfjson.ActionCreate)}))
+
+			tree, err := s.Tree(Key{}, "main")
+			require.NoError(t, err)
+			assert.Equal(t, 1, tree.Changes().Added, "the newest record is read although it is compressed")
+		})
+	}
+}
+
+func TestStorage_Tree_locks(t *testing.T) {
+	locked := run.PlanRecord{Failure: terraform.FailureLock, Lock: &terraform.LockInfo{ID: "abc", Who: "someone", Created: time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)}}
+	lockedOldAgent := run.PlanRecord{Output: "Error: Error acquiring the state lock\nLock Info:\n  ID:        def\n"}
+	failed := run.PlanRecord{Failure: terraform.FailureError, Command: "terraform plan", Output: "Error: broken"}
+	planned := run.PlanRecord{Succeeded: true, Plan: planWith(tfjson.ActionCreate)}
+
+	tests := []struct {
+		name         string
+		records      []run.PlanRecord // oldest first
+		lockFailures int
+		failed       bool
+		added        int
+	}{
+		{name: "no locks", records: []run.PlanRecord{locked, planned}, lockFailures: 0, added: 1},
+		{name: "locked after plan", records: []run.PlanRecord{planned, locked, lockedOldAgent}, lockFailures: 2, added: 1},
+		{name: "locked after failure", records: []run.PlanRecord{failed, locked}, lockFailures: 1, failed: true},
+		{name: "only locks", records: []run.PlanRecord{locked, locked, locked}, lockFailures: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New(t.TempDir())
+			start := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+			for i, r := range tt.records {
+				r.End = start.Add(time.Duration(i) * time.Hour)
+				r.Branch = "main"
+				r.Workspace = "default"
+				require.NoError(t, s.Store(ParseKey("app"), &r))
+			}
+
+			sum, err := s.Tree(ParseKey("app"), "main")
+			require.NoError(t, err)
+			require.Equal(t, 1, len(sum.Children()))
+
+			assert.Equal(t, tt.lockFailures, sum.LockFailures())
+			assert.Equal(t, tt.failed, sum.Failed())
+			assert.Equal(t, tt.added, sum.Changes().Added)
+			if tt.lockFailures > 0 {
+				require.NotNil(t, sum.Lock())
+			} else {
+				assert.Nil(t, sum.Lock())
+			}
+		})
+	}
+}
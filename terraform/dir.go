@@ -15,6 +15,40 @@ type PlanDir struct {
 	children []PlanSummary
 }
 
+// ByWorkspace splits a summary into one for each workspace planned in below it, each summarizing only the plans of
+// that workspace
+func ByWorkspace(s PlanSummary) map[Workspace]PlanSummary {
+	dir, ok := s.(*PlanDir)
+	if !ok {
+		if j, ok := s.(*JSonPlanSummary); ok {
+			return map[Workspace]PlanSummary{j.Workspace(): j}
+		}
+		return map[Workspace]PlanSummary{DefaultWorkspace: s}
+	}
+
+	children := make(map[Workspace][]PlanSummary)
+	for _, c := range dir.children {
+		for w, part := range ByWorkspace(c) {
+			children[w] = append(children[w], part)
+		}
+	}
+
+	if len(children) == 0 {
+		return map[Workspace]PlanSummary{DefaultWorkspace: s}
+	}
+
+	result := make(map[Workspace]PlanSummary)
+	for w, c := range children {
+		result[w] = NewPlanDir(dir.name, c...)
+	}
+	return result
+}
+
+// NewPlanDir creates a summary of the children
+func NewPlanDir(name string, children ...PlanSummary) *PlanDir {
+	return &PlanDir{name: name, children: children}
+}
+
 func (p *PlanDir) Name() string {
 	return p.name
 }
@@ -46,6 +80,76 @@ func (p *PlanDir) ChangedResources() string {
 	return strings.Join(resources, "\n")
 }
 
+func (p *PlanDir) Failed() bool {
+	for _, c := range p.children {
+		if c.Failed() {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *PlanDir) Failure() string {
+	var failures []string
+
+	for _, c := range p.children {
+		if c.Failed() {
+			failures = append(failures, c.Failure())
+		}
+	}
+
+	return strings.Join(failures, "\n")
+}
+
+func (p *PlanDir) LockFailures() int {
+	most := 0
+
+	for _, c := range p.children {
+		if n := c.LockFailures(); n > most {
+			most = n
+		}
+	}
+
+	return most
+}
+
+func (p *PlanDir) Lock() *LockInfo {
+	var oldest *LockInfo
+
+	for _, c := range p.children {
+		if l := c.Lock(); l != nil && (oldest == nil || l.Created.Before(oldest.Created)) {
+			oldest = l
+		}
+	}
+
+	return oldest
+}
+
+func (p *PlanDir) Oldest() time.Time {
+	var oldest time.Time
+
+	for _, c := range p.children {
+		if t := c.Oldest(); !t.IsZero() && (oldest.IsZero() || t.Before(oldest)) {
+			oldest = t
+		}
+	}
+
+	return oldest
+}
+
+func (p *PlanDir) Newest() time.Time {
+	var newest time.Time
+
+	for _, c := range p.children {
+		if t := c.Newest(); t.After(newest) {
+			newest = t
+		}
+	}
+
+	return newest
+}
+
 func (p *PlanDir) UpToDate() bool {
 	for _, c := range p.children {
 		if !c.UpToDate() {
@@ -89,6 +193,56 @@ func ReadDir(dir string) (*PlanDir, error) {
 	return result, nil
 }
 
+// maxLockHistory is how far back to look for a run which was not blocked by a state lock
+const maxLockHistory = 50
+
+// History chooses what to show for a component from its count runs, which read returns newest first.  If the newest
+// run could not acquire the state lock, the newest run which did not have that problem is used instead, counting the
+// lock failures since.  Only as many runs as needed are read.
+func History(count int, read func(i int) (PlanSummary, error)) (PlanSummary, error) {
+	var head *JSonPlanSummary
+	failures := 0
+
+	for i := 0; i < count && failures < maxLockHistory; i++ {
+		c, err := read(i)
+		if err != nil {
+			return nil, err
+		}
+
+		j, ok := c.(*JSonPlanSummary)
+		if !ok {
+			return c, nil
+		}
+
+		if head == nil {
+			head = j
+		}
+
+		if j.lock == nil {
+			if failures == 0 {
+				return j, nil
+			}
+			// Summaries are cached, so copy before changing
+			result := *j
+			result.lock = head.lock
+			result.lockFailures = failures
+			return &result, nil
+		}
+
+		failures++
+	}
+
+	if head == nil {
+		return nil, os.ErrNotExist
+	}
+
+	// Nothing but lock failures, so there has never been a plan to speak of
+	result := *head
+	result.lockFailures = failures
+	result.time = time.Time{}
+	return &result, nil
+}
+
 type cacheEntry struct {
 	plan     PlanSummary
 	fileTime time.Time
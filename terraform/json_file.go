@@ -3,12 +3,14 @@ package terraform
 import (
 	"encoding/json"
 	"fmt"
+	"github.com/deweysasser/olympus/compression"
 	tfjson "github.com/hashicorp/terraform-json"
 	"github.com/pkg/errors"
 	"io"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 type PlanSummary interface {
@@ -19,6 +21,18 @@ type PlanSummary interface {
 	UpToDate() bool
 	Children() []PlanSummary
 	ChangedResources() string
+	// Failed is true if the most recent attempt to plan failed
+	Failed() bool
+	// Failure describes why planning failed
+	Failure() string
+	// LockFailures is the number of most recent consecutive runs which could not acquire the state lock
+	LockFailures() int
+	// Lock describes the oldest state lock blocking the most recent runs
+	Lock() *LockInfo
+	// Oldest is the time of the oldest plan included in the summary
+	Oldest() time.Time
+	// Newest is the time of the newest plan included in the summary
+	Newest() time.Time
 }
 
 func (j *JSonPlanSummary) Children() []PlanSummary {
@@ -28,7 +42,23 @@ func (j *JSonPlanSummary) Children() []PlanSummary {
 // JSonPlanSummary is a summary based on the actual terraform plan
 type JSonPlanSummary struct {
 	*tfjson.Plan
-	name string
+	name         string
+	planned      bool
+	failed       bool
+	failure      string
+	lock         *LockInfo
+	lockFailures int
+	time         time.Time
+	workspace    Workspace
+}
+
+// NewPlanSummary creates a summary for an already parsed plan
+func NewPlanSummary(name string, plan *tfjson.Plan) *JSonPlanSummary {
+	return &JSonPlanSummary{
+		Plan:    plan,
+		name:    name,
+		planned: true,
+	}
 }
 
 func (j *JSonPlanSummary) ChangedResources() string {
@@ -92,12 +122,115 @@ func (j *JSonPlanSummary) Changes() Changes {
 }
 
 func (j *JSonPlanSummary) UpToDate() bool {
-	return len(j.ResourceChanges) == 0
+	return j.planned && !j.failed && len(j.ResourceChanges) == 0
 }
 
-func ReadPlan(file string) (PlanSummary, error) {
-	sum := &tfjson.Plan{}
+func (j *JSonPlanSummary) Failed() bool {
+	return j.failed
+}
+
+func (j *JSonPlanSummary) Failure() string {
+	return j.failure
+}
+
+func (j *JSonPlanSummary) LockFailures() int {
+	return j.lockFailures
+}
+
+func (j *JSonPlanSummary) Lock() *LockInfo {
+	return j.lock
+}
+
+func (j *JSonPlanSummary) Oldest() time.Time {
+	return j.time
+}
+
+func (j *JSonPlanSummary) Newest() time.Time {
+	return j.time
+}
+
+// Workspace is the workspace the plan was made in.  Plans which don't say were made in the default workspace.
+func (j *JSonPlanSummary) Workspace() Workspace {
+	if j.workspace == "" {
+		return DefaultWorkspace
+	}
+	return j.workspace
+}
+
+// Envelope is the part of a run record which is needed to display it.  (The run package depends on this one, so
+// can't be used here.)
+type Envelope struct {
+	Plan      *tfjson.Plan `json:"plan,omitempty"`
+	End       time.Time    `json:"end-time"`
+	Workspace Workspace    `json:"workspace"`
+	Command   string       `json:"command"`
+	Output    string       `json:"output,omitempty"`
+	Succeeded bool         `json:"success"`
+	Failure   FailureClass `json:"failure,omitempty"`
+	Lock      *LockInfo    `json:"lock,omitempty"`
+}
+
+// failed is true if the record describes a failed run other than failing to get the state lock.  Older agents never
+// claimed success, but always sent a plan.
+func (e *Envelope) failed() bool {
+	return !e.Succeeded && e.Plan == nil && e.lock() == nil
+}
+
+// lock returns the lock which prevented the run, if any
+func (e *Envelope) lock() *LockInfo {
+	switch {
+	case e.Succeeded || e.Plan != nil:
+		return nil
+	case e.Lock != nil:
+		return e.Lock
+	case e.Failure == "":
+		// Older agents didn't classify failures
+		return ParseLock(e.Output)
+	default:
+		return nil
+	}
+}
 
+// failure describes why the run failed
+func (e *Envelope) failure() string {
+	if !e.failed() {
+		return ""
+	}
+	return strings.TrimSpace(fmt.Sprintf("%s\n%s", e.Command, e.Output))
+}
+
+// Summary summarizes the run described by the envelope, removing anything sensitive from its plan
+func (e *Envelope) Summary(name string) *JSonPlanSummary {
+	sum := e.Plan
+	if sum == nil {
+		sum = &tfjson.Plan{}
+	}
+
+	// Variables may be sensitive, so we don't want them.  They should not have been sent in the first place.
+	sum.Variables = make(map[string]*tfjson.PlanVariable)
+	// Nor should sensitive values, but older agents sent them
+	Redact(sum)
+
+	result := &JSonPlanSummary{
+		Plan:      sum,
+		name:      name,
+		planned:   e.Plan != nil,
+		failed:    e.failed(),
+		failure:   e.failure(),
+		lock:      e.lock(),
+		time:      e.End,
+		workspace: e.Workspace,
+	}
+
+	if result.lock != nil {
+		result.lockFailures = 1
+	}
+
+	return result
+}
+
+// ReadPlan reads either a bare terraform JSON plan or a plan record containing one
+func ReadPlan(file string) (PlanSummary, error) {
 	f, err := os.Open(file)
 
 	if err != nil {
@@ -107,21 +240,41 @@ func ReadPlan(file string) (PlanSummary, error) {
 	defer f.Close()
 
 	bytes, err := io.ReadAll(f)
+	if err == nil {
+		bytes, err = compression.Decompress(bytes)
+	}
 
 	if err != nil {
 		return nil, err
 	}
 
-	err = json.Unmarshal(bytes, sum)
+	var probe map[string]json.RawMessage
+	err = json.Unmarshal(bytes, &probe)
 	if err != nil {
 		return nil, errors.Wrap(err, fmt.Sprintf("while reading file %s:", file))
 	}
 
-	// Variables may be sensitive, so we don't want them.  They should not have been sent in the first place.
-	sum.Variables = make(map[string]*tfjson.PlanVariable)
+	var envelope Envelope
+	if _, bare := probe["format_version"]; bare {
+		envelope.Succeeded = true
+		envelope.Plan = &tfjson.Plan{}
+		err = json.Unmarshal(bytes, envelope.Plan)
+	} else {
+		err = json.Unmarshal(bytes, &envelope)
+	}
 
-	return &JSonPlanSummary{
-		Plan: sum,
-		name: filepath.Base(file),
-	}, nil
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("while reading file %s:", file))
+	}
+
+	result := envelope.Summary(filepath.Base(file))
+
+	// Bare plans don't say when they were made, so the best we can do is when they were received
+	if result.time.IsZero() {
+		if info, err := f.Stat(); err == nil {
+			result.time = info.ModTime()
+		}
+	}
+
+	return result, nil
 }
@@ -3,7 +3,11 @@ package terraform
 import (
 	tfjson "github.com/hashicorp/terraform-json"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestReadPlan(t *testing.T) {
@@ -29,3 +33,61 @@ func TestReadPlan(t *testing.T) {
 	assert.True(t, c.HasAny())
 	assert.Equal(t, "deleted", c.Highest())
 }
+
+func TestReadPlan_formats(t *testing.T) {
+	dir := t.TempDir()
+	plan := `{"format_version": "1.1", "resource_changes": [{"type": "null_resource", "name": "a", "change": {"actions": ["create"]}}]}`
+
+	tests := []struct {
+		name    string
+		content string
+		added   int
+		failure string
+	}{
+		{name: "bare plan", content: plan, added: 1},
+		{name: "plan record", content: `{"plan": ` + plan + `, "branch": "main", "success": true}`, added: 1},
+		{name: "old agent plan record", content: `{"plan": ` + plan + `, "branch": "main"}`, added: 1},
+		{name: "failed record", content: `{"branch": "main", "command": "terraform plan", "output": "Error: broken", "success": false}`, failure: "terraform plan\nError: broken"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(dir, "plan.json")
+			require.NoError(t, os.WriteFile(file, []byte(tt.content), 0644))
+
+			sum, err := ReadPlan(file)
+			require.NoError(t, err)
+			assert.Equal(t, tt.added, sum.Changes().Added)
+			assert.Equal(t, tt.failure != "", sum.Failed())
+			assert.Equal(t, tt.failure, sum.Failure())
+			if sum.Failed() {
+				assert.False(t, sum.UpToDate())
+			}
+		})
+	}
+
+	file := filepath.Join(dir, "bad.json")
+	require.NoError(t, os.WriteFile(file, []byte("not json"), 0644))
+	_, err := ReadPlan(file)
+	assert.Error(t, err)
+}
+
+func TestReadPlan_time(t *testing.T) {
+	dir := t.TempDir()
+
+	file := filepath.Join(dir, "record.json")
+	require.NoError(t, os.WriteFile(file, []byte(`{"end-time": "2000-01-02T03:04:05Z", "success": true, "plan": {"format_version": "1.1"}}`), 0644))
+
+	sum, err := ReadPlan(file)
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2000, 1, 2, 3, 4, 5, 0, time.UTC), sum.Oldest())
+	assert.Equal(t, sum.Oldest(), sum.Newest())
+
+	file = filepath.Join(dir, "plan.json")
+	require.NoError(t, os.WriteFile(file, []byte(`{"format_version": "1.1"}`), 0644))
+	modified := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+	require.NoError(t, os.Chtimes(file, modified, modified))
+
+	sum, err = ReadPlan(file)
+	require.NoError(t, err)
+	assert.True(t, modified.Equal(sum.Oldest()))
+}
@@ -0,0 +1,107 @@
+package terraform
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// FailureClass distinguishes the reasons a plan can fail
+type FailureClass string
+
+const (
+	// FailureLock means the plan could not acquire the state lock, which usually resolves itself
+	FailureLock FailureClass = "lock"
+	// FailureError is any other failure
+	FailureError FailureClass = "error"
+)
+
+// LockInfo describes the holder of a terraform state lock
+type LockInfo struct {
+	ID        string    `json:"id"`
+	Path      string    `json:"path,omitempty"`
+	Operation string    `json:"operation,omitempty"`
+	Who       string    `json:"who,omitempty"`
+	Version   string    `json:"version,omitempty"`
+	Created   time.Time `json:"created,omitempty"`
+}
+
+// lockCreatedFormat is how terraform shows lock creation times (go's default time format)
+const lockCreatedFormat = "2006-01-02 15:04:05.999999999 -0700 MST"
+
+var lockField = regexp.MustCompile(`^(ID|Path|Operation|Who|Version|Created):\s*(.*?)\s*$`)
+
+// ParseLock finds the lock information in the output of a terraform command which failed to acquire the state lock.
+// It returns nil if the output does not describe a lock failure.
+func ParseLock(output string) *LockInfo {
+	if !strings.Contains(output, "Error acquiring the state lock") {
+		return nil
+	}
+
+	lock := &LockInfo{}
+
+	var lines []string
+	for _, line := range strings.Split(output, "\n") {
+		// Newer versions of terraform draw a box around errors
+		lines = append(lines, strings.TrimSpace(strings.TrimLeft(line, "│ \t")))
+	}
+
+	for i, line := range lines {
+		if line != "Lock Info:" {
+			continue
+		}
+
+		for _, field := range lines[i+1:] {
+			m := lockField.FindStringSubmatch(field)
+			if m == nil {
+				continue
+			}
+			switch m[1] {
+			case "ID":
+				lock.ID = m[2]
+			case "Path":
+				lock.Path = m[2]
+			case "Operation":
+				lock.Operation = m[2]
+			case "Who":
+				lock.Who = m[2]
+			case "Version":
+				lock.Version = m[2]
+			case "Created":
+				if t, err := time.Parse(lockCreatedFormat, m[2]); err == nil {
+					lock.Created = t
+				}
+			}
+		}
+		break
+	}
+
+	return lock
+}
+
+// HeldFor returns how long the lock has been held, or zero if that is unknown
+func (l *LockInfo) HeldFor(now time.Time) time.Duration {
+	if l == nil || l.Created.IsZero() {
+		return 0
+	}
+	return now.Sub(l.Created)
+}
+
+func (l *LockInfo) String() string {
+	if l == nil {
+		return ""
+	}
+
+	s := fmt.Sprintf("state locked by %s", l.Who)
+	if l.Operation != "" {
+		s += " for " + l.Operation
+	}
+	if !l.Created.IsZero() {
+		s += " since " + l.Created.UTC().Format(time.RFC3339)
+	}
+	if l.ID != "" {
+		s += " (lock ID " + l.ID + ")"
+	}
+	return s
+}
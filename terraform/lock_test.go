@@ -0,0 +1,44 @@
+package terraform
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+const lockOutput = `Acquiring state lock. This may take a few moments...
+╷
+│ Error: Error acquiring the state lock
+│
+│ Error message: ConditionalCheckFailedException: The conditional request failed
+│ Lock Info:
+│   ID:        8c1e2b3a-1111-2222-3333-444455556666
+│   Path:      my-bucket/network/terraform.tfstate
+│   Operation: OperationTypePlan
+│   Who:       someone@build-host
+│   Version:   1.3.2
+│   Created:   2022-10-10 12:34:56.789012 +0000 UTC
+│   Info:
+│
+│ Terraform acquires a state lock to protect the state from being written
+│ by multiple users at the same time.
+╵
+`
+
+func TestParseLock(t *testing.T) {
+	lock := ParseLock(lockOutput)
+	require.NotNil(t, lock)
+
+	assert.Equal(t, "8c1e2b3a-1111-2222-3333-444455556666", lock.ID)
+	assert.Equal(t, "my-bucket/network/terraform.tfstate", lock.Path)
+	assert.Equal(t, "OperationTypePlan", lock.Operation)
+	assert.Equal(t, "someone@build-host", lock.Who)
+	assert.Equal(t, "1.3.2", lock.Version)
+	assert.Equal(t, time.Date(2022, 10, 10, 12, 34, 56, 789012000, time.UTC), lock.Created.UTC())
+
+	assert.Equal(t, time.Hour, lock.HeldFor(lock.Created.Add(time.Hour)))
+	assert.Equal(t, "state locked by someone@build-host for OperationTypePlan since 2022-10-10T12:34:56Z (lock ID 8c1e2b3a-1111-2222-3333-444455556666)", lock.String())
+
+	assert.Nil(t, ParseLock("Error: Invalid provider configuration"))
+}
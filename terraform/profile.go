@@ -0,0 +1,58 @@
+package terraform
+
+import (
+	"fmt"
+	tfjson "github.com/hashicorp/terraform-json"
+)
+
+// Profile decides how much of a plan is uploaded.  Whatever the server doesn't need is better never sent: it can only
+// leak, and it makes large plans much larger.
+type Profile string
+
+const (
+	// ProfileFull sends the whole plan
+	ProfileFull Profile = "full"
+	// ProfileDiffOnly sends only the changes, without the prior state, configuration and planned values
+	ProfileDiffOnly Profile = "diff-only"
+	// ProfileMinimal sends only which resources and outputs change and how, without any of their values
+	ProfileMinimal Profile = "minimal"
+)
+
+// Validate returns an error if the profile is not one of the known ones.  The empty profile means the default,
+// diff-only.
+func (p Profile) Validate() error {
+	switch p {
+	case "", ProfileFull, ProfileDiffOnly, ProfileMinimal:
+		return nil
+	default:
+		return fmt.Errorf("unknown upload profile %s (expected %s, %s or %s)", p, ProfileMinimal, ProfileDiffOnly, ProfileFull)
+	}
+}
+
+// Strip removes the parts of the plan which the profile does not send
+func (p Profile) Strip(plan *tfjson.Plan) {
+	if plan == nil || p == ProfileFull {
+		return
+	}
+
+	plan.PriorState = nil
+	plan.Config = nil
+	plan.PlannedValues = nil
+	plan.RelevantAttributes = nil
+
+	if p != ProfileMinimal {
+		return
+	}
+
+	for _, rc := range plan.ResourceChanges {
+		if rc != nil && rc.Change != nil {
+			rc.Change = &tfjson.Change{Actions: rc.Change.Actions}
+		}
+	}
+
+	for name, c := range plan.OutputChanges {
+		if c != nil {
+			plan.OutputChanges[name] = &tfjson.Change{Actions: c.Actions}
+		}
+	}
+}
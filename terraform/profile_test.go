@@ -0,0 +1,68 @@
+package terraform
+
+import (
+	"encoding/json"
+	tfjson "github.com/hashicorp/terraform-json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestProfile_Strip(t *testing.T) {
+	read := func() *tfjson.Plan {
+		plan := &tfjson.Plan{}
+		require.NoError(t, json.Unmarshal([]byte(sensitivePlan), plan))
+		require.NotNil(t, plan.PriorState)
+		require.NotNil(t, plan.Config)
+		require.NotNil(t, plan.PlannedValues)
+		return plan
+	}
+
+	full := read()
+	ProfileFull.Strip(full)
+	assert.NotNil(t, full.PriorState)
+	assert.NotNil(t, full.Config)
+	assert.NotNil(t, full.PlannedValues)
+
+	for _, p := range []Profile{ProfileDiffOnly, ""} {
+		plan := read()
+		p.Strip(plan)
+		assert.Nil(t, plan.PriorState)
+		assert.Nil(t, plan.Config)
+		assert.Nil(t, plan.PlannedValues)
+		assert.NotNil(t, plan.ResourceChanges[0].Change.After)
+	}
+
+	minimal := read()
+	before := NewPlanSummary("x", read())
+	ProfileMinimal.Strip(minimal)
+	assert.Nil(t, minimal.PriorState)
+	require.NotEmpty(t, minimal.ResourceChanges)
+	for _, rc := range minimal.ResourceChanges {
+		assert.NotEmpty(t, rc.Change.Actions)
+		assert.Nil(t, rc.Change.Before)
+		assert.Nil(t, rc.Change.After)
+		assert.Nil(t, rc.Change.AfterSensitive)
+	}
+	for _, c := range minimal.OutputChanges {
+		assert.Nil(t, c.After)
+	}
+
+	// Variables are removed whatever the profile
+	minimal.Variables = nil
+	b, err := json.Marshal(minimal)
+	require.NoError(t, err)
+	assert.NotContains(t, string(b), "hunter2")
+
+	// Nothing the UI shows is lost
+	after := NewPlanSummary("x", minimal)
+	assert.Equal(t, before.Changes(), after.Changes())
+	assert.Equal(t, before.ChangedResources(), after.ChangedResources())
+}
+
+func TestProfile_Validate(t *testing.T) {
+	for _, p := range []Profile{"", ProfileFull, ProfileDiffOnly, ProfileMinimal} {
+		assert.NoError(t, p.Validate(), p)
+	}
+	assert.Error(t, Profile("everything").Validate())
+}
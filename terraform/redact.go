@@ -0,0 +1,363 @@
+package terraform
+
+import (
+	"encoding/json"
+	"fmt"
+	tfjson "github.com/hashicorp/terraform-json"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Redacted replaces sensitive values
+const Redacted = "[REDACTED]"
+
+// reasonSensitive is the reason given for values terraform marked as sensitive
+const reasonSensitive = "sensitive"
+
+// RedactionRule removes values which terraform does not know are sensitive
+type RedactionRule struct {
+	// Type is a pattern of the resource types the rule applies to.  Rules without one apply to everything, including
+	// outputs.
+	Type string `yaml:"type,omitempty"`
+	// Attribute is a dotted path of the attribute to remove, e.g. "user_data" or "tags.*".  Each part may be a pattern,
+	// and list elements are numbered from 0.
+	Attribute string `yaml:"attribute,omitempty"`
+	// Value is a regular expression.  Matching parts of string values are replaced, rather than whole attributes.
+	Value string `yaml:"value,omitempty"`
+
+	attribute []string
+	value     *regexp.Regexp
+}
+
+// Compile checks the rule and prepares it for use
+func (r *RedactionRule) Compile() error {
+	if r.Attribute == "" && r.Value == "" {
+		return fmt.Errorf("redaction rule needs an attribute or a value")
+	}
+
+	for _, p := range []string{r.Type, r.Attribute} {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("bad pattern %s: %w", p, err)
+		}
+	}
+
+	if r.Attribute != "" {
+		r.attribute = strings.Split(r.Attribute, ".")
+	}
+
+	if r.Value != "" {
+		re, err := regexp.Compile(r.Value)
+		if err != nil {
+			return fmt.Errorf("bad value expression %s: %w", r.Value, err)
+		}
+		r.value = re
+	}
+
+	return nil
+}
+
+func (r *RedactionRule) String() string {
+	var parts []string
+	if r.Type != "" {
+		parts = append(parts, "type "+r.Type)
+	}
+	if r.Attribute != "" {
+		parts = append(parts, "attribute "+r.Attribute)
+	}
+	if r.Value != "" {
+		parts = append(parts, "value "+r.Value)
+	}
+	return "rule " + strings.Join(parts, ", ")
+}
+
+// appliesTo reports whether the rule covers objects of the resource type ("" for outputs)
+func (r *RedactionRule) appliesTo(typ string) bool {
+	if r.Type == "" {
+		return true
+	}
+	ok, _ := path.Match(r.Type, typ)
+	return typ != "" && ok
+}
+
+// Redaction records a value removed from a plan
+type Redaction struct {
+	// Address is the resource, output or variable the value belonged to
+	Address string `json:"address"`
+	// Path is the attribute within it, if any
+	Path   string `json:"path,omitempty"`
+	Reason string `json:"reason"`
+}
+
+func (r Redaction) String() string {
+	if r.Path == "" {
+		return fmt.Sprintf("%s (%s)", r.Address, r.Reason)
+	}
+	return fmt.Sprintf("%s: %s (%s)", r.Address, r.Path, r.Reason)
+}
+
+// Redact replaces every value terraform marked as sensitive anywhere in the plan, and everything matched by the rules,
+// which must have been compiled.  Sensitive values must never leave the agent, and the server does it again in case an
+// agent didn't.  It returns what was removed.
+func Redact(plan *tfjson.Plan, rules ...RedactionRule) []Redaction {
+	if plan == nil {
+		return nil
+	}
+
+	r := &redactor{rules: rules}
+
+	for _, rc := range plan.ResourceChanges {
+		if rc == nil || rc.Change == nil {
+			continue
+		}
+		rc.Change.Before = r.object(rc.Address, rc.Type, "before", rc.Change.Before, rc.Change.BeforeSensitive)
+		rc.Change.After = r.object(rc.Address, rc.Type, "after", rc.Change.After, rc.Change.AfterSensitive)
+	}
+
+	for name, c := range plan.OutputChanges {
+		if c == nil {
+			continue
+		}
+		c.Before = r.object("output."+name, "", "before", c.Before, c.BeforeSensitive)
+		c.After = r.object("output."+name, "", "after", c.After, c.AfterSensitive)
+	}
+
+	r.stateValues(plan.PlannedValues, "planned")
+	if plan.PriorState != nil {
+		r.stateValues(plan.PriorState.Values, "prior")
+	}
+
+	if plan.Config != nil {
+		r.configModule(plan.Config.RootModule, "")
+
+		if plan.Config.RootModule != nil {
+			for name, v := range plan.Variables {
+				if cv, ok := plan.Config.RootModule.Variables[name]; ok && cv.Sensitive && v != nil {
+					v.Value = r.all("var."+name, "", v.Value, reasonSensitive)
+				}
+			}
+		}
+	}
+
+	return r.found
+}
+
+// redactor walks a plan, remembering what it removed
+type redactor struct {
+	rules []RedactionRule
+	found []Redaction
+}
+
+// object redacts a single resource or output value.  Which tells which of its values it is (e.g. before or after).
+func (r *redactor) object(address, typ, which string, value, sensitive interface{}) interface{} {
+	value = r.sensitive(address, []string{which}, value, sensitive)
+
+	for i := range r.rules {
+		rule := &r.rules[i]
+		if rule.appliesTo(typ) {
+			value = r.rule(address, rule, []string{which}, 1, value)
+		}
+	}
+
+	return value
+}
+
+// sensitive replaces the parts of value marked in sensitive, which is either true or has the same shape as value
+func (r *redactor) sensitive(address string, at []string, value, sensitive interface{}) interface{} {
+	switch s := sensitive.(type) {
+	case bool:
+		if s {
+			return r.all(address, strings.Join(at, "."), value, reasonSensitive)
+		}
+	case map[string]interface{}:
+		if v, ok := value.(map[string]interface{}); ok {
+			for k, sk := range s {
+				if _, present := v[k]; present {
+					v[k] = r.sensitive(address, extend(at, k), v[k], sk)
+				}
+			}
+		}
+	case []interface{}:
+		if v, ok := value.([]interface{}); ok {
+			for i := range v {
+				if i < len(s) {
+					v[i] = r.sensitive(address, extend(at, strconv.Itoa(i)), v[i], s[i])
+				}
+			}
+		}
+	}
+
+	return value
+}
+
+// rule applies a rule to value, found at path.  The first skip parts of the path are not attributes.
+func (r *redactor) rule(address string, rule *RedactionRule, at []string, skip int, value interface{}) interface{} {
+	attribute := at[skip:]
+
+	if len(rule.attribute) > 0 {
+		if !matchPath(rule.attribute, attribute) {
+			return value
+		}
+
+		if len(attribute) == len(rule.attribute) {
+			if rule.value == nil {
+				return r.all(address, strings.Join(at, "."), value, rule.String())
+			}
+			return r.matching(address, rule, at, value)
+		}
+	} else if rule.value != nil {
+		return r.matching(address, rule, at, value)
+	}
+
+	return r.children(value, at, func(child []string, v interface{}) interface{} {
+		return r.rule(address, rule, child, skip, v)
+	})
+}
+
+// matching replaces the parts of every string in value which match the rule's expression
+func (r *redactor) matching(address string, rule *RedactionRule, at []string, value interface{}) interface{} {
+	if s, ok := value.(string); ok {
+		if s == Redacted || !rule.value.MatchString(s) {
+			return s
+		}
+		r.found = append(r.found, Redaction{Address: address, Path: strings.Join(at, "."), Reason: rule.String()})
+		return rule.value.ReplaceAllString(s, Redacted)
+	}
+
+	return r.children(value, at, func(child []string, v interface{}) interface{} {
+		return r.matching(address, rule, child, v)
+	})
+}
+
+// children replaces each element of a map or list with the result of f
+func (r *redactor) children(value interface{}, at []string, f func(at []string, v interface{}) interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for k := range v {
+			v[k] = f(extend(at, k), v[k])
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = f(extend(at, strconv.Itoa(i)), v[i])
+		}
+	}
+	return value
+}
+
+// all replaces a whole value.  Null values are left alone since they give nothing away.
+func (r *redactor) all(address, at string, value interface{}, reason string) interface{} {
+	if value == nil || value == Redacted {
+		return value
+	}
+
+	r.found = append(r.found, Redaction{Address: address, Path: at, Reason: reason})
+	return Redacted
+}
+
+func (r *redactor) stateValues(values *tfjson.StateValues, which string) {
+	if values == nil {
+		return
+	}
+
+	for name, o := range values.Outputs {
+		if o == nil {
+			continue
+		}
+		var sensitive interface{} = o.Sensitive
+		o.Value = r.object("output."+name, "", which, o.Value, sensitive)
+	}
+
+	r.stateModule(values.RootModule, which)
+}
+
+func (r *redactor) stateModule(module *tfjson.StateModule, which string) {
+	if module == nil {
+		return
+	}
+
+	for _, res := range module.Resources {
+		if res == nil {
+			continue
+		}
+
+		var sensitive interface{}
+		if len(res.SensitiveValues) > 0 {
+			if err := json.Unmarshal(res.SensitiveValues, &sensitive); err != nil {
+				// If we can't tell what's sensitive, assume everything is
+				sensitive = true
+			}
+		}
+
+		if redacted, ok := r.object(res.Address, res.Type, which, map[string]interface{}(res.AttributeValues), sensitive).(map[string]interface{}); ok {
+			res.AttributeValues = redacted
+		} else {
+			res.AttributeValues = nil
+		}
+	}
+
+	for _, child := range module.ChildModules {
+		r.stateModule(child, which)
+	}
+}
+
+func (r *redactor) configModule(module *tfjson.ConfigModule, prefix string) {
+	if module == nil {
+		return
+	}
+
+	for name, v := range module.Variables {
+		if v != nil && v.Sensitive {
+			v.Default = r.all(prefix+"var."+name, "default", v.Default, reasonSensitive)
+		}
+	}
+
+	for name, o := range module.Outputs {
+		if o != nil && o.Sensitive && o.Expression != nil && o.Expression.ExpressionData != nil {
+			o.Expression.ConstantValue = r.all(prefix+"output."+name, "expression", o.Expression.ConstantValue, reasonSensitive)
+		}
+	}
+
+	// Only constants written in the configuration can be redacted.  Anything else is not known until later.
+	for _, res := range module.Resources {
+		if res == nil {
+			continue
+		}
+
+		constants := make(map[string]interface{})
+		for k, e := range res.Expressions {
+			if e != nil && e.ExpressionData != nil && e.ConstantValue != nil {
+				constants[k] = e.ConstantValue
+			}
+		}
+
+		constants = r.object(prefix+res.Address, res.Type, "configuration", constants, nil).(map[string]interface{})
+		for k, v := range constants {
+			res.Expressions[k].ConstantValue = v
+		}
+	}
+
+	for name, call := range module.ModuleCalls {
+		if call != nil {
+			r.configModule(call.Module, prefix+"module."+name+".")
+		}
+	}
+}
+
+// extend returns a new path with part added
+func extend(at []string, part string) []string {
+	return append(at[:len(at):len(at)], part)
+}
+
+// matchPath reports whether the pattern matches the start of an attribute path, part by part
+func matchPath(pattern, attribute []string) bool {
+	for i, p := range pattern {
+		if i >= len(attribute) {
+			return true
+		}
+		if ok, _ := path.Match(p, attribute[i]); !ok {
+			return false
+		}
+	}
+	return len(attribute) <= len(pattern)
+}
@@ -0,0 +1,184 @@
+package terraform
+
+import (
+	"encoding/json"
+	tfjson "github.com/hashicorp/terraform-json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// sensitivePlan has the secret "hunter2" everywhere terraform puts sensitive values
+const sensitivePlan = `{
+  "format_version": "1.1",
+  "variables": {"db_password": {"value": "hunter2"}, "region": {"value": "us-east-1"}},
+  "planned_values": {
+    "outputs": {"password": {"sensitive": true, "value": "hunter2"}, "host": {"sensitive": false, "value": "db.example.com"}},
+    "root_module": {
+      "child_modules": [{
+        "address": "module.db",
+        "resources": [{
+          "address": "module.db.aws_db_instance.main", "mode": "managed", "type": "aws_db_instance", "name": "main",
+          "values": {"username": "admin", "password": "hunter2", "tags": {"env": "prod", "token": "hunter2"}},
+          "sensitive_values": {"password": true, "tags": {"token": true}}
+        }]
+      }]
+    }
+  },
+  "resource_changes": [{
+    "address": "aws_db_instance.main", "mode": "managed", "type": "aws_db_instance", "name": "main",
+    "change": {
+      "actions": ["update"],
+      "before": {"username": "admin", "password": "hunter2", "users": [{"name": "a", "key": "hunter2"}]},
+      "after": {"username": "admin", "password": "hunter2", "users": [{"name": "a", "key": "hunter2"}]},
+      "before_sensitive": {"password": true, "users": [{"key": true}]},
+      "after_sensitive": {"password": true, "users": [{"key": true}]}
+    }
+  }],
+  "output_changes": {
+    "password": {"actions": ["no-op"], "before": "hunter2", "after": "hunter2", "before_sensitive": true, "after_sensitive": true}
+  },
+  "prior_state": {
+    "format_version": "1.0",
+    "values": {
+      "outputs": {"password": {"sensitive": true, "value": "hunter2"}},
+      "root_module": {
+        "resources": [{
+          "address": "random_password.db", "mode": "managed", "type": "random_password", "name": "db",
+          "values": {"length": 16, "result": "hunter2"},
+          "sensitive_values": {"result": true}
+        }]
+      }
+    }
+  },
+  "configuration": {
+    "root_module": {
+      "variables": {"db_password": {"default": "hunter2", "sensitive": true}, "region": {"default": "us-east-1"}},
+      "outputs": {"password": {"sensitive": true, "expression": {"constant_value": "hunter2"}}},
+      "module_calls": {
+        "db": {"source": "./db", "module": {"variables": {"password": {"default": "hunter2", "sensitive": true}}}}
+      }
+    }
+  }
+}`
+
+func TestRedact(t *testing.T) {
+	plan := &tfjson.Plan{}
+	require.NoError(t, json.Unmarshal([]byte(sensitivePlan), plan))
+
+	Redact(plan)
+
+	b, err := json.Marshal(plan)
+	require.NoError(t, err)
+	assert.NotContains(t, string(b), "hunter2")
+
+	// Only the sensitive values are removed
+	assert.Contains(t, string(b), "db.example.com")
+	assert.Contains(t, string(b), `"username":"admin"`)
+	assert.Contains(t, string(b), `"env":"prod"`)
+	assert.Equal(t, "us-east-1", plan.Variables["region"].Value)
+	assert.Equal(t, "us-east-1", plan.Config.RootModule.Variables["region"].Default)
+
+	after := plan.ResourceChanges[0].Change.After.(map[string]interface{})
+	assert.Equal(t, Redacted, after["password"])
+	assert.Equal(t, Redacted, after["users"].([]interface{})[0].(map[string]interface{})["key"])
+	assert.Equal(t, "a", after["users"].([]interface{})[0].(map[string]interface{})["name"])
+
+	assert.NotPanics(t, func() {
+		Redact(nil)
+		Redact(&tfjson.Plan{ResourceChanges: []*tfjson.ResourceChange{{}}})
+	})
+}
+
+func TestReadPlan_redacts(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "plan.json")
+	require.NoError(t, os.WriteFile(file, []byte(sensitivePlan), 0644))
+
+	summary, err := ReadPlan(file)
+	require.NoError(t, err)
+
+	b, err := json.Marshal(summary.(*JSonPlanSummary).Plan)
+	require.NoError(t, err)
+	assert.False(t, strings.Contains(string(b), "hunter2"), "sensitive values are removed from stored plans")
+}
+
+const rulesPlan = `{
+  "format_version": "1.1",
+  "resource_changes": [{
+    "address": "aws_instance.web", "mode": "managed", "type": "aws_instance", "name": "web",
+    "change": {
+      "actions": ["create"],
+      "before": null,
+      "after": {"ami": "ami-123", "user_data": "#!/bin/sh\nexport DB=postgres://app:hunter2@db/app", "tags": {"Name": "web", "conn": "Server=db;Password=hunter2"}},
+      "after_sensitive": {}
+    }
+  }, {
+    "address": "aws_s3_bucket.logs", "mode": "managed", "type": "aws_s3_bucket", "name": "logs",
+    "change": {
+      "actions": ["create"],
+      "after": {"bucket": "logs", "user_data": "not an instance", "tags": {"conn": "Server=db;Password=hunter2"}}
+    }
+  }],
+  "output_changes": {
+    "url": {"actions": ["create"], "after": "postgres://app:hunter2@db/app"}
+  },
+  "configuration": {
+    "root_module": {
+      "resources": [{
+        "address": "aws_instance.web", "mode": "managed", "type": "aws_instance", "name": "web",
+        "expressions": {"ami": {"constant_value": "ami-123"}, "user_data": {"constant_value": "secret script"}}
+      }]
+    }
+  }
+}`
+
+func TestRedact_rules(t *testing.T) {
+	rules := []RedactionRule{
+		{Type: "aws_instance", Attribute: "user_data"},
+		{Attribute: "tags.*", Value: `Password=[^;]*`},
+		{Value: `://[^:]+:[^@]+@`},
+	}
+	for i := range rules {
+		require.NoError(t, rules[i].Compile())
+	}
+
+	plan := &tfjson.Plan{}
+	require.NoError(t, json.Unmarshal([]byte(rulesPlan), plan))
+
+	redactions := Redact(plan, rules...)
+
+	b, err := json.Marshal(plan)
+	require.NoError(t, err)
+	assert.NotContains(t, string(b), "hunter2")
+	assert.NotContains(t, string(b), "secret script")
+
+	web := plan.ResourceChanges[0].Change.After.(map[string]interface{})
+	assert.Equal(t, Redacted, web["user_data"])
+	assert.Equal(t, "ami-123", web["ami"])
+	assert.Equal(t, "Server=db;[REDACTED]", web["tags"].(map[string]interface{})["conn"])
+	assert.Equal(t, "web", web["tags"].(map[string]interface{})["Name"])
+
+	logs := plan.ResourceChanges[1].Change.After.(map[string]interface{})
+	assert.Equal(t, "not an instance", logs["user_data"], "type rules only apply to their types")
+
+	assert.Equal(t, "postgres[REDACTED]db/app", plan.OutputChanges["url"].After)
+	assert.Equal(t, "ami-123", plan.Config.RootModule.Resources[0].Expressions["ami"].ConstantValue)
+
+	assert.Contains(t, redactions, Redaction{Address: "aws_instance.web", Path: "after.user_data", Reason: "rule type aws_instance, attribute user_data"})
+	assert.Contains(t, redactions, Redaction{Address: "aws_s3_bucket.logs", Path: "after.tags.conn", Reason: `rule attribute tags.*, value Password=[^;]*`})
+	assert.Contains(t, redactions, Redaction{Address: "output.url", Path: "after", Reason: `rule value ://[^:]+:[^@]+@`})
+	assert.Contains(t, redactions, Redaction{Address: "aws_instance.web", Path: "configuration.user_data", Reason: "rule type aws_instance, attribute user_data"})
+}
+
+func TestRedactionRule_Compile(t *testing.T) {
+	for name, rule := range map[string]RedactionRule{
+		"empty":       {Type: "aws_instance"},
+		"bad pattern": {Attribute: "tags.[x"},
+		"bad regex":   {Value: "(unclosed"},
+	} {
+		assert.Error(t, rule.Compile(), name)
+	}
+}
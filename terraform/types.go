@@ -1,3 +1,6 @@
 package terraform
 
 type Workspace string
+
+// DefaultWorkspace is the workspace terraform uses unless told otherwise
+const DefaultWorkspace Workspace = "default"